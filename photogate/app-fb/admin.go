@@ -0,0 +1,434 @@
+package appfb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen"
+	"gitlab.sendo.vn/system/photogate/templatestore"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	viper.SetDefault("fb.frame.maxBytes", 10<<20)
+	viper.SetDefault("fb.frame.maxPixels", 4000*4000)
+}
+
+const (
+	previewWidth          = 800
+	previewPrice          = 1234000
+	previewPromotionPrice = 999000
+	// form fields and multipart headers of a template form, besides the frame
+	formOverhead = 1 << 20
+)
+
+// management of fb templates, under /internal/fb/templates:
+//
+//	GET    /templates         list templates
+//	GET    /templates/{name}  config of the template
+//	POST   /templates         create from form: file (png frame), name, price texts
+//	PUT    /templates/{name}  update from form: file and/or price texts
+//	DELETE /templates/{name}  refused while the template is still rendered
+//	DELETE /cache/{name}      purge the cached renders of the template
+//
+// templates are saved to the template store, built-in templates are
+// overridden by an update but can not be deleted
+func (ps *fbImageService) registerAdminRoutes(r *mux.Router) {
+	r.Methods("GET").Path("/templates").HandlerFunc(ps.handleListTemplates).Name("LIST_FB_TEMPLATES")
+	r.Methods("GET").Path("/templates/{name}").HandlerFunc(ps.handleGetTemplate).Name("GET_FB_TEMPLATE")
+	r.Methods("POST").Path("/templates").HandlerFunc(ps.handleCreateTemplate).Name("CREATE_FB_TEMPLATE")
+	r.Methods("PUT").Path("/templates/{name}").HandlerFunc(ps.handleUpdateTemplate).Name("UPDATE_FB_TEMPLATE")
+	r.Methods("DELETE").Path("/templates/{name}").HandlerFunc(ps.handleDeleteTemplate).Name("DELETE_FB_TEMPLATE")
+	r.Methods("DELETE").Path("/cache/{name}").HandlerFunc(ps.handlePurgeCache).Name("PURGE_FB_CACHE")
+}
+
+func checkAllowedRole(r *http.Request, c jwtauthen.Claims) bool {
+	route := mux.CurrentRoute(r)
+	switch name := route.GetName(); name {
+	case "LIST_FB_TEMPLATES", "GET_FB_TEMPLATE":
+		requireRole := "photogate.fb.viewer"
+		requireAdminRole := "photogate.fb.admin"
+		return c.ContainRole(requireRole) || c.ContainRole(requireAdminRole)
+	case "CREATE_FB_TEMPLATE", "UPDATE_FB_TEMPLATE", "DELETE_FB_TEMPLATE", "PURGE_FB_CACHE":
+		requireAdminRole := "photogate.fb.admin"
+		return c.ContainRole(requireAdminRole)
+	}
+	return false
+}
+
+func defaultTemplateConfig() ImageTemplateConfig {
+	return ImageTemplateConfig{
+		PriceOnly: TextConfig{
+			Top:            0.932,
+			Right:          0.17,
+			VerticalCenter: true,
+			Height:         0.042,
+			FontURI:        "2020-02/UTMAVO-REGULAR.TTF",
+			Color:          "#fffefe",
+		},
+		PriceOrig: TextConfig{
+			Top:            0.913,
+			Right:          0.17,
+			VerticalCenter: true,
+			Height:         0.025,
+			FontURI:        "2020-02/UTMAVO-REGULAR.TTF",
+			Color:          "#ffffff",
+			StrikeThrough:  0.07,
+			StrikeFull:     true,
+			StrikePos:      0.55,
+		},
+		PricePromo: TextConfig{
+			Top:            0.932,
+			Right:          0.17,
+			VerticalCenter: true,
+			Height:         0.042,
+			FontURI:        "2020-02/UTMAVO-REGULAR.TTF",
+			Color:          "#fffefe",
+		},
+	}
+}
+
+type fbTemplateInfo struct {
+	Name string
+	// active version in the template store, 0 for a built-in template
+	Version int
+	// renders in the last fb.keepUsedDays days
+	Renders int64
+	Config  *ImageTemplateConfig `json:",omitempty"`
+	// data url of a sample rendered by create and update
+	Preview string `json:",omitempty"`
+}
+
+func (ps *fbImageService) templateInfo(name string) (*fbTemplateInfo, error) {
+	info := &fbTemplateInfo{Name: name}
+	tv, err := ps.store.Get("fb", name, 0)
+	if err == nil {
+		info.Version = tv.Version
+	} else if !errors.Is(err, templatestore.ErrNotFound) {
+		return nil, err
+	}
+
+	info.Renders, err = ps.usage.rendersSince(name, viper.GetInt("fb.keepUsedDays"))
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (ps *fbImageService) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	ps.tmplsMu.RLock()
+	names := make([]string, 0, len(ps.tmpls))
+	for name := range ps.tmpls {
+		names = append(names, name)
+	}
+	ps.tmplsMu.RUnlock()
+	sort.Strings(names)
+
+	infos := make([]*fbTemplateInfo, 0, len(names))
+	for _, name := range names {
+		info, err := ps.templateInfo(name)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		infos = append(infos, info)
+	}
+	respondData(w, http.StatusOK, infos)
+}
+
+func (ps *fbImageService) handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	tmpl, ok := ps.getTemplate(name)
+	if !ok {
+		respondError(w, http.StatusNotFound, "template not found")
+		return
+	}
+
+	info, err := ps.templateInfo(name)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	info.Config = tmpl.cfg
+	respondData(w, http.StatusOK, info)
+}
+
+// uploaded frame, decoded and checked. nil when the form has no file
+// parse the form of a create or update request, reading at most a frame
+// and formOverhead from the body. responds and returns false on error
+func parseTemplateForm(w http.ResponseWriter, r *http.Request) bool {
+	maxBytes := viper.GetInt64("fb.frame.maxBytes") + formOverhead
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	err := r.ParseMultipartForm(maxBytes)
+	if err == nil || errors.Is(err, http.ErrNotMultipart) {
+		return true
+	}
+	// the error of MaxBytesReader has no type before go 1.19
+	if strings.Contains(err.Error(), "request body too large") {
+		respondError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("form is larger than %d bytes", maxBytes))
+	} else {
+		respondError(w, http.StatusBadRequest, err.Error())
+	}
+	return false
+}
+
+func readFrameImage(r *http.Request) ([]byte, image.Image, error) {
+	file, _, err := r.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	maxBytes := viper.GetInt64("fb.frame.maxBytes")
+	b, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(b)) > maxBytes {
+		return nil, nil, fmt.Errorf("frame is larger than %d bytes", maxBytes)
+	}
+
+	// size from the header, before decoding all pixels
+	c, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	if format != "png" {
+		return nil, nil, fmt.Errorf("frame must be a png, not %s", format)
+	}
+	if maxPixels := viper.GetInt64("fb.frame.maxPixels"); int64(c.Width)*int64(c.Height) > maxPixels {
+		return nil, nil, fmt.Errorf("frame %dx%d has more than %d pixels", c.Width, c.Height, maxPixels)
+	}
+	if !hasAlpha(c.ColorModel) {
+		return nil, nil, errors.New("frame must have an alpha channel")
+	}
+
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return nil, nil, errors.New("frame has no transparent area for the product")
+	}
+	return b, img, nil
+}
+
+func hasAlpha(m color.Model) bool {
+	switch m {
+	case color.NRGBAModel, color.NRGBA64Model, color.RGBAModel, color.RGBA64Model:
+		return true
+	}
+	if p, ok := m.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a < 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// price texts must be drawn inside the image
+func (tc *TextConfig) validate() error {
+	if tc.Top < 0 || tc.Top > 1 || tc.Right < 0 || tc.Right > 1 {
+		return errors.New("top and right must be in [0, 1]")
+	}
+	if tc.Height <= 0 || tc.Height > 0.5 {
+		return errors.New("height must be in (0, 0.5]")
+	}
+	return nil
+}
+
+// product image of the preview, gray to show the transparent area
+func previewImage(frame image.Image) image.Image {
+	size := frame.Bounds().Size()
+	if size.X > previewWidth {
+		size = image.Pt(previewWidth, size.Y*previewWidth/size.X)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{0xcc}), image.Point{}, draw.Src)
+	return img
+}
+
+// apply the form of a create or update request to cfg and save it.
+// price texts are overridden by form values priceOnly, priceOrig and
+// pricePromo, yaml of TextConfig. a sample is rendered before saving
+// and returned as preview
+func (ps *fbImageService) saveTemplate(w http.ResponseWriter, r *http.Request, name string, cfg *ImageTemplateConfig, comment string) {
+	if err := templatestore.CheckName("fb", name); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	texts := []struct {
+		key string
+		tc  *TextConfig
+	}{
+		{"priceOnly", &cfg.PriceOnly},
+		{"priceOrig", &cfg.PriceOrig},
+		{"pricePromo", &cfg.PricePromo},
+	}
+	for _, t := range texts {
+		if s := r.FormValue(t.key); s != "" {
+			if err := decodeTextConfig(s, t.tc); err != nil {
+				respondError(w, http.StatusBadRequest, t.key+": "+err.Error())
+				return
+			}
+		}
+		if err := t.tc.validate(); err != nil {
+			respondError(w, http.StatusBadRequest, t.key+": "+err.Error())
+			return
+		}
+	}
+
+	b, frame, err := readFrameImage(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "frame: "+err.Error())
+		return
+	}
+	if frame == nil && cfg.FrameURI == "" {
+		respondError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+
+	var tmpl *ImageTemplate
+	if frame != nil {
+		tmpl, err = newImageTemplate(cfg, frame)
+	} else {
+		tmpl, err = NewImageTemplate(cfg)
+	}
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	preview := tmpl.GenerateFromImage(previewImage(tmpl.origFrame), previewPrice, previewPromotionPrice)
+
+	if frame != nil {
+		cfg.FrameURI = fmt.Sprintf("fb-frames/%s/%d.png", name, utils.MakeTimestamp())
+		if err = ps.store.PutAsset(cfg.FrameURI, b); err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	y, err := yaml.Marshal(cfg)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if c := r.FormValue("comment"); c != "" {
+		comment = c
+	}
+	tv, err := ps.store.Save("fb", name, y, comment, true)
+	var verr *templatestore.ValidationError
+	if errors.As(err, &verr) {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondData(w, http.StatusOK, &fbTemplateInfo{
+		Name:    name,
+		Version: tv.Version,
+		Config:  cfg,
+		Preview: "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(preview),
+	})
+}
+
+func (ps *fbImageService) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+	if !parseTemplateForm(w, r) {
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = strconv.FormatInt(utils.MakeTimestamp(), 10)
+	}
+	if _, ok := ps.getTemplate(name); ok {
+		respondError(w, http.StatusConflict, "template already exists")
+		return
+	}
+
+	cfg := defaultTemplateConfig()
+	ps.saveTemplate(w, r, name, &cfg, "created")
+}
+
+func (ps *fbImageService) handleUpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := ps.getTemplate(name); !ok {
+		respondError(w, http.StatusNotFound, "template not found")
+		return
+	}
+	if !parseTemplateForm(w, r) {
+		return
+	}
+
+	// the yaml instead of the loaded config, which has defaults applied
+	b, err := fs.ReadFile(ps.static, "fb-templates/"+name+".yaml")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg, err := loadImageTemplateConfig(string(b))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ps.saveTemplate(w, r, name, cfg, "updated")
+}
+
+func (ps *fbImageService) handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := ps.getTemplate(name); !ok {
+		respondError(w, http.StatusNotFound, "template not found")
+		return
+	}
+
+	_, err := ps.store.Get("fb", name, 0)
+	if errors.Is(err, templatestore.ErrNotFound) {
+		respondError(w, http.StatusBadRequest, "built-in template can not be deleted")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	days := viper.GetInt("fb.keepUsedDays")
+	renders, err := ps.usage.rendersSince(name, days)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if renders > 0 {
+		respondError(w, http.StatusConflict,
+			fmt.Sprintf("template was rendered %d times in the last %d days", renders, days))
+		return
+	}
+
+	if err = ps.store.Delete("fb", name); err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondData(w, http.StatusOK, "success")
+}
@@ -0,0 +1,204 @@
+package appfb
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/database"
+	"gitlab.sendo.vn/system/photogate/templatestore"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// transparent frame with an opaque border
+func testFrame() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	draw.Draw(img, image.Rect(0, 90, 100, 100), image.NewUniform(color.White), image.Point{}, draw.Src)
+	return img
+}
+
+func encodeImage(t *testing.T, img image.Image, format string) []byte {
+	buf := &bytes.Buffer{}
+	if format == "png" {
+		require.NoError(t, png.Encode(buf, img))
+	} else {
+		require.NoError(t, jpeg.Encode(buf, img, nil))
+	}
+	return buf.Bytes()
+}
+
+func formBody(t *testing.T, fields map[string]string, frame []byte) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for k, v := range fields {
+		require.NoError(t, mw.WriteField(k, v))
+	}
+	if frame != nil {
+		fw, err := mw.CreateFormFile("file", "frame.png")
+		require.NoError(t, err)
+		_, err = fw.Write(frame)
+		require.NoError(t, err)
+	}
+	require.NoError(t, mw.Close())
+	return body, mw.FormDataContentType()
+}
+
+func TestTemplateAdmin(t *testing.T) {
+	viper.Set("database.dsn", filepath.Join(t.TempDir(), "test.db"))
+	store, err := templatestore.New(database.DB())
+	require.NoError(t, err)
+	fsys := utils.NewOverlayFS(store.FS(), os.DirFS("../static"))
+	utils.Init(fsys)
+
+	ps, err := NewFbImageService("https://media3/", fsys, store)
+	require.NoError(t, err)
+	store.OnChange(ps.ReloadTemplates)
+	r := mux.NewRouter()
+	ps.registerAdminRoutes(r)
+
+	frame := encodeImage(t, testFrame(), "png")
+	do := func(method, url string, fields map[string]string, frame []byte) *httptest.ResponseRecorder {
+		body, contentType := formBody(t, fields, frame)
+		req := httptest.NewRequest(method, url, body)
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodPost, "/templates", map[string]string{"name": "sale"}, nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "file is required")
+
+	w = do(http.MethodPost, "/templates", map[string]string{
+		"name":      "sale",
+		"priceOnly": "color: '#000000'",
+	}, frame)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var info fbTemplateInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	require.True(t, strings.HasPrefix(info.Preview, "data:image/jpeg;base64,"))
+	tmpl, ok := ps.getTemplate("sale")
+	require.True(t, ok)
+	require.Equal(t, "#000000", tmpl.cfg.PriceOnly.Color)
+	require.Equal(t, float32(0.932), tmpl.cfg.PriceOnly.Top)
+	frameURI := tmpl.cfg.FrameURI
+
+	w = do(http.MethodPost, "/templates", map[string]string{"name": "sale"}, frame)
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	w = do(http.MethodPut, "/templates/sale", map[string]string{"priceOrig": "height: 0.03"}, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	tmpl, _ = ps.getTemplate("sale")
+	require.Equal(t, 0.03, tmpl.cfg.PriceOrig.Height)
+	require.Equal(t, "#000000", tmpl.cfg.PriceOnly.Color)
+	require.Equal(t, frameURI, tmpl.cfg.FrameURI)
+
+	w = do(http.MethodPut, "/templates/sale", map[string]string{"pricePromo": "top: 1.5"}, nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "pricePromo: top and right must be in [0, 1]")
+
+	// the body is limited before the form is read
+	viper.Set("fb.frame.maxBytes", 10)
+	w = do(http.MethodPut, "/templates/sale", map[string]string{"comment": strings.Repeat("a", formOverhead)}, nil)
+	viper.Set("fb.frame.maxBytes", 10<<20)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+
+	w = do(http.MethodGet, "/templates/sale", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	info = fbTemplateInfo{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	require.Equal(t, 2, info.Version)
+	require.EqualValues(t, 0, info.Renders)
+
+	w = do(http.MethodGet, "/templates", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"Name":"012023","Version":0`)
+
+	w = do(http.MethodDelete, "/templates/012023", nil, nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	ps.usage.record("sale")
+	w = do(http.MethodDelete, "/templates/sale", nil, nil)
+	require.Equal(t, http.StatusConflict, w.Code)
+	require.Contains(t, w.Body.String(), "rendered 1 times")
+
+	viper.Set("fb.keepUsedDays", 0)
+	defer viper.Set("fb.keepUsedDays", 30)
+	w = do(http.MethodDelete, "/templates/sale", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	_, ok = ps.getTemplate("sale")
+	require.False(t, ok)
+	w = do(http.MethodDelete, "/templates/sale", nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUsageFlushOnStop(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "usage.db")))
+	require.NoError(t, err)
+	u, err := newUsageRecorder(db, zerolog.Nop())
+	require.NoError(t, err)
+
+	for _, interval := range []time.Duration{time.Hour, 0} {
+		u.record("flushed")
+		stop, done := make(chan struct{}), make(chan struct{})
+		go func() {
+			u.run(interval, stop)
+			close(done)
+		}()
+		close(stop)
+		<-done
+
+		var usage FbTemplateUsage
+		require.NoError(t, u.db.Where(map[string]interface{}{"Template": "flushed"}).First(&usage).Error)
+		require.EqualValues(t, 1, usage.Renders)
+		require.NoError(t, u.db.Where("template = ?", "flushed").Delete(&FbTemplateUsage{}).Error)
+	}
+}
+
+func TestReadFrameImage(t *testing.T) {
+	read := func(frame []byte) error {
+		body, contentType := formBody(t, nil, frame)
+		req := httptest.NewRequest(http.MethodPost, "/templates", body)
+		req.Header.Set("Content-Type", contentType)
+		_, _, err := readFrameImage(req)
+		return err
+	}
+
+	require.NoError(t, read(encodeImage(t, testFrame(), "png")))
+	require.NoError(t, read(nil))
+
+	require.EqualError(t, read(encodeImage(t, testFrame(), "jpeg")), "frame must be a png, not jpeg")
+	require.EqualError(t, read(encodeImage(t, image.NewGray(image.Rect(0, 0, 10, 10)), "png")),
+		"frame must have an alpha channel")
+
+	opaque := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(opaque, opaque.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	require.EqualError(t, read(encodeImage(t, opaque, "png")), "frame has no transparent area for the product")
+
+	viper.Set("fb.frame.maxPixels", 99)
+	defer viper.Set("fb.frame.maxPixels", 4000*4000)
+	require.EqualError(t, read(encodeImage(t, testFrame(), "png")), "frame 100x100 has more than 99 pixels")
+
+	viper.Set("fb.frame.maxBytes", 10)
+	defer viper.Set("fb.frame.maxBytes", 10<<20)
+	require.EqualError(t, read(encodeImage(t, testFrame(), "png")), "frame is larger than 10 bytes")
+}
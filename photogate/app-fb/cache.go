@@ -0,0 +1,38 @@
+package appfb
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+)
+
+// key of a render in the render cache by the template version, the source
+// and the prices as they are drawn
+func renderCacheKey(name string, tmpl *ImageTemplate, upstream string, params url.Values, format imghelper.Format) string {
+	price, promotionPrice, ok := prices(params)
+	if !ok {
+		return rendercache.Key(name, tmpl.version, string(format), upstream)
+	}
+	return rendercache.Key(name, tmpl.version, string(format), upstream,
+		strconv.Itoa(price), strconv.Itoa(promotionPrice))
+}
+
+// renders of templates changed or removed by a reload are never served
+// again, free their space
+func (ps *fbImageService) purgeChanged(prev, tmpls map[string]*ImageTemplate) {
+	for name, old := range prev {
+		if t, ok := tmpls[name]; !ok || t.version != old.version {
+			ps.cache.Purge(name)
+		}
+	}
+}
+
+// responds how many renders were purged
+func (ps *fbImageService) handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	n := ps.cache.Purge(mux.Vars(r)["name"])
+	respondData(w, http.StatusOK, map[string]int{"purged": n})
+}
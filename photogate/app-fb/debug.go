@@ -10,9 +10,11 @@ import (
 
 func (ps *fbImageService) handleDebugListTemplates(w http.ResponseWriter, r *http.Request) {
 	tmpls := []string{}
+	ps.tmplsMu.RLock()
 	for t := range ps.tmpls {
 		tmpls = append(tmpls, t)
 	}
+	ps.tmplsMu.RUnlock()
 
 	b, err := json.Marshal(tmpls)
 	if err != nil {
@@ -26,7 +28,7 @@ func (ps *fbImageService) handleDebugListTemplates(w http.ResponseWriter, r *htt
 
 func (ps *fbImageService) handleDebugConfig(w http.ResponseWriter, r *http.Request) {
 	template := r.URL.Query().Get("template")
-	tmpl, ok := ps.tmpls[template]
+	tmpl, ok := ps.getTemplate(template)
 	if !ok {
 		w.WriteHeader(400)
 		w.Write([]byte("template not found"))
@@ -58,5 +60,5 @@ func (ps *fbImageService) handleDebugImage(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	ps._process(w, params, tmpl)
+	ps._process(w, r, "", params, tmpl)
 }
@@ -1,28 +1,27 @@
 package appfb
 
 import (
-	"bytes"
 	"encoding/json"
-	"image"
-	"io"
 	"io/fs"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
+	"gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen"
+	jwtmux "gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen/mux"
+	"gitlab.sendo.vn/system/photogate/database"
 	"gitlab.sendo.vn/system/photogate/downloader"
 	"gitlab.sendo.vn/system/photogate/logger"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+	"gitlab.sendo.vn/system/photogate/templatestore"
 	"gitlab.sendo.vn/system/photogate/utils"
-	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -47,19 +46,27 @@ type fbImageService struct {
 	mr *mux.Router
 	ir *mux.Router
 
-	tmpls    map[string]*ImageTemplate
+	// replaced as a whole by ReloadTemplates
+	tmpls   map[string]*ImageTemplate
+	tmplsMu sync.RWMutex
+	static  fs.FS
+	// one reload at a time, each builds on the templates of the last
+	reloadMu sync.Mutex
+	store    *templatestore.Store
+	usage    *usageRecorder
 	upstream string
+	cache    *rendercache.Cache
 
 	log zerolog.Logger
 }
 
-func NewFbImageService(media3 string, staticFs fs.FS) (*fbImageService, error) {
+func NewFbImageService(media3 string, staticFs fs.FS, store *templatestore.Store) (*fbImageService, error) {
 	mr := mux.NewRouter()
 	ir := mux.NewRouter()
 
 	log := logger.NamedLogger("fb").Level(logger.GetLogLevel("fb.loglevel"))
 
-	tmpls, err := loadTemplates(log, staticFs, "fb-templates")
+	tmpls, err := loadTemplates(log, staticFs, "fb-templates", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -68,17 +75,31 @@ func NewFbImageService(media3 string, staticFs fs.FS) (*fbImageService, error) {
 		media3 += "/"
 	}
 
+	cache, err := rendercache.FromConfig("fb")
+	if err != nil {
+		return nil, err
+	}
+
 	ps := &fbImageService{
 		mr:       mr,
 		ir:       ir,
 		tmpls:    tmpls,
+		static:   staticFs,
+		store:    store,
 		upstream: media3,
+		cache:    cache,
 		log:      log,
 	}
 
-	ir.HandleFunc("/get-templates", ps.handleDebugListTemplates)
-	ir.HandleFunc("/get-config", ps.handleDebugConfig)
-	ir.HandleFunc("/test-template", ps.handleDebugImage)
+	ps.usage, err = newUsageRecorder(database.DB(), log)
+	if err != nil {
+		return nil, err
+	}
+
+	ir.HandleFunc("/get-templates", ps.handleDebugListTemplates).Name("DEBUG_TEMPLATES")
+	ir.HandleFunc("/get-config", ps.handleDebugConfig).Name("DEBUG_CONFIG")
+	ir.HandleFunc("/test-template", ps.handleDebugImage).Name("DEBUG_IMAGE")
+	ps.registerAdminRoutes(ir)
 
 	subFs, err := fs.Sub(staticFs, "html")
 	if err != nil {
@@ -86,14 +107,22 @@ func NewFbImageService(media3 string, staticFs fs.FS) (*fbImageService, error) {
 	}
 	ir.Methods("GET").PathPrefix("/").Handler(
 		http.FileServer(http.FS(subFs)),
+	).Name("DEBUG_HTML")
+
+	ir.Use(
+		jwtmux.NewJwtAuthenticationMiddleware(
+			jwtmux.AllowByName("", "DEBUG_TEMPLATES"),
+			jwtmux.AllowByName("", "DEBUG_CONFIG"),
+			jwtmux.AllowByName("", "DEBUG_IMAGE"),
+			jwtmux.AllowByName("", "DEBUG_HTML"),
+			jwtmux.AllowByFunc(checkAllowedRole),
+			jwtmux.WithCustomClaims(&jwtauthen.XClaims{}),
+		),
 	)
 
 	// ir.Handle("/", http.RedirectHandler("/debug", http.StatusTemporaryRedirect))
 
 	// fb scdn handler
-	mr.Methods("GET").Path("/get-fb-templates").HandlerFunc(ps.handleGetFBTemplates)
-	mr.Methods("POST").Path("/create-fb-template").HandlerFunc(ps.handleCreateFBTemplate)
-	mr.Methods("DELETE").Path("/del-fb-template/{id}").HandlerFunc(ps.handleDelFBTemplate)
 	mr.Methods("GET").Path("/{source:.*}").HandlerFunc(ps.handleFbScdnImage)
 
 	return ps, nil
@@ -110,119 +139,51 @@ func respondData(w http.ResponseWriter, code int, payload interface{}) {
 	w.Write(response)
 }
 
-func (ps *fbImageService) MainHandler() http.Handler {
-	return ps.mr
+func (ps *fbImageService) getTemplate(name string) (*ImageTemplate, bool) {
+	ps.tmplsMu.RLock()
+	defer ps.tmplsMu.RUnlock()
+	t, ok := ps.tmpls[name]
+	return t, ok
 }
 
-func (ps *fbImageService) InternalHandler() http.Handler {
-	return ps.ir
-}
+// load templates again after the template dir changed
+func (ps *fbImageService) ReloadTemplates() {
+	ps.reloadMu.Lock()
+	defer ps.reloadMu.Unlock()
 
-func (ps *fbImageService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ps.mr.ServeHTTP(w, r)
-}
-
-func uploadFrameImage(w http.ResponseWriter, r *http.Request) (frameUrl string, err error) {
-	folderName := strconv.FormatInt(utils.MakeTimestamp(), 10)
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return "", err
-	}
+	ps.tmplsMu.RLock()
+	prev := ps.tmpls
+	ps.tmplsMu.RUnlock()
 
-	defer file.Close()
-
-	err = os.MkdirAll("static/"+folderName, os.ModePerm)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return "", err
-	}
-	dst, err := os.Create("static/" + folderName + "/frame.png")
+	tmpls, err := loadTemplates(ps.log, ps.static, "fb-templates", prev)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return "", err
+		ps.log.Error().Err(err).Msg("reload templates")
+		return
 	}
 
-	defer dst.Close()
+	ps.tmplsMu.Lock()
+	ps.tmpls = tmpls
+	ps.tmplsMu.Unlock()
 
-	_, err = io.Copy(dst, file)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return "", err
-	}
-	frameUrl = folderName + "/frame.png"
-	return frameUrl, err
+	ps.purgeChanged(prev, tmpls)
 }
 
-func (ps *fbImageService) handleDelFBTemplate(w http.ResponseWriter, r *http.Request) {
-
+// Start writes render counts to the database every fb.usageFlushInterval
+// until stop is closed
+func (ps *fbImageService) Start(stop <-chan struct{}) {
+	go ps.usage.run(viper.GetDuration("fb.usageFlushInterval"), stop)
 }
 
-func (ps *fbImageService) handleCreateFBTemplate(w http.ResponseWriter, r *http.Request) {
-	templateDefault := ImageTemplateConfig{
-		PriceOnly: TextConfig{
-			Top:            0.932,
-			Right:          0.17,
-			VerticalCenter: true,
-			Height:         0.042,
-			FontURI:        "2020-02/UTMAVO-REGULAR.TTF",
-			Color:          "#fffefe",
-		},
-		PriceOrig: TextConfig{
-			Top:            0.913,
-			Right:          0.17,
-			VerticalCenter: true,
-			Height:         0.025,
-			FontURI:        "2020-02/UTMAVO-REGULAR.TTF",
-			Color:          "#ffffff",
-			StrikeThrough:  0.07,
-			StrikeFull:     true,
-			StrikePos:      0.55,
-		},
-		PricePromo: TextConfig{
-			Top:            0.932,
-			Right:          0.17,
-			VerticalCenter: true,
-			Height:         0.042,
-			FontURI:        "2020-02/UTMAVO-REGULAR.TTF",
-			Color:          "#fffefe",
-		},
-	}
-	frameUrl, err := uploadFrameImage(w, r)
-	if err != nil {
-		respondError(w, 400, "Upload frame image fail!")
-		return
-	}
-	templateDefault.FrameURI = frameUrl
+func (ps *fbImageService) MainHandler() http.Handler {
+	return ps.mr
+}
 
-	yamlData, err := yaml.Marshal(&templateDefault)
-	if err != nil {
-		respondError(w, 400, "Error while Marshaling!")
-		return
-	}
-	templateName := strconv.FormatInt(utils.MakeTimestamp(), 10)
-	fileName := "static/fb-templates/" + templateName + ".yaml"
-	err = ioutil.WriteFile(fileName, yamlData, 777)
-	if err != nil {
-		respondError(w, 400, "Unable to write data into the file!")
-		return
-	}
-	respondData(w, http.StatusOK, map[string]string{
-		"data": templateName + ".yaml",
-	})
-	return
+func (ps *fbImageService) InternalHandler() http.Handler {
+	return ps.ir
 }
 
-func (ps *fbImageService) handleGetFBTemplates(w http.ResponseWriter, r *http.Request) {
-	files, err := ioutil.ReadDir("./static/fb-templates")
-	if err != nil {
-		log.Fatal(err)
-	}
-	fileArr := []string{}
-	for _, f := range files {
-		fileArr = append(fileArr, f.Name())
-	}
-	respondData(w, http.StatusOK, fileArr)
+func (ps *fbImageService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.mr.ServeHTTP(w, r)
 }
 
 func (ps *fbImageService) handleFbScdnImage(w http.ResponseWriter, r *http.Request) {
@@ -236,45 +197,75 @@ func (ps *fbImageService) handleFbScdnImage(w http.ResponseWriter, r *http.Reque
 	timer := prometheus.NewTimer(opsDurationProcessed.With(prometheus.Labels{"template": template}))
 	defer timer.ObserveDuration()
 
-	tmpl, ok := ps.tmpls[template]
+	tmpl, ok := ps.getTemplate(template)
 	if !ok {
+		utils.SetErrorCacheHeaders(w)
 		w.WriteHeader(400)
 		w.Write([]byte("template not found"))
 		return
 	}
-	ps._process(w, params, tmpl)
+	ps.usage.record(template)
+	ps._process(w, r, template, params, tmpl)
 }
 
-func (ps *fbImageService) _process(w http.ResponseWriter, params url.Values, tmpl *ImageTemplate) {
+// renders of the template named name are cached, name is empty for a
+// template which is not served
+func (ps *fbImageService) _process(w http.ResponseWriter, r *http.Request, name string, params url.Values, tmpl *ImageTemplate) {
+	w.Header().Set("Vary", "Accept")
+	format, err := imghelper.NegotiateFormat(r, tmpl.format)
+	if err != nil {
+		respondRenderError(w, err.Error(), 400)
+		return
+	}
+
 	upstream := params.Get("__upstream")
-	b, err := downloader.Download(upstream, "facebook")
+	key := renderCacheKey(name, tmpl, upstream, params, format)
+	etag := utils.ETag(key)
+	if name != "" {
+		if utils.NotModified(r, etag, tmpl.mtime) {
+			utils.SetCacheHeaders(w, etag, tmpl.mtime, utils.MaxAge(tmpl.cfg.CacheMaxAge))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if b, ok := ps.cache.Get(key); ok {
+			utils.SetCacheHeaders(w, etag, tmpl.mtime, utils.MaxAge(tmpl.cfg.CacheMaxAge))
+			w.Header().Set("content-type", format.ContentType())
+			w.Write(b)
+			return
+		}
+	}
+
+	b, err := downloader.DownloadContext(r.Context(), upstream, "facebook")
 	if err != nil {
 		err2, ok := err.(*downloader.DownloadError)
-		if ok && err2.Code == 404 {
-			http.Error(w, "not found", 404)
-		} else {
-			http.Error(w, "service unavailable", err2.Code)
+		switch {
+		case ok && err2.Code == 404:
+			respondRenderError(w, "not found", 404)
+		case ok:
+			respondRenderError(w, "service unavailable", err2.Code)
+		default:
+			// no response, or the client went away
+			respondRenderError(w, "service unavailable", http.StatusServiceUnavailable)
 		}
 		return
 	}
 
-	src, _, err := image.Decode(bytes.NewReader(b))
+	src, err := imghelper.DecodeImage(b)
 	if err != nil {
-		http.Error(w, err.Error(), 400)
+		respondRenderError(w, err.Error(), 400)
 		return
 	}
-	price, err := strconv.Atoi(params.Get("price"))
-	if err == nil {
-		promotionPrice, err := strconv.Atoi(params.Get("promotion_price"))
-		if err != nil || promotionPrice <= 0 || promotionPrice > price {
-			promotionPrice = price
-		}
-		img := tmpl.GenerateFromImage(src, price, promotionPrice)
-		w.Header().Set("content-type", "image/jpeg")
-		w.Write(img)
-	} else {
-		img := tmpl.GenerateFromImageNotPrice(src)
-		w.Header().Set("content-type", "image/jpeg")
-		w.Write(img)
+	img := tmpl.GenerateFromParams(src, params, format)
+	if name != "" {
+		ps.cache.Put(name, key, img)
+		utils.SetCacheHeaders(w, etag, tmpl.mtime, utils.MaxAge(tmpl.cfg.CacheMaxAge))
 	}
+	w.Header().Set("content-type", format.ContentType())
+	w.Write(img)
+}
+
+// error of a render, cached briefly by clients
+func respondRenderError(w http.ResponseWriter, msg string, code int) {
+	utils.SetErrorCacheHeaders(w)
+	http.Error(w, msg, code)
 }
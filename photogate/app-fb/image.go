@@ -7,13 +7,17 @@ import (
 	"image/draw"
 	"io"
 	"math"
+	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
 	_ "image/gif"
 
 	_ "github.com/chai2010/webp"
 	_ "github.com/jdeng/goheif"
 	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
 	"gitlab.sendo.vn/system/photogate/utils"
 
 	"github.com/disintegration/imaging"
@@ -36,19 +40,29 @@ type ImageTemplate struct {
 	promoOrigFrame image.Image
 	// frame by size
 	frames map[string]image.Image
+	// when the request asks for no format
+	format imghelper.Format
+	// of the config, renders are cached by it
+	version string
+	// of the template files, Last-Modified of renders if not zero
+	mtime time.Time
 }
 
 func NewImageTemplate(cfg *ImageTemplateConfig) (*ImageTemplate, error) {
-	var origFrame, promoOrigFrame image.Image
-
 	b, err := utils.SimpleGetFile(cfg.FrameURI)
 	if err != nil {
 		return nil, err
 	}
-	origFrame, _, err = image.Decode(bytes.NewReader(b))
+	origFrame, _, err := image.Decode(bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
+	return newImageTemplate(cfg, origFrame)
+}
+
+// template with the frame already decoded, cfg.FrameURI is not read
+func newImageTemplate(cfg *ImageTemplateConfig, origFrame image.Image) (*ImageTemplate, error) {
+	var promoOrigFrame image.Image
 
 	if cfg.PromoFrameURI != "" {
 		b, err := utils.SimpleGetFile(cfg.PromoFrameURI)
@@ -61,6 +75,19 @@ func NewImageTemplate(cfg *ImageTemplateConfig) (*ImageTemplate, error) {
 		}
 	}
 
+	format, err := imghelper.ParseFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = imghelper.FORMAT_JPEG
+	}
+	assets, mtime := utils.AssetsVersion(cfg)
+	version, err := rendercache.Version(cfg, assets)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := cfg.PriceOnly.parse(nil); err != nil {
 		return nil, errors.WithMessage(err, "PriceOnly")
 	}
@@ -77,6 +104,9 @@ func NewImageTemplate(cfg *ImageTemplateConfig) (*ImageTemplate, error) {
 		origFrame:      origFrame,
 		promoOrigFrame: promoOrigFrame,
 		frames:         make(map[string]image.Image),
+		format:         format,
+		version:        version,
+		mtime:          mtime,
 	}, nil
 }
 
@@ -193,6 +223,11 @@ func (it *ImageTemplate) _calcAnchorPoint(tc *TextConfig, imageSize image.Point)
 }
 
 func (it *ImageTemplate) GenerateFromImage(src image.Image, price, promotionPrice int) []byte {
+	return imghelper.Img2jpegBuf(it.compose(src, price, promotionPrice))
+}
+
+// src with the frame and prices drawn over it
+func (it *ImageTemplate) compose(src image.Image, price, promotionPrice int) image.Image {
 	imageSize := src.Bounds().Size()
 
 	dst := image.NewRGBA(src.Bounds())
@@ -215,7 +250,35 @@ func (it *ImageTemplate) GenerateFromImage(src image.Image, price, promotionPric
 		it.drawPricing(dst, p, promotionPrice, tc)
 	}
 
-	return imghelper.Img2jpegBuf(dst)
+	return dst
+}
+
+// GenerateFromParams generates src with the price and promotion_price
+// parameters, without a price if there is none, encoded in format
+func (it *ImageTemplate) GenerateFromParams(src image.Image, params url.Values, format imghelper.Format) []byte {
+	return imghelper.Encode(it.composeFromParams(src, params), format)
+}
+
+func (it *ImageTemplate) composeFromParams(src image.Image, params url.Values) image.Image {
+	price, promotionPrice, ok := prices(params)
+	if !ok {
+		return it.composeNotPrice(src)
+	}
+	return it.compose(src, price, promotionPrice)
+}
+
+// the price and promotion_price parameters, the promotion price is the
+// price unless it is lower. false if there is no price
+func prices(params url.Values) (int, int, bool) {
+	price, err := strconv.Atoi(params.Get("price"))
+	if err != nil {
+		return 0, 0, false
+	}
+	promotionPrice, err := strconv.Atoi(params.Get("promotion_price"))
+	if err != nil || promotionPrice <= 0 || promotionPrice > price {
+		promotionPrice = price
+	}
+	return price, promotionPrice, true
 }
 
 func (it *ImageTemplate) getFrameBySizeNoPrice(s image.Point) image.Image {
@@ -236,6 +299,10 @@ func (it *ImageTemplate) getFrameBySizeNoPrice(s image.Point) image.Image {
 }
 
 func (it *ImageTemplate) GenerateFromImageNotPrice(src image.Image) []byte {
+	return imghelper.Img2jpegBuf(it.composeNotPrice(src))
+}
+
+func (it *ImageTemplate) composeNotPrice(src image.Image) image.Image {
 	imageSize := src.Bounds().Size()
 
 	dst := image.NewRGBA(src.Bounds())
@@ -243,5 +310,5 @@ func (it *ImageTemplate) GenerateFromImageNotPrice(src image.Image) []byte {
 
 	frame := it.getFrameBySizeNoPrice(imageSize)
 	draw.Draw(dst, dst.Bounds(), frame, image.Point{}, draw.Over)
-	return imghelper.Img2jpegBuf(dst)
+	return dst
 }
\ No newline at end of file
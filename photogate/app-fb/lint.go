@@ -0,0 +1,92 @@
+package appfb
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"github.com/golang/freetype/truetype"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+// LintTemplate loads the content of a fb template like ValidateTemplate,
+// reporting the field of each frame and font which can not be read, and
+// prices placed outside the image
+func LintTemplate(b []byte) []plugins.Problem {
+	cfg, err := loadImageTemplateConfig(string(b))
+	if err != nil {
+		return []plugins.Problem{plugins.NewProblem(err)}
+	}
+
+	var problems []plugins.Problem
+	report := func(field string, format string, args ...interface{}) {
+		problems = append(problems, plugins.Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	frames := []struct {
+		field, uri string
+	}{
+		{"frameURI", cfg.FrameURI},
+		{"promoFrameURI", cfg.PromoFrameURI},
+	}
+	for _, f := range frames {
+		if f.uri == "" {
+			if f.field == "frameURI" {
+				report(f.field, "frameURI is required")
+			}
+			continue
+		}
+		data, err := utils.SimpleGetFile(f.uri)
+		if err != nil {
+			report(f.field, `load frame "%s": %s`, f.uri, err)
+			continue
+		}
+		if _, _, err = image.DecodeConfig(bytes.NewReader(data)); err != nil {
+			report(f.field, `decode frame "%s": %s`, f.uri, err)
+		}
+	}
+
+	if _, err := imghelper.ParseFormat(cfg.Format); err != nil {
+		report("format", "%s", err)
+	}
+
+	texts := []struct {
+		field string
+		tc    *TextConfig
+	}{
+		{"priceOnly", &cfg.PriceOnly},
+		{"priceOrig", &cfg.PriceOrig},
+		{"pricePromo", &cfg.PricePromo},
+	}
+	for _, t := range texts {
+		if t.tc.Color != "" {
+			if _, err := parseHexColor(t.tc.Color); err != nil {
+				report(t.field+".color", `%s: invalid color "%s"`, t.field, t.tc.Color)
+			}
+		}
+		if t.tc.FontURI != "" {
+			data, err := utils.SimpleGetFile(t.tc.FontURI)
+			if err == nil {
+				_, err = truetype.Parse(data)
+			}
+			if err != nil {
+				report(t.field+".fontUri", `%s: load font "%s": %s`, t.field, t.tc.FontURI, err)
+			}
+		} else if t.field == "priceOnly" {
+			report(t.field, "priceOnly: fontUri is required")
+		}
+		if err := t.tc.validate(); err != nil {
+			report(t.field, "%s: %s", t.field, err)
+		}
+	}
+
+	if len(problems) == 0 {
+		// anything else the loader checks
+		if err := ValidateTemplate(b); err != nil {
+			problems = append(problems, plugins.NewProblem(err))
+		}
+	}
+	return problems
+}
@@ -1,10 +1,13 @@
 package appfb
 
 import (
+	"image"
 	"image/color"
 	"io/fs"
+	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/golang/freetype/truetype"
 	"github.com/mitchellh/mapstructure"
@@ -128,15 +131,35 @@ type ImageTemplateConfig struct {
 	PriceOnly  TextConfig `yaml:"priceOnly,omitempty"`
 	PriceOrig  TextConfig `yaml:"priceOrig,omitempty"`
 	PricePromo TextConfig `yaml:"pricePromo,omitempty"`
+
+	// jpeg, png or webp, when the request asks for no format
+	Format string `yaml:"format,omitempty"`
+	// Cache-Control max-age of renders, httpCache.maxAge if unset
+	CacheMaxAge *time.Duration `yaml:"cacheMaxAge,omitempty"`
 }
 
 func loadImageTemplateConfig(s string) (*ImageTemplateConfig, error) {
-	var m map[string]interface{}
-	if err := yaml.Unmarshal([]byte(s), &m); err != nil {
+	cc := &ImageTemplateConfig{}
+	if err := decodeImageTemplateConfig(s, cc); err != nil {
 		return nil, err
 	}
+	return cc, nil
+}
 
-	cc := &ImageTemplateConfig{}
+// decode the yaml config into cc, keys not in s keep their value
+func decodeImageTemplateConfig(s string, cc *ImageTemplateConfig) error {
+	return decodeYamlConfig(s, cc)
+}
+
+func decodeTextConfig(s string, tc *TextConfig) error {
+	return decodeYamlConfig(s, tc)
+}
+
+func decodeYamlConfig(s string, result interface{}) error {
+	var m map[string]interface{}
+	if err := yaml.Unmarshal([]byte(s), &m); err != nil {
+		return err
+	}
 
 	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
@@ -145,34 +168,41 @@ func loadImageTemplateConfig(s string) (*ImageTemplateConfig, error) {
 			mapstructure.StringToSliceHookFunc(","),
 		),
 		TagName: "yaml",
-		Result:  cc,
+		Result:  result,
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if err := dec.Decode(m); err != nil {
-		return nil, err
-	}
-
-	return cc, nil
+	return dec.Decode(m)
 }
 
 var genericTemplateRx = regexp.MustCompile(`\.yaml$`)
 
-func loadTemplates(log zerolog.Logger, staticFs fs.FS, root string) (map[string]*ImageTemplate, error) {
+// load templates of root. when reloading, prev holds the templates in use
+// and a template which fails to load keeps serving its previous version
+func loadTemplates(log zerolog.Logger, staticFs fs.FS, root string, prev map[string]*ImageTemplate) (map[string]*ImageTemplate, error) {
 	tmpls := map[string]*ImageTemplate{}
 	err := utils.ScanFileMatch(staticFs, root, genericTemplateRx, func(fname, path string, b []byte) error {
 		name := strings.TrimSuffix(fname, ".yaml")
 		log.Info().Msgf(`load fb template "%s"`, path)
 
-		itc, err := loadImageTemplateConfig(string(b))
+		t, err := loadTemplateFile(b)
 		if err != nil {
-			return err
+			if prev == nil {
+				return err
+			}
+			utils.TemplateReloads.WithLabelValues("fb", "error").Inc()
+			log.Error().Err(err).Msgf(`reload fb template "%s", keep previous version`, path)
+			if old, ok := prev[name]; ok {
+				tmpls[name] = old
+			}
+			return nil
 		}
-
-		t, err := NewImageTemplate(itc)
-		if err != nil {
-			return err
+		if prev != nil {
+			utils.TemplateReloads.WithLabelValues("fb", "ok").Inc()
+		}
+		if mtime := utils.ModTime(staticFs, path); mtime.After(t.mtime) {
+			t.mtime = mtime
 		}
 
 		tmpls[name] = t
@@ -186,3 +216,31 @@ func loadTemplates(log zerolog.Logger, staticFs fs.FS, root string) (map[string]
 
 	return tmpls, err
 }
+
+func loadTemplateFile(b []byte) (*ImageTemplate, error) {
+	itc, err := loadImageTemplateConfig(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return NewImageTemplate(itc)
+}
+
+// ValidateTemplate loads the content of a fb template, with its frames and fonts
+func ValidateTemplate(b []byte) error {
+	_, err := loadTemplateFile(b)
+	return err
+}
+
+// RenderFile generates src with the fb template named name of static
+// and the price parameters, like a request to the service
+func RenderFile(static fs.FS, name string, src image.Image, params url.Values) (image.Image, error) {
+	b, err := fs.ReadFile(static, "fb-templates/"+name+".yaml")
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadTemplateFile(b)
+	if err != nil {
+		return nil, err
+	}
+	return t.composeFromParams(src, params), nil
+}
@@ -0,0 +1,138 @@
+package appfb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func init() {
+	// a template rendered within this many days can not be deleted
+	viper.SetDefault("fb.keepUsedDays", 30)
+	// how often render counts are written to the database
+	viper.SetDefault("fb.usageFlushInterval", time.Minute)
+}
+
+// renders of a template per day, summed over all instances
+type FbTemplateUsage struct {
+	Template string `gorm:"primaryKey;size:100"`
+	// yyyymmdd
+	Day     int `gorm:"primaryKey"`
+	Renders int64
+}
+
+type usageKey struct {
+	template string
+	day      int
+}
+
+// counts renders in memory, they are written to the database
+// every flush interval
+type usageRecorder struct {
+	db  *gorm.DB
+	log zerolog.Logger
+
+	mu     sync.Mutex
+	counts map[usageKey]int64
+}
+
+func newUsageRecorder(db *gorm.DB, log zerolog.Logger) (*usageRecorder, error) {
+	if err := db.AutoMigrate(&FbTemplateUsage{}); err != nil {
+		return nil, err
+	}
+	return &usageRecorder{
+		db:     db,
+		log:    log,
+		counts: map[usageKey]int64{},
+	}, nil
+}
+
+func usageDay(t time.Time) int {
+	y, m, d := t.Date()
+	return y*10000 + int(m)*100 + d
+}
+
+func (u *usageRecorder) record(template string) {
+	k := usageKey{template, usageDay(time.Now())}
+	u.mu.Lock()
+	u.counts[k]++
+	u.mu.Unlock()
+}
+
+func (u *usageRecorder) flush() error {
+	u.mu.Lock()
+	counts := u.counts
+	u.counts = map[usageKey]int64{}
+	u.mu.Unlock()
+
+	for k, n := range counts {
+		err := u.db.Clauses(clause.OnConflict{
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"renders": gorm.Expr("renders + ?", n),
+			}),
+		}).Create(&FbTemplateUsage{
+			Template: k.template,
+			Day:      k.day,
+			Renders:  n,
+		}).Error
+		if err != nil {
+			// keep counts not written for the next flush
+			u.mu.Lock()
+			for k, n := range counts {
+				u.counts[k] += n
+			}
+			u.mu.Unlock()
+			return err
+		}
+		delete(counts, k)
+	}
+	return nil
+}
+
+// flush every interval until stop is closed, then once more for the
+// renders counted since. no periodic flush if interval is not positive
+func (u *usageRecorder) run(interval time.Duration, stop <-chan struct{}) {
+	flush := func() {
+		if err := u.flush(); err != nil {
+			u.log.Error().Err(err).Msg("flush template usage")
+		}
+	}
+	defer flush()
+
+	if interval <= 0 {
+		u.log.Warn().Dur("interval", interval).Msg("template usage flushed on reads and stop only")
+		<-stop
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// renders of the template in the last days, today included
+func (u *usageRecorder) rendersSince(template string, days int) (int64, error) {
+	if err := u.flush(); err != nil {
+		return 0, err
+	}
+
+	var renders int64
+	since := usageDay(time.Now().AddDate(0, 0, -days))
+	err := u.db.Model(&FbTemplateUsage{}).
+		Where(map[string]interface{}{"Template": template}).
+		Where("day > ?", since).
+		Select("COALESCE(SUM(renders), 0)").
+		Scan(&renders).
+		Error
+	return renders, err
+}
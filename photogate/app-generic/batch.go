@@ -0,0 +1,295 @@
+package appgeneric
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"gitlab.sendo.vn/system/photogate/downloader"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+// max size of a batch request body
+const maxBatchSize = 16 << 20
+
+func init() {
+	// most items of a batch render
+	viper.SetDefault("generic.batch.maxItems", 1000)
+}
+
+// error of the items of a batch not rendered before it was canceled
+const batchCanceled = "canceled"
+
+type batchRequest struct {
+	Template string `json:"template"`
+	// query parameters of each image, like those of GET /{template}/{source}
+	Items []map[string]string `json:"items"`
+	Width int                 `json:"width"`
+	// jpeg, png or webp, the format of the template if empty
+	Format string `json:"format"`
+}
+
+// manifest.json of a batch zip
+type batchManifest struct {
+	Template string      `json:"template"`
+	Count    int         `json:"count"`
+	Failed   int         `json:"failed"`
+	Items    []batchItem `json:"items"`
+}
+
+type batchItem struct {
+	Index int `json:"index"`
+	// name of the image in the zip, empty if the item failed or was
+	// canceled
+	File  string `json:"file,omitempty"`
+	Error string `json:"error,omitempty"`
+	// invalid input of a failed item
+	Input string `json:"input,omitempty"`
+}
+
+type batchResult struct {
+	index int
+	b     []byte
+	err   error
+}
+
+// batch request which can not be rendered
+type batchError struct {
+	Code    int
+	Message string
+}
+
+func (e *batchError) Error() string {
+	return e.Message
+}
+
+// template of a batch request which can be rendered, and the format of
+// its images
+func (svc *genericService) checkBatch(req *batchRequest) (*template, imghelper.Format, error) {
+	tmpl, ok := svc.getTemplate(req.Template)
+	if !ok {
+		return nil, "", &batchError{http.StatusNotFound, "template not found"}
+	}
+	format, err := imghelper.ParseFormat(req.Format)
+	if err != nil {
+		return nil, "", &batchError{http.StatusBadRequest, err.Error()}
+	}
+	if format == "" {
+		format = tmpl._format
+	}
+	if len(req.Items) == 0 {
+		return nil, "", &batchError{http.StatusBadRequest, "items is empty"}
+	}
+	if len(req.Items) > svc.maxBatchItems {
+		return nil, "", &batchError{http.StatusBadRequest, fmt.Sprintf("more than %d items", svc.maxBatchItems)}
+	}
+	return tmpl, format, nil
+}
+
+// render a template with each binding set of the request body, see
+// batchRequest. the response is a zip of the image of each item, in the
+// order they are rendered, and a manifest.json of the items which failed
+func (svc *genericService) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxBatchSize)).Decode(&req)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	tmpl, format, err := svc.checkBatch(&req)
+	if err != nil {
+		respondError(w, err.(*batchError).Code, err.Error())
+		return
+	}
+
+	w.Header().Set("content-type", "application/zip")
+	w.Header().Set("content-disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, req.Template))
+	if err = svc.writeBatch(r.Context(), &req, tmpl, format, w, nil); err != nil {
+		svc.log.Error().Err(err).Str("template", req.Template).Msg("write batch")
+	}
+}
+
+// write the zip of a batch to w, progress is called after each item when
+// not nil. once ctx is done no more items are rendered, the zip is closed
+// with the items not rendered canceled in its manifest and ctx.Err() is
+// returned
+func (svc *genericService) writeBatch(ctx context.Context, req *batchRequest, tmpl *template, format imghelper.Format, w io.Writer, progress func(failed bool)) error {
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := range req.Items {
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// an item mostly waits for its images, as many items at once as
+	// downloads. the downloader bounds the downloads of all batches
+	workers := downloader.Concurrency()
+	if workers < 1 {
+		workers = 1
+	}
+	results := make(chan batchResult)
+	go func() {
+		var wg sync.WaitGroup
+		for n := 0; n < workers; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indexes {
+					b, err := svc.renderBatchItem(ctx, tmpl, req.Template, req.Items[i], req.Width, format)
+					results <- batchResult{i, b, err}
+				}
+			}()
+		}
+		wg.Wait()
+		close(results)
+	}()
+
+	manifest := batchManifest{
+		Template: req.Template,
+		Count:    len(req.Items),
+		Items:    make([]batchItem, len(req.Items)),
+	}
+	// every item has a result unless the batch is canceled
+	for i := range manifest.Items {
+		manifest.Items[i] = batchItem{Index: i, Error: batchCanceled}
+	}
+	digits := len(strconv.Itoa(len(req.Items) - 1))
+	zw := zip.NewWriter(w)
+
+	// results are drained after a write error, so renders never block
+	var werr error
+	for res := range results {
+		item := &manifest.Items[res.index]
+		if res.err != nil && errors.Is(res.err, ctx.Err()) {
+			// stopped by the cancel, the error stays canceled
+		} else if res.err != nil {
+			item.Error = res.err.Error()
+			var ie *inputError
+			if errors.As(res.err, &ie) {
+				item.Input = ie.Name
+			}
+		} else if werr == nil {
+			name := fmt.Sprintf("%0*d.%s", digits, res.index, format.Extension())
+			var f io.Writer
+			// images do not compress further
+			f, werr = zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+			if werr == nil {
+				_, werr = f.Write(res.b)
+			}
+			if werr == nil {
+				item.File = name
+				item.Error = ""
+			}
+		}
+		if progress != nil {
+			progress(item.File == "")
+		}
+	}
+	if werr != nil {
+		return werr
+	}
+
+	for _, item := range manifest.Items {
+		if item.File == "" {
+			manifest.Failed++
+		}
+	}
+	b, _ := json.MarshalIndent(manifest, "", "  ")
+	f, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// batchRunner runs batch requests as jobs, see the jobs package
+type batchRunner struct {
+	svc *genericService
+}
+
+func (svc *genericService) BatchRunner() *batchRunner {
+	return &batchRunner{svc}
+}
+
+// Check returns the number of items of a batch request which can be rendered
+func (br *batchRunner) Check(b []byte) (int, error) {
+	var req batchRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return 0, err
+	}
+	if _, _, err := br.svc.checkBatch(&req); err != nil {
+		return 0, err
+	}
+	return len(req.Items), nil
+}
+
+// Run writes the zip of a batch request to w, like POST /batch
+func (br *batchRunner) Run(ctx context.Context, b []byte, w io.Writer, progress func(failed bool)) error {
+	var req batchRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	tmpl, format, err := br.svc.checkBatch(&req)
+	if err != nil {
+		return err
+	}
+	return br.svc.writeBatch(ctx, &req, tmpl, format, w, progress)
+}
+
+func (svc *genericService) renderBatchItem(ctx context.Context, tmpl *template, name string, item map[string]string, width int, format imghelper.Format) ([]byte, error) {
+	params := url.Values{}
+	for k, v := range item {
+		params.Set(k, v)
+	}
+	values, err := tmpl.bindRequest(name, params, svc.upstream)
+	if err != nil {
+		return nil, err
+	}
+	if err = downloadImages(ctx, tmpl.imageURLs(values)); err != nil {
+		return nil, err
+	}
+	img, err := tmpl.Render(values, width)
+	if err != nil {
+		return nil, err
+	}
+	return imghelper.Encode(img, format), nil
+}
+
+// download the images of an item until ctx is done, so that a canceled
+// batch does not wait for them. the plugins then load them from the
+// download cache, or share the download still in flight
+func downloadImages(ctx context.Context, urls []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for _, u := range urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			continue
+		}
+		if _, err := downloader.DownloadContext(ctx, u, "batch"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package appgeneric
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	upstream := newProductUpstream(t)
+	svc := newTestService(t, upstream.URL)
+
+	batch := func(req batchRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		svc.internalRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/batch", bytes.NewReader(body)))
+		return w
+	}
+
+	items := []map[string]string{}
+	for i := 0; i < 12; i++ {
+		items = append(items, map[string]string{"source": "product/" + strconv.Itoa(i%10), "price": "1000"})
+	}
+	// missing price, and not found upstream
+	items[3] = map[string]string{"source": "product/3"}
+	items[7]["source"] = "missing"
+
+	w := batch(batchRequest{Template: "product", Items: items})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, "application/zip", w.Header().Get("content-type"))
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rd, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		files[f.Name] = b
+	}
+
+	var manifest batchManifest
+	require.NoError(t, json.Unmarshal(files["manifest.json"], &manifest))
+	require.Equal(t, 12, manifest.Count)
+	require.Equal(t, 2, manifest.Failed)
+	require.Len(t, files, 11)
+
+	require.Equal(t, batchItem{Index: 3, Error: `input "price" is required`, Input: "price"}, manifest.Items[3])
+	require.Empty(t, manifest.Items[7].File)
+	require.NotEmpty(t, manifest.Items[7].Error)
+
+	require.Equal(t, "05.jpg", manifest.Items[5].File)
+	img, _, err := image.Decode(bytes.NewReader(files["05.jpg"]))
+	require.NoError(t, err)
+	require.Less(t, colorDistance(productColor(5), img.At(50, 80)), 24)
+
+	w = batch(batchRequest{Template: "product", Items: items[:1], Format: "png"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	zr, err = zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	require.Equal(t, "0.png", zr.File[0].Name)
+	rd, err := zr.File[0].Open()
+	require.NoError(t, err)
+	_, format, err := image.Decode(rd)
+	require.NoError(t, err)
+	require.Equal(t, "png", format)
+
+	w = batch(batchRequest{Template: "product", Items: items, Format: "gif"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = batch(batchRequest{Template: "missing", Items: items})
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = batch(batchRequest{Template: "product"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	svc.maxBatchItems = 10
+	w = batch(batchRequest{Template: "product", Items: items})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// no token
+	body, err := json.Marshal(batchRequest{Template: "product", Items: items[:1]})
+	require.NoError(t, err)
+	w = httptest.NewRecorder()
+	svc.InternalHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/batch", bytes.NewReader(body)))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestBatchRunner(t *testing.T) {
+	upstream := newProductUpstream(t)
+	br := newTestService(t, upstream.URL).BatchRunner()
+
+	_, err := br.Check([]byte(`{"template": "missing", "items": [{}]}`))
+	require.Error(t, err)
+	req := []byte(`{"template": "product", "items": [{"source": "product/1", "price": "1"}, {"source": "product/2"}]}`)
+	n, err := br.Check(req)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	var buf bytes.Buffer
+	var progress []bool
+	require.NoError(t, br.Run(context.Background(), req, &buf, func(failed bool) {
+		progress = append(progress, failed)
+	}))
+	require.ElementsMatch(t, []bool{false, true}, progress)
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, zr.File, 2)
+	require.Equal(t, "0.jpg", zr.File[0].Name)
+
+	// a canceled batch is still a zip, with the items not rendered
+	// canceled in its manifest
+	manifest := func(b []byte) batchManifest {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		require.NoError(t, err)
+		var m batchManifest
+		for _, f := range zr.File {
+			if f.Name == "manifest.json" {
+				rd, err := f.Open()
+				require.NoError(t, err)
+				require.NoError(t, json.NewDecoder(rd).Decode(&m))
+			}
+		}
+		return m
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buf.Reset()
+	require.ErrorIs(t, br.Run(ctx, req, &buf, nil), context.Canceled)
+	m := manifest(buf.Bytes())
+	require.Equal(t, 2, m.Failed)
+	require.Equal(t, batchItem{Index: 1, Error: batchCanceled}, m.Items[1])
+
+	// items waiting for their images stop at the cancel
+	release := make(chan struct{})
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(stalled.Close)
+	t.Cleanup(func() { close(release) })
+	br = newTestService(t, stalled.URL).BatchRunner()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	buf.Reset()
+	require.ErrorIs(t, br.Run(ctx, req, &buf, nil), context.DeadlineExceeded)
+	m = manifest(buf.Bytes())
+	require.Equal(t, batchItem{Index: 0, Error: batchCanceled}, m.Items[0])
+	require.Equal(t, `input "price" is required`, m.Items[1].Error)
+}
@@ -0,0 +1,39 @@
+package appgeneric
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+)
+
+// key of a render in the render cache by the template version and the
+// bound values, which are normalized by their input types. false if the
+// values can not be encoded
+func renderCacheKey(name string, tmpl *template, values plugins.BindValues, format imghelper.Format) (string, bool) {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return "", false
+	}
+	return rendercache.Key(name, tmpl._version, string(format), string(b)), true
+}
+
+// renders of templates changed or removed by a reload are never served
+// again, free their space
+func (svc *genericService) purgeChanged(prev, tmpls map[string]*template) {
+	for name, old := range prev {
+		if t, ok := tmpls[name]; !ok || t._version != old._version {
+			svc.cache.Purge(name)
+		}
+	}
+}
+
+// DELETE /internal/template/cache/{template}, responds how many renders
+// were purged
+func (svc *genericService) handlePurgeCache(w http.ResponseWriter, r *http.Request) {
+	n := svc.cache.Purge(mux.Vars(r)["template"])
+	respondData(w, http.StatusOK, map[string]int{"purged": n})
+}
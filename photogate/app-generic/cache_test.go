@@ -0,0 +1,196 @@
+package appgeneric
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+func TestRenderCache(t *testing.T) {
+	products := newProductUpstream(t)
+	var downloads int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		// renders only, not the sources
+		w.Header().Set("Cache-Control", "no-store")
+		products.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+	svc := newTestService(t, upstream.URL)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		svc.MainHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/product/product/4?"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	first := get("price=1000&product_name=abc")
+	require.EqualValues(t, 1, atomic.LoadInt32(&downloads))
+	// same bindings once normalized
+	w := get("product_name=abc&price=01000&unused=1")
+	require.EqualValues(t, 1, atomic.LoadInt32(&downloads))
+	require.Equal(t, first.Body.Bytes(), w.Body.Bytes())
+
+	get("price=1000&product_name=abc&format=png")
+	require.EqualValues(t, 2, atomic.LoadInt32(&downloads))
+	get("price=2000&product_name=abc")
+	require.EqualValues(t, 3, atomic.LoadInt32(&downloads))
+
+	w = httptest.NewRecorder()
+	svc.internalRouter().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/cache/product", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"purged":3}`, w.Body.String())
+
+	// no token
+	w = httptest.NewRecorder()
+	svc.InternalHandler().ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/cache/product", nil))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+
+	get("price=1000&product_name=abc")
+	require.EqualValues(t, 4, atomic.LoadInt32(&downloads))
+}
+
+func TestHTTPCache(t *testing.T) {
+	products := newProductUpstream(t)
+	var downloads int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		// renders only, not the sources
+		w.Header().Set("Cache-Control", "no-store")
+		products.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	static := newTestStatic()
+	mtime := time.Date(2022, 3, 10, 8, 0, 0, 0, time.UTC)
+	static["generic-templates/product.yaml"].ModTime = mtime
+	static["generic-templates/hourly.yaml"] = &fstest.MapFile{
+		Data:    []byte("extends: product.yaml\ncacheMaxAge: 1h\n"),
+		ModTime: mtime.Add(-time.Hour),
+	}
+	// without the text, no file of it has a mtime
+	product := string(static["generic-templates/product.yaml"].Data)
+	static["generic-templates/embedded.yaml"] = &fstest.MapFile{Data: []byte(product[:strings.Index(product, "- type: text")])}
+	svc, err := NewGenericService(upstream.URL, static)
+	require.NoError(t, err)
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		svc.MainHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	const path = "/product/product/6?price=1000"
+	w := get(path, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	require.Regexp(t, `^"[0-9a-f]+"$`, etag)
+	require.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+	// of the template file or its font, the same for each instance
+	lastModified := w.Header().Get("Last-Modified")
+	want := mtime
+	if fi, err := os.Stat("../static/fonts/Roboto-Bold.ttf"); err == nil && fi.ModTime().After(want) {
+		want = fi.ModTime()
+	}
+	require.Equal(t, want.UTC().Format(http.TimeFormat), lastModified)
+	require.EqualValues(t, 1, atomic.LoadInt32(&downloads))
+
+	// same etag without the render cache
+	svc.cache.Purge("product")
+	w = get(path, nil)
+	require.Equal(t, etag, w.Header().Get("ETag"))
+	require.EqualValues(t, 2, atomic.LoadInt32(&downloads))
+
+	svc.cache.Purge("product")
+	w = get(path, http.Header{"If-None-Match": {`"other", ` + etag}})
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Empty(t, w.Body.Bytes())
+	require.Equal(t, etag, w.Header().Get("ETag"))
+	w = get(path, http.Header{"If-Modified-Since": {lastModified}})
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.EqualValues(t, 2, atomic.LoadInt32(&downloads))
+
+	w = get(path, http.Header{"If-None-Match": {`"other"`}})
+	require.Equal(t, http.StatusOK, w.Code)
+	w = get(path+"&format=png", http.Header{"If-None-Match": {etag}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEqual(t, etag, w.Header().Get("ETag"))
+
+	w = get("/hourly/product/6?price=1000", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "public, max-age=3600", w.Header().Get("Cache-Control"))
+	// the template it extends changed later
+	require.Equal(t, lastModified, w.Header().Get("Last-Modified"))
+
+	// no mtime, like embedded files
+	w = get("/embedded/product/6?price=1000", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotEmpty(t, w.Header().Get("ETag"))
+	require.Empty(t, w.Header().Get("Last-Modified"))
+
+	// placeholders
+	w = get("/missing/product/6", nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"))
+	w = get("/product/missing?price=1000", nil)
+	require.GreaterOrEqual(t, w.Code, 400)
+	require.Equal(t, "public, max-age=60", w.Header().Get("Cache-Control"))
+	require.Empty(t, w.Header().Get("ETag"))
+}
+
+func TestAssetsVersion(t *testing.T) {
+	mtime := time.Date(2022, 3, 10, 8, 0, 0, 0, time.UTC)
+	frame := func(c color.Color) []byte {
+		return imghelper.Img2pngBuf(imghelper.InitDrawingContext(10, 10, c).Image())
+	}
+	static := newTestStatic()
+	static["frames/a.png"] = &fstest.MapFile{Data: frame(color.White), ModTime: mtime}
+	static["generic-templates/framed.yaml"] = &fstest.MapFile{
+		Data:    []byte("allWidths: [100]\nformat: png\nplugins:\n- type: image\n  mode: stretch\n  image: frames/a.png\n"),
+		ModTime: mtime.Add(-time.Hour),
+	}
+	utils.Init(static)
+	t.Cleanup(func() { utils.Init(nil) })
+	svc, err := NewGenericService("http://upstream.invalid", static)
+	require.NoError(t, err)
+
+	render := func() (color.Color, string) {
+		w := httptest.NewRecorder()
+		svc.MainHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/framed/x", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		img, _, err := image.Decode(w.Body)
+		require.NoError(t, err)
+		return img.At(50, 50), w.Header().Get("Last-Modified")
+	}
+	c, lastModified := render()
+	require.Less(t, colorDistance(color.White, c), 8)
+	// of the frame, newer than the yaml
+	require.Equal(t, "Thu, 10 Mar 2022 08:00:00 GMT", lastModified)
+	tmpl, _ := svc.getTemplate("framed")
+	version := tmpl._version
+
+	// only the frame changed, the render is not served from the cache
+	static["frames/a.png"] = &fstest.MapFile{Data: frame(color.Black), ModTime: mtime.Add(time.Hour)}
+	svc.ReloadTemplates()
+	tmpl, _ = svc.getTemplate("framed")
+	require.NotEqual(t, version, tmpl._version)
+	c, lastModified = render()
+	require.Less(t, colorDistance(color.Black, c), 8)
+	require.Equal(t, "Thu, 10 Mar 2022 09:00:00 GMT", lastModified)
+}
@@ -0,0 +1,71 @@
+package appgeneric
+
+import (
+	"image"
+	"net/http"
+
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+// debug render modes, by the debug query parameter
+const (
+	DEBUG_OFF = ""
+	// png with the outline of each plugin drawn over
+	DEBUG_OVERLAY = "1"
+	// json of where each plugin was drawn
+	DEBUG_JSON = "json"
+)
+
+func validDebugMode(mode string) bool {
+	switch mode {
+	case DEBUG_OFF, DEBUG_OVERLAY, DEBUG_JSON:
+		return true
+	}
+	return false
+}
+
+// response of a DEBUG_JSON render
+type debugGeometry struct {
+	Width   int                `json:"width"`
+	Height  int                `json:"height"`
+	Plugins []plugins.Geometry `json:"plugins"`
+}
+
+// png of a render, or its geometry for DEBUG_JSON
+func respondRender(w http.ResponseWriter, mode string, img image.Image, geometry []plugins.Geometry) {
+	if mode == DEBUG_JSON {
+		size := img.Bounds().Size()
+		respondData(w, http.StatusOK, debugGeometry{size.X, size.Y, geometry})
+		return
+	}
+	w.Header().Set("content-type", "image/png")
+	w.Write(imghelper.Img2pngBuf(img))
+}
+
+// render of a served template in the mode of the debug query parameter,
+// DEBUG_OVERLAY if unset. errors are reported like the preview endpoint does
+func (svc *genericService) handleDebugImage(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("debug")
+	if mode == DEBUG_OFF {
+		mode = DEBUG_OVERLAY
+	}
+	if !validDebugMode(mode) {
+		respondError(w, http.StatusBadRequest, "debug must be 1 or json")
+		return
+	}
+
+	values := bindValuesFromRequest(r)
+	// found by mwBindInputs, unless a reload removed it since
+	tmpl, ok := svc.getTemplate(values.GetString("template"))
+	if !ok {
+		respondError(w, http.StatusNotFound, "template not found")
+		return
+	}
+	img, geometry, err := tmpl.RenderDebug(values, 0)
+	if err != nil {
+		respondData(w, http.StatusBadRequest, newPreviewError(err))
+		return
+	}
+	respondRender(w, mode, img, geometry)
+}
@@ -1,9 +1,11 @@
 package appgeneric
 
 import (
+	"context"
 	"io/fs"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,17 +13,23 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen"
+	jwtmux "gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen/mux"
 	"gitlab.sendo.vn/system/photogate/downloader"
 	"gitlab.sendo.vn/system/photogate/logger"
 	"gitlab.sendo.vn/system/photogate/plugins"
 	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+	"gitlab.sendo.vn/system/photogate/utils"
 )
 
 var (
 	TemplateName = "template"
 )
 
-var values plugins.BindValues
+type ctxKey int
+
+const bindValuesKey ctxKey = iota
 
 var opsDurationProcessed = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Name: "photogate_generic_response_duration_time",
@@ -40,20 +48,28 @@ type genericService struct {
 	mr *mux.Router
 	ir *mux.Router
 
-	tmpls map[string]*template
+	// replaced as a whole by ReloadTemplates
+	tmpls   map[string]*template
+	tmplsMu sync.RWMutex
+	static  fs.FS
+	// one reload at a time, each builds on the templates of the last
+	reloadMu sync.Mutex
 
 	upstream string
+	cache    *rendercache.Cache
+
+	// see handleBatch
+	maxBatchItems int
 
 	log zerolog.Logger
 }
 
 func NewGenericService(media3 string, templateFs fs.FS) (*genericService, error) {
 	mr := mux.NewRouter()
-	ir := mux.NewRouter()
 
 	log := logger.NamedLogger("gapp").Level(logger.GetLogLevel("generic.loglevel"))
 
-	tmpls, err := loadTemplates(log, templateFs, "generic-templates")
+	tmpls, err := loadTemplates(log, templateFs, "generic-templates", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -62,24 +78,98 @@ func NewGenericService(media3 string, templateFs fs.FS) (*genericService, error)
 		media3 += "/"
 	}
 
+	cache, err := rendercache.FromConfig("generic")
+	if err != nil {
+		return nil, err
+	}
+
 	s := &genericService{
 		mr:       mr,
-		ir:       ir,
 		tmpls:    tmpls,
+		static:   templateFs,
 		upstream: media3,
+		cache:    cache,
+		log:      log,
+
+		maxBatchItems: viper.GetInt("generic.batch.maxItems"),
 	}
 
-	singleItemSR := mr.PathPrefix("/{template}").Subrouter()
-	singleItemSR.Path("/{source:.*}").Methods(http.MethodGet).HandlerFunc(s.handleImage)
-	singleItemSR.Use(s.mwGetSingleItem)
+	templateSR := mr.PathPrefix("/{template}").Subrouter()
+	templateSR.Path("/{source:.*}").Methods(http.MethodGet).HandlerFunc(s.handleImage)
+	templateSR.Methods(http.MethodGet).HandlerFunc(s.handleImage)
+	templateSR.Use(s.mwBindInputs)
 
-	doubleItemSR := mr.PathPrefix("/{template}").Subrouter()
-	doubleItemSR.Methods(http.MethodGet).HandlerFunc(s.handleImage)
-	doubleItemSR.Use(s.mwGetDoubleItem)
+	s.ir = s.internalRouter()
+	s.ir.Use(
+		jwtmux.NewJwtAuthenticationMiddleware(
+			jwtmux.AllowByFunc(checkAllowedRole),
+			jwtmux.WithCustomClaims(&jwtauthen.XClaims{}),
+		),
+	)
 
 	return s, nil
 }
 
+// routes without authentication
+func (svc *genericService) internalRouter() *mux.Router {
+	ir := mux.NewRouter()
+	ir.Path("/preview").Methods(http.MethodPost).HandlerFunc(svc.handlePreview).Name("PREVIEW")
+	ir.Path("/preview/templates").Methods(http.MethodGet).HandlerFunc(svc.handlePreviewTemplates).Name("PREVIEW_TEMPLATES")
+	ir.Path("/preview/source").Methods(http.MethodGet).HandlerFunc(svc.handlePreviewSource).Name("PREVIEW_SOURCE")
+	// renders of served templates in a debug mode, see handleDebugImage
+	debugSR := ir.PathPrefix("/debug/{template}").Subrouter()
+	debugSR.Path("/{source:.*}").Methods(http.MethodGet).HandlerFunc(svc.handleDebugImage).Name("DEBUG_RENDER")
+	debugSR.Methods(http.MethodGet).HandlerFunc(svc.handleDebugImage).Name("DEBUG_RENDER")
+	debugSR.Use(svc.mwBindInputs)
+	ir.Path("/batch").Methods(http.MethodPost).HandlerFunc(svc.handleBatch).Name("BATCH_RENDER")
+	ir.Path("/cache/{template}").Methods(http.MethodDelete).HandlerFunc(svc.handlePurgeCache).Name("PURGE_CACHE")
+	return ir
+}
+
+func checkAllowedRole(r *http.Request, c jwtauthen.Claims) bool {
+	route := mux.CurrentRoute(r)
+	switch name := route.GetName(); name {
+	case "PREVIEW_TEMPLATES", "PREVIEW_SOURCE", "DEBUG_RENDER", "BATCH_RENDER":
+		requireRole := "photogate.template.viewer"
+		requireAdminRole := "photogate.template.admin"
+		return c.ContainRole(requireRole) || c.ContainRole(requireAdminRole)
+	case "PREVIEW", "PURGE_CACHE":
+		// a preview renders any posted template, which may download any url
+		requireAdminRole := "photogate.template.admin"
+		return c.ContainRole(requireAdminRole)
+	}
+	return false
+}
+
+func (svc *genericService) getTemplate(name string) (*template, bool) {
+	svc.tmplsMu.RLock()
+	defer svc.tmplsMu.RUnlock()
+	t, ok := svc.tmpls[name]
+	return t, ok
+}
+
+// load templates again after the template dir changed
+func (svc *genericService) ReloadTemplates() {
+	svc.reloadMu.Lock()
+	defer svc.reloadMu.Unlock()
+
+	svc.tmplsMu.RLock()
+	prev := svc.tmpls
+	svc.tmplsMu.RUnlock()
+
+	tmpls, err := loadTemplates(svc.log, svc.static, "generic-templates", prev)
+	if err != nil {
+		svc.log.Error().Err(err).Msg("reload templates")
+		return
+	}
+
+	svc.tmplsMu.Lock()
+	svc.tmpls = tmpls
+	svc.tmplsMu.Unlock()
+
+	svc.purgeChanged(prev, tmpls)
+}
+
 func (svc *genericService) MainHandler() http.Handler {
 	return svc.mr
 }
@@ -88,77 +178,105 @@ func (svc *genericService) InternalHandler() http.Handler {
 	return svc.ir
 }
 
+// attach values bound by a middleware to the request
+func withBindValues(r *http.Request, values plugins.BindValues) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), bindValuesKey, values))
+}
+
+func bindValuesFromRequest(r *http.Request) plugins.BindValues {
+	values, _ := r.Context().Value(bindValuesKey).(plugins.BindValues)
+	return values
+}
+
 func (svc *genericService) handleImage(w http.ResponseWriter, r *http.Request) {
+	values := bindValuesFromRequest(r)
 	template := values.GetString("template")
 	// start := time.Now()
 	timer := prometheus.NewTimer(opsDurationProcessed.With(prometheus.Labels{"template": template}))
 	defer timer.ObserveDuration()
 
-	tmpl, ok := svc.tmpls[template]
+	tmpl, ok := svc.getTemplate(template)
 	if !ok {
 		log.Error().Msgf("template %s not found", template)
-		w.Header().Add("content-type", "image/png")
-		w.WriteHeader(400)
-		w.Write(imghelper.Empty1x1_PNG)
+		respondEmptyImage(w, 400)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	format, err := imghelper.NegotiateFormat(r, tmpl._format)
+	if err != nil {
+		respondEmptyImage(w, 400)
 		return
 	}
 
+	key, cacheable := renderCacheKey(template, tmpl, values, format)
+	if cacheable {
+		etag := utils.ETag(key)
+		if utils.NotModified(r, etag, tmpl._mtime) {
+			utils.SetCacheHeaders(w, etag, tmpl._mtime, utils.MaxAge(tmpl.CacheMaxAge))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if b, ok := svc.cache.Get(key); ok {
+			utils.SetCacheHeaders(w, etag, tmpl._mtime, utils.MaxAge(tmpl.CacheMaxAge))
+			w.Header().Add("content-type", format.ContentType())
+			w.Write(b)
+			return
+		}
+	}
+
 	img, err := tmpl.Render(values, 0)
 	if err != nil {
-		w.Header().Add("content-type", "image/png")
 		if err2, ok := err.(*downloader.DownloadError); ok {
-			w.WriteHeader(err2.Code)
+			respondEmptyImage(w, err2.Code)
 		} else {
-			w.WriteHeader(500)
+			respondEmptyImage(w, 500)
 		}
-		w.Write(imghelper.Empty1x1_PNG)
 		return
 	}
 
-	w.Header().Add("content-type", "image/jpeg")
-	w.Write(imghelper.Img2jpegBuf(img))
+	b := imghelper.Encode(img, format)
+	if cacheable {
+		svc.cache.Put(template, key, b)
+		utils.SetCacheHeaders(w, utils.ETag(key), tmpl._mtime, utils.MaxAge(tmpl.CacheMaxAge))
+	}
+	w.Header().Add("content-type", format.ContentType())
+	w.Write(b)
+}
+
+// placeholder of a failed render, cached briefly by clients
+func respondEmptyImage(w http.ResponseWriter, code int) {
+	utils.SetErrorCacheHeaders(w)
+	w.Header().Add("content-type", "image/png")
+	w.WriteHeader(code)
+	w.Write(imghelper.Empty1x1_PNG)
 }
 
-func (svc *genericService) mwGetSingleItem(next http.Handler) http.Handler {
+// bind the query parameters declared by the template inputs,
+// the source path is bound as the "source" parameter
+func (svc *genericService) mwBindInputs(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		template := vars["template"]
-		source := vars["source"]
-		productName := r.URL.Query().Get("product_name")
-		price := r.URL.Query().Get("price")
-		promotionPrice := r.URL.Query().Get("promotion_price")
-		values = plugins.BindValues{
-			"template":        template,
-			"source":          svc.upstream + source,
-			"product_name":    productName,
-			"price":           price,
-			"promotion_price": promotionPrice,
+
+		tmpl, ok := svc.getTemplate(template)
+		if !ok {
+			log.Error().Msgf("template %s not found", template)
+			respondEmptyImage(w, 400)
+			return
 		}
 
-		next.ServeHTTP(w, r)
-	})
-}
+		params := r.URL.Query()
+		if source, ok := vars["source"]; ok {
+			params.Set("source", source)
+		}
 
-func (svc *genericService) mwGetDoubleItem(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		template := vars["template"]
-		img_source1 := r.URL.Query().Get("img_source1")
-		price1 := r.URL.Query().Get("price1")
-		promotionPrice1 := r.URL.Query().Get("promotion_price1")
-		img_source2 := r.URL.Query().Get("img_source2")
-		price2 := r.URL.Query().Get("price2")
-		promotionPrice2 := r.URL.Query().Get("promotion_price2")
-		values = plugins.BindValues{
-			"template":         template,
-			"img_source1":      svc.upstream + img_source1,
-			"price1":           price1,
-			"promotion_price1": promotionPrice1,
-			"img_source2":      svc.upstream + img_source2,
-			"price2":           price2,
-			"promotion_price2": promotionPrice2,
+		values, err := tmpl.bindRequest(template, params, svc.upstream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withBindValues(r, values))
 	})
 }
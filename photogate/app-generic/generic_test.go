@@ -0,0 +1,387 @@
+package appgeneric
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+// product i is a solid image of productColor(i)
+func productColor(i int) color.NRGBA {
+	return color.NRGBA{uint8(i * 37 % 256), uint8(i * 71 % 256), uint8(i * 113 % 256), 255}
+}
+
+func newProductUpstream(t testing.TB) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/product/"))
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		dc := imghelper.InitDrawingContext(64, 64, productColor(i))
+		w.Write(imghelper.Img2pngBuf(dc.Image()))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestService(t testing.TB, upstream string) *genericService {
+	svc, err := NewGenericService(upstream, newTestStatic())
+	require.NoError(t, err)
+	return svc
+}
+
+func newTestStatic() fstest.MapFS {
+	return fstest.MapFS{
+		"generic-templates/product.yaml": &fstest.MapFile{
+			Data: []byte(`
+allWidths: [100]
+inputs:
+- name: source
+  type: image-url
+  required: true
+- name: product_name
+- name: price
+  type: price
+  required: true
+plugins:
+- type: image
+  mode: stretch
+  binding:
+    image: source
+- type: text
+  x: 0
+  y: 0
+  color: '#000'
+  fontUri: ../static/fonts/Roboto-Bold.ttf
+  fontsize: 1
+  drawWrapped: true
+  textWidth: 1
+  maxCharacter: 10
+  binding:
+    text: product_name
+`),
+		},
+	}
+}
+
+func colorDistance(a, b color.Color) int {
+	r1, g1, b1, _ := a.RGBA()
+	r2, g2, b2, _ := b.RGBA()
+	abs := func(x, y uint32) int {
+		if x > y {
+			return int(x-y) >> 8
+		}
+		return int(y-x) >> 8
+	}
+	return abs(r1, r2) + abs(g1, g2) + abs(b1, b2)
+}
+
+// template with a large text over the product image, for renders checked
+// by their text
+const labelTemplate = `
+allWidths: [100]
+format: png
+inputs:
+- name: source
+  type: image-url
+  required: true
+- name: product_name
+- name: text_color
+plugins:
+- type: image
+  mode: stretch
+  binding:
+    image: source
+- type: text
+  x: 5
+  y: 70
+  fontUri: ../static/fonts/Roboto-Bold.ttf
+  fontsize: 40
+  binding:
+    text: product_name
+    color: text_color
+`
+
+func TestParallelRenders(t *testing.T) {
+	upstream := newProductUpstream(t)
+	static := newTestStatic()
+	static["generic-templates/label.yaml"] = &fstest.MapFile{Data: []byte(labelTemplate)}
+	svc, err := NewGenericService(upstream.URL, static)
+	require.NoError(t, err)
+	tmpl, ok := svc.getTemplate("label")
+	require.True(t, ok)
+
+	// each request has its own text and color, rendered alone first
+	const n = 32
+	queries := make([]url.Values, n)
+	want := make([]image.Image, n)
+	for i := range queries {
+		q := url.Values{}
+		q.Set("product_name", fmt.Sprintf("%d", 10+i))
+		q.Set("text_color", fmt.Sprintf("#%02x%02x%02x", 255-i*7, i*5, 128))
+		queries[i] = q
+
+		values := plugins.BindValues{"source": upstream.URL + "/product/" + strconv.Itoa(i)}
+		for k := range q {
+			values[k] = q.Get(k)
+		}
+		want[i], err = tmpl.Render(values, 100)
+		require.NoError(t, err)
+		if i > 0 {
+			require.NotEqual(t, imghelper.Img2pngBuf(want[i-1]), imghelper.Img2pngBuf(want[i]))
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/label/product/%d?%s", i, queries[i].Encode()), nil)
+			w := httptest.NewRecorder()
+			svc.MainHandler().ServeHTTP(w, r)
+
+			if !assertOK(t, w.Code == 200, "product %d: status %d", i, w.Code) {
+				return
+			}
+			img, _, err := image.Decode(w.Body)
+			if !assertOK(t, err == nil, "product %d: decode %v", i, err) {
+				return
+			}
+			c := img.At(img.Bounds().Dx()-2, img.Bounds().Dy()-2)
+			assertOK(t, colorDistance(c, productColor(i)) < 24,
+				"product %d: got color %v want %v", i, c, productColor(i))
+			// text and color of this request, not of another one
+			assertOK(t, string(imghelper.Img2pngBuf(img)) == string(imghelper.Img2pngBuf(want[i])),
+				"product %d: text %s differs from its render alone", i, queries[i].Get("product_name"))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMissingRequiredInput(t *testing.T) {
+	svc := newTestService(t, "http://upstream.invalid")
+
+	r := httptest.NewRequest(http.MethodGet, "/product/product/1?product_name=abc", nil)
+	w := httptest.NewRecorder()
+	svc.MainHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), `"price"`)
+}
+
+func TestDebugRender(t *testing.T) {
+	upstream := newProductUpstream(t)
+	svc := newTestService(t, upstream.URL)
+
+	get := func(debug string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/debug/product/product/2?price=1000&product_name=abc&debug="+debug, nil)
+		w := httptest.NewRecorder()
+		svc.internalRouter().ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("json")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var geometry debugGeometry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &geometry))
+	require.Equal(t, 100, geometry.Width)
+	require.Len(t, geometry.Plugins, 2)
+	require.Equal(t, "image", geometry.Plugins[0].Type)
+	require.Equal(t, &plugins.Box{X: 0, Y: 0, Width: 100, Height: geometry.Height}, geometry.Plugins[0].Rect)
+	require.Equal(t, "text", geometry.Plugins[1].Type)
+	require.NotNil(t, geometry.Plugins[1].Content)
+
+	w = get("1")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "image/png", w.Header().Get("content-type"))
+	img, _, err := image.Decode(w.Body)
+	require.NoError(t, err)
+	// outline of the image plugin over the product
+	require.Greater(t, colorDistance(img.At(0, 50), productColor(2)), 24)
+	require.Less(t, colorDistance(img.At(50, 50), productColor(2)), 24)
+
+	w = get("")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "image/png", w.Header().Get("content-type"))
+
+	w = get("yes")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// template removed by a reload after the inputs were bound
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/debug/missing/product/2?debug=1", nil)
+	svc.handleDebugImage(w, withBindValues(r, plugins.BindValues{"template": "missing"}))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	// not served publicly
+	for _, debug := range []string{"1", "json", "yes"} {
+		r = httptest.NewRequest(http.MethodGet, "/product/product/2?price=1000&product_name=abc&debug="+debug, nil)
+		w = httptest.NewRecorder()
+		svc.MainHandler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "image/jpeg", w.Header().Get("content-type"))
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	upstream := newProductUpstream(t)
+	svc := newTestService(t, upstream.URL)
+
+	get := func(query, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/product/product/3?price=1000&product_name=abc"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		svc.MainHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	cases := []struct {
+		query, accept, format string
+	}{
+		{"", "", "jpeg"},
+		{"", "image/*,*/*;q=0.8", "jpeg"},
+		{"", "image/webp,image/*;q=0.8", "webp"},
+		{"", "image/png;q=0.5,image/jpeg;q=0.5", "jpeg"},
+		{"", "image/avif,image/png", "png"},
+		{"&format=png", "image/webp", "png"},
+		{"&format=JPG", "", "jpeg"},
+		{"&format=webp", "", "webp"},
+	}
+	for _, c := range cases {
+		w := get(c.query, c.accept)
+		require.Equal(t, http.StatusOK, w.Code, "%+v", c)
+		require.Equal(t, "image/"+c.format, w.Header().Get("content-type"), "%+v", c)
+		require.Equal(t, "Accept", w.Header().Get("Vary"))
+		img, format, err := image.Decode(w.Body)
+		require.NoError(t, err)
+		require.Equal(t, c.format, format)
+		require.Less(t, colorDistance(img.At(50, 50), productColor(3)), 24)
+	}
+
+	w := get("&format=gif", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRenderFile(t *testing.T) {
+	upstream := newProductUpstream(t)
+	params := url.Values{"source": {"product/5"}, "price": {"1000"}}
+
+	img, err := RenderFile(newTestStatic(), upstream.URL, "product", params, 0)
+	require.NoError(t, err)
+	require.Equal(t, 100, img.Bounds().Dx())
+	require.Less(t, colorDistance(productColor(5), img.At(50, 80)), 10)
+
+	p := filepath.Join(t.TempDir(), "source.png")
+	dc := imghelper.InitDrawingContext(64, 64, productColor(7))
+	require.NoError(t, os.WriteFile(p, imghelper.Img2pngBuf(dc.Image()), 0644))
+	params.Set("source", "file://"+filepath.ToSlash(p))
+
+	// the service resolves file uris against its upstream
+	_, err = RenderFile(newTestStatic(), upstream.URL, "product", params, 0)
+	require.Error(t, err)
+
+	utils.AllowFileScheme()
+	img, err = RenderFile(newTestStatic(), upstream.URL, "product", params, 0)
+	require.NoError(t, err)
+	require.Less(t, colorDistance(productColor(7), img.At(50, 80)), 10)
+
+	_, err = RenderFile(newTestStatic(), upstream.URL, "missing", params, 0)
+	require.Error(t, err)
+}
+
+// require must not be called outside the test goroutine
+func assertOK(t *testing.T, ok bool, format string, args ...interface{}) bool {
+	if !ok {
+		t.Errorf(format, args...)
+	}
+	return ok
+}
+
+func TestReloadTemplates(t *testing.T) {
+	upstream := newProductUpstream(t)
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "generic-templates"), 0755))
+	static := utils.NewOverlayFS(os.DirFS(dir), fstest.MapFS{
+		"generic-templates/product.yaml": &fstest.MapFile{Data: []byte(`
+allWidths: [100]
+plugins: []
+`)},
+	})
+	svc, err := NewGenericService(upstream.URL, static)
+	require.NoError(t, err)
+
+	render := func(name string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		svc.MainHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+name+"/product/1", nil))
+		return w
+	}
+	width := func(name string) int {
+		w := render(name)
+		require.Equal(t, 200, w.Code)
+		img, _, err := image.Decode(w.Body)
+		require.NoError(t, err)
+		return img.Bounds().Dx()
+	}
+	write := func(name, s string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "generic-templates", name), []byte(s), 0644))
+	}
+	require.Equal(t, 100, width("product"))
+
+	// file of the dir hides the embedded one, new files are added
+	write("product.yaml", "allWidths: [200]\n")
+	write("banner.yaml", "allWidths: [50]\n")
+	svc.ReloadTemplates()
+	require.Equal(t, 200, width("product"))
+	require.Equal(t, 50, width("banner"))
+
+	// reloads at the same time, like the watcher and the store, end with
+	// the files on disk
+	write("banner.yaml", "allWidths: [60]\n")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svc.ReloadTemplates()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 200, width("product"))
+	require.Equal(t, 60, width("banner"))
+
+	// broken files keep their previous version
+	write("product.yaml", "allWidths: [300]\nplugins: [{type: unknown}]\n")
+	write("banner.yaml", "allWidths: [")
+	svc.ReloadTemplates()
+	require.Equal(t, 200, width("product"))
+	require.Equal(t, 60, width("banner"))
+
+	// removed files fall back to the embedded template
+	require.NoError(t, os.Remove(filepath.Join(dir, "generic-templates", "product.yaml")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "generic-templates", "banner.yaml")))
+	svc.ReloadTemplates()
+	require.Equal(t, 100, width("product"))
+	require.Equal(t, http.StatusBadRequest, render("banner").Code)
+}
@@ -0,0 +1,52 @@
+package appgeneric
+
+import (
+	"io/fs"
+
+	"github.com/spf13/cast"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+// LintTemplate loads the content of a generic template named name like
+// ValidateTemplate, then checks what loading does not: keys bound which
+// no input provides, widths, and plugins drawn outside the image
+func LintTemplate(static fs.FS, name string, b []byte) []plugins.Problem {
+	path := "generic-templates/" + name + ".yaml"
+	m, err := utils.ParseTemplateConfig(static, path, b)
+	if err != nil {
+		return []plugins.Problem{plugins.NewProblem(err)}
+	}
+	t, err := newTemplate(name, m)
+	if err != nil {
+		return []plugins.Problem{plugins.NewProblem(err)}
+	}
+
+	var problems []plugins.Problem
+	// newTemplate replaces an invalid ratio with 1
+	if ratio, ok := m["widthHeightRatio"]; ok && cast.ToFloat64(ratio) <= 0 {
+		problems = append(problems, plugins.Problem{
+			Field:   "widthHeightRatio",
+			Message: "widthHeightRatio must be positive",
+		})
+	}
+
+	// bound by mwBindInputs
+	scope := inputsScope(t.Inputs)
+	scope["template"] = nil
+	scope["upstream"] = nil
+
+	return append(problems, t._plugins.Lint(scope, t.AllWidths, t.WidthHeightRatio)...)
+}
+
+func inputsScope(inputs []templateInput) plugins.LintScope {
+	scope := plugins.LintScope{}
+	for _, in := range inputs {
+		if in.Type == INPUT_LIST {
+			scope[in.Name] = inputsScope(in.Fields)
+		} else {
+			scope[in.Name] = nil
+		}
+	}
+	return scope
+}
@@ -0,0 +1,201 @@
+package appgeneric
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+
+	appqr "gitlab.sendo.vn/system/photogate/app-qr"
+	"gitlab.sendo.vn/system/photogate/downloader"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+// max size of a previewed template
+const maxPreviewSize = 1 << 20
+
+// dir of templates by kind
+var previewDirs = map[string]string{
+	"generic": "generic-templates",
+	"qr":      "qr-templates",
+}
+
+type previewRequest struct {
+	// generic or qr, default generic
+	Kind string `json:"kind"`
+	// name of the template, extends are resolved from its dir.
+	// default preview
+	Name string `json:"name"`
+	// yaml content of the template
+	Template string `json:"template"`
+	// query parameters bound by the inputs of a generic template
+	Values map[string]string `json:"values"`
+	// text of the qr code of a QR template
+	QrPayload string `json:"qr_payload"`
+	Width     int    `json:"width"`
+	// 1 to outline the plugins, json for where each plugin was drawn
+	Debug string `json:"debug"`
+}
+
+// location of a plugin error, path is the index of the plugin in each
+// level of nested group and grid plugins
+type previewPluginError struct {
+	Op    string `json:"op"`
+	Path  []int  `json:"path"`
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Id    string `json:"id,omitempty"`
+	Field string `json:"field,omitempty"`
+}
+
+type previewError struct {
+	Error  string              `json:"error"`
+	Input  string              `json:"input,omitempty"`
+	Plugin *previewPluginError `json:"plugin,omitempty"`
+}
+
+func newPreviewError(err error) *previewError {
+	pe := &previewError{Error: err.Error()}
+
+	var ie *inputError
+	if errors.As(err, &ie) {
+		pe.Input = ie.Name
+	}
+
+	var pluginErr *plugins.PluginError
+	for errors.As(err, &pluginErr) {
+		if pe.Plugin == nil {
+			pe.Plugin = &previewPluginError{Op: pluginErr.Op}
+		}
+		pe.Plugin.Path = append(pe.Plugin.Path, pluginErr.Index)
+		pe.Plugin.Index = pluginErr.Index
+		pe.Plugin.Type = pluginErr.Type
+		pe.Plugin.Id = pluginErr.Id
+		pe.Plugin.Field = pluginErr.Field
+		err = pluginErr.Err
+	}
+	return pe
+}
+
+// render the template of the request body, see previewRequest.
+// the response is a png, or a json previewError
+func (svc *genericService) handlePreview(w http.ResponseWriter, r *http.Request) {
+	var req previewRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxPreviewSize)).Decode(&req)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Kind == "" {
+		req.Kind = "generic"
+	}
+	if req.Name == "" {
+		req.Name = "preview"
+	}
+	if _, ok := previewDirs[req.Kind]; !ok || strings.ContainsAny(req.Name, "/\\") {
+		respondError(w, http.StatusBadRequest, "invalid kind or name")
+		return
+	}
+	if !validDebugMode(req.Debug) {
+		respondError(w, http.StatusBadRequest, "debug must be 1 or json")
+		return
+	}
+
+	var (
+		img      image.Image
+		geometry []plugins.Geometry
+		debug    = req.Debug != DEBUG_OFF
+	)
+	if req.Kind == "qr" {
+		img, geometry, err = appqr.PreviewTemplate(svc.static, req.Name, []byte(req.Template), req.QrPayload, req.Width, debug)
+	} else {
+		img, geometry, err = svc.preview(&req, debug)
+	}
+	if err != nil {
+		code := http.StatusBadRequest
+		if err2, ok := err.(*downloader.DownloadError); ok && err2.Code >= 500 {
+			code = http.StatusBadGateway
+		}
+		respondData(w, code, newPreviewError(err))
+		return
+	}
+
+	respondRender(w, req.Debug, img, geometry)
+}
+
+func (svc *genericService) preview(req *previewRequest, debug bool) (image.Image, []plugins.Geometry, error) {
+	tmpl, err := loadTemplateFile(svc.static, req.Name, "generic-templates/"+req.Name+".yaml", []byte(req.Template))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	params := url.Values{}
+	for k, v := range req.Values {
+		params.Set(k, v)
+	}
+	values, err := tmpl.bindRequest(req.Name, params, svc.upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tmpl.render(values, req.Width, debug)
+}
+
+// names of the templates of kind, to start a preview from
+func (svc *genericService) handlePreviewTemplates(w http.ResponseWriter, r *http.Request) {
+	dir, ok := previewDirs[r.URL.Query().Get("kind")]
+	if !ok {
+		respondError(w, http.StatusBadRequest, "invalid kind")
+		return
+	}
+
+	names := []string{}
+	err := utils.ScanFileMatch(svc.static, dir, genericTemplateRx, func(fname, path string, b []byte) error {
+		names = append(names, strings.TrimSuffix(fname, ".yaml"))
+		return nil
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondData(w, http.StatusOK, names)
+}
+
+// yaml content of a template, as served
+func (svc *genericService) handlePreviewSource(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	dir, ok := previewDirs[query.Get("kind")]
+	name := query.Get("name")
+	if !ok || name == "" || strings.ContainsAny(name, "/\\") {
+		respondError(w, http.StatusBadRequest, "invalid kind or name")
+		return
+	}
+
+	b, err := fs.ReadFile(svc.static, dir+"/"+name+".yaml")
+	if errors.Is(err, fs.ErrNotExist) {
+		respondError(w, http.StatusNotFound, "template not found")
+		return
+	}
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/yaml")
+	w.Write(b)
+}
+
+func respondData(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func respondError(w http.ResponseWriter, code int, msg string) {
+	respondData(w, code, map[string]string{"error": msg})
+}
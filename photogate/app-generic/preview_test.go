@@ -0,0 +1,138 @@
+package appgeneric
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	_ "image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreview(t *testing.T) {
+	upstream := newProductUpstream(t)
+	svc := newTestService(t, upstream.URL)
+
+	preview := func(req previewRequest) *httptest.ResponseRecorder {
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		svc.internalRouter().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/preview", bytes.NewReader(body)))
+		return w
+	}
+	previewError := func(req previewRequest) previewError {
+		w := preview(req)
+		require.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		var pe previewError
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pe))
+		return pe
+	}
+
+	w := preview(previewRequest{
+		Template: "extends: product.yaml",
+		Values:   map[string]string{"source": "product/3", "price": "1000"},
+		// not in allWidths
+		Width: 50,
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Equal(t, "image/png", w.Header().Get("content-type"))
+	img, _, err := image.Decode(w.Body)
+	require.NoError(t, err)
+	require.Equal(t, 100, img.Bounds().Dx())
+	require.Less(t, colorDistance(productColor(3), img.At(50, 80)), 10)
+
+	pe := previewError(previewRequest{
+		Template: `
+allWidths: [100]
+plugins:
+- type: image
+  binding:
+    image: source
+- type: text
+  fontUri: ../static/fonts/Roboto-Bold.ttf
+`,
+	})
+	require.Equal(t, "generic-templates/preview.yaml: configure plugin #1 (text): field fontSize is required", pe.Error)
+	require.Equal(t, &previewPluginError{
+		Op: "configure", Path: []int{1}, Index: 1, Type: "text", Field: "fontSize",
+	}, pe.Plugin)
+
+	pe = previewError(previewRequest{
+		Template: `
+allWidths: [100]
+plugins:
+- type: group
+  plugins:
+  - type: image
+    binding:
+      image: source
+  - type: image
+    image: product/1
+    valign: side
+`,
+	})
+	require.Equal(t, &previewPluginError{
+		Op: "configure", Path: []int{0, 1}, Index: 1, Type: "image", Field: "valign",
+	}, pe.Plugin)
+
+	pe = previewError(previewRequest{
+		Template: `
+allWidths: [100]
+plugins:
+- type: text
+  fontUri: ../static/fonts/Roboto-Bold.ttf
+  fontsize: big
+`,
+	})
+	require.Equal(t, "decode", pe.Plugin.Op)
+	require.Equal(t, "fontSize", pe.Plugin.Field)
+
+	pe = previewError(previewRequest{
+		Template: "extends: product.yaml",
+		Values:   map[string]string{"source": "product/3"},
+	})
+	require.Equal(t, "price", pe.Input)
+	require.Nil(t, pe.Plugin)
+
+	w = preview(previewRequest{Kind: "svg", Template: "extends: product.yaml"})
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPreviewSource(t *testing.T) {
+	svc := newTestService(t, "http://media3/")
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		svc.internalRouter().ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+
+	w := get("/preview/templates?kind=generic")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `["product"]`, w.Body.String())
+
+	w = get("/preview/source?kind=generic&name=product")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "type: image-url")
+
+	w = get("/preview/source?kind=generic&name=missing")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPreviewAuth(t *testing.T) {
+	svc := newTestService(t, "http://media3/")
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/preview", bytes.NewReader([]byte(`{"template":"plugins: []"}`))),
+		httptest.NewRequest(http.MethodGet, "/preview/templates?kind=generic", nil),
+		httptest.NewRequest(http.MethodGet, "/preview/source?kind=generic&name=product", nil),
+		httptest.NewRequest(http.MethodGet, "/debug/product/product/2?price=1000&debug=json", nil),
+	} {
+		w := httptest.NewRecorder()
+		svc.InternalHandler().ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code, req.URL.Path)
+	}
+}
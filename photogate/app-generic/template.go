@@ -2,20 +2,93 @@ package appgeneric
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io/fs"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gitlab.sendo.vn/system/photogate/plugins"
 	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
 	"gitlab.sendo.vn/system/photogate/utils"
 	"gopkg.in/yaml.v3"
 )
 
+type INPUT_TYPE string
+
+const (
+	INPUT_STRING    INPUT_TYPE = "string"
+	INPUT_INT       INPUT_TYPE = "int"
+	INPUT_PRICE     INPUT_TYPE = "price"
+	INPUT_IMAGE_URL INPUT_TYPE = "image-url"
+	// items from parameters like products[0].image, products[0].price
+	INPUT_LIST INPUT_TYPE = "list"
+
+	defaultMaxListItems = 20
+)
+
+// query parameter a template binds into its plugins
+type templateInput struct {
+	Name     string
+	Type     INPUT_TYPE
+	Required bool
+	// used when the parameter is missing or empty
+	Default string
+
+	// fields of each item of a list
+	Fields []templateInput
+	// most items of a list, default 20
+	MaxItems int
+}
+
+type inputError struct {
+	Name   string
+	Reason string
+}
+
+func (e *inputError) Error() string {
+	return fmt.Sprintf(`input "%s" %s`, e.Name, e.Reason)
+}
+
+// convert a raw parameter to the value bound into plugins,
+// relative image urls are resolved against upstream
+func (in *templateInput) convert(s string, upstream string) (interface{}, error) {
+	switch in.Type {
+	case INPUT_STRING:
+		return s, nil
+	case INPUT_INT:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return nil, &inputError{in.Name, "must be an integer"}
+		}
+		return n, nil
+	case INPUT_PRICE:
+		// accept grouped prices like 120.000 or 120,000, but not a
+		// decimal part like 99.5
+		n, ok := utils.ParsePrice(s)
+		if !ok {
+			return nil, &inputError{in.Name, "must be a non-negative price"}
+		}
+		return n, nil
+	case INPUT_IMAGE_URL:
+		// local file of a command line render, see utils.AllowFileScheme
+		if strings.HasPrefix(s, "file://") && utils.FileSchemeAllowed() {
+			return s, nil
+		}
+		return upstream + strings.TrimPrefix(s, "/"), nil
+	default:
+		return nil, &inputError{in.Name, fmt.Sprintf("has invalid type %s", in.Type)}
+	}
+}
+
 type template struct {
 	// possible widths, default width = widths[0]
 	AllWidths []int
@@ -25,8 +98,197 @@ type template struct {
 	BackgroundColor string
 	_bgColor        color.Color
 
+	// jpeg, png or webp, when the request asks for no format
+	Format  string
+	_format imghelper.Format
+
+	// Cache-Control max-age of renders, httpCache.maxAge if unset
+	CacheMaxAge *time.Duration
+
+	Inputs []templateInput
+
 	Plugins  []map[string]interface{}
 	_plugins plugins.Plugins
+
+	// of the config, renders are cached by it
+	_version string
+	// of the template files, Last-Modified of renders if not zero
+	_mtime time.Time
+}
+
+var listParamRx = regexp.MustCompile(`^(.+)\[(\d+)\]\.(.+)$`)
+
+// items of a list from parameters like products[0].image, ordered by
+// index. indexes need not be contiguous
+func (in *templateInput) bindList(params url.Values, upstream string) ([]map[string]interface{}, error) {
+	itemParams := map[int]url.Values{}
+	for k, v := range params {
+		m := listParamRx.FindStringSubmatch(k)
+		if m == nil || m[1] != in.Name {
+			continue
+		}
+		i, err := strconv.Atoi(m[2])
+		if err != nil || i >= in.MaxItems {
+			return nil, &inputError{in.Name, fmt.Sprintf("has more than %d items", in.MaxItems)}
+		}
+		if itemParams[i] == nil {
+			itemParams[i] = url.Values{}
+		}
+		itemParams[i][m[3]] = v
+	}
+
+	indexes := make([]int, 0, len(itemParams))
+	for i := range itemParams {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	items := make([]map[string]interface{}, 0, len(indexes))
+	for _, i := range indexes {
+		item, err := bindInputs(in.Fields, itemParams[i], upstream)
+		if err != nil {
+			if ie, ok := err.(*inputError); ok {
+				ie.Name = fmt.Sprintf("%s[%d].%s", in.Name, i, ie.Name)
+			}
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// urls of the image inputs of values bound by bindRequest
+func (tm *template) imageURLs(values plugins.BindValues) []string {
+	return imageURLs(tm.Inputs, values)
+}
+
+func imageURLs(inputs []templateInput, values map[string]interface{}) []string {
+	var urls []string
+	for i := range inputs {
+		in := &inputs[i]
+		switch in.Type {
+		case INPUT_IMAGE_URL:
+			if s, ok := values[in.Name].(string); ok {
+				urls = append(urls, s)
+			}
+		case INPUT_LIST:
+			items, _ := values[in.Name].([]map[string]interface{})
+			for _, item := range items {
+				urls = append(urls, imageURLs(in.Fields, item)...)
+			}
+		}
+	}
+	return urls
+}
+
+// bind the parameters declared in inputs, missing required inputs
+// are reported by an *inputError
+func (tm *template) bindInputs(params url.Values, upstream string) (plugins.BindValues, error) {
+	return bindInputs(tm.Inputs, params, upstream)
+}
+
+// values of a render of the template named name with request parameters,
+// upstream ends with /
+func (tm *template) bindRequest(name string, params url.Values, upstream string) (plugins.BindValues, error) {
+	values, err := tm.bindInputs(params, upstream)
+	if err != nil {
+		return nil, err
+	}
+	values["template"] = name
+	values["upstream"] = strings.TrimSuffix(upstream, "/")
+	return values, nil
+}
+
+func bindInputs(inputs []templateInput, params url.Values, upstream string) (plugins.BindValues, error) {
+	values := plugins.BindValues{}
+	for i := range inputs {
+		in := &inputs[i]
+
+		if in.Type == INPUT_LIST {
+			items, err := in.bindList(params, upstream)
+			if err != nil {
+				return nil, err
+			}
+			if len(items) == 0 && in.Required {
+				return nil, &inputError{in.Name, "is required"}
+			}
+			values[in.Name] = items
+			continue
+		}
+
+		s := params.Get(in.Name)
+		if s == "" {
+			if in.Required {
+				return nil, &inputError{in.Name, "is required"}
+			}
+			if in.Default == "" {
+				continue
+			}
+			s = in.Default
+		}
+
+		v, err := in.convert(s, upstream)
+		if err != nil {
+			return nil, err
+		}
+		values[in.Name] = v
+	}
+	return values, nil
+}
+
+func (tm *template) validateInputs() error {
+	return validateInputs(tm.Inputs, false)
+}
+
+func validateInputs(inputs []templateInput, isListItem bool) error {
+	names := map[string]bool{}
+	for i := range inputs {
+		in := &inputs[i]
+		if in.Name == "" {
+			return fmt.Errorf("inputs at index %d has no name", i)
+		}
+		if names[in.Name] {
+			return fmt.Errorf(`input "%s" declared twice`, in.Name)
+		}
+		names[in.Name] = true
+
+		switch in.Type {
+		case INPUT_STRING, INPUT_INT, INPUT_PRICE, INPUT_IMAGE_URL:
+			// pass
+		case INPUT_LIST:
+			if isListItem {
+				return &inputError{in.Name, "is a list inside a list"}
+			}
+			if len(in.Fields) == 0 {
+				return &inputError{in.Name, "has no fields"}
+			}
+			if in.Default != "" {
+				return &inputError{in.Name, "is a list and cannot have a default"}
+			}
+			if in.MaxItems <= 0 {
+				in.MaxItems = defaultMaxListItems
+			}
+			if err := validateInputs(in.Fields, true); err != nil {
+				if ie, ok := err.(*inputError); ok {
+					ie.Name = in.Name + "." + ie.Name
+					return ie
+				}
+				return fmt.Errorf(`input "%s": %w`, in.Name, err)
+			}
+			continue
+		case "":
+			in.Type = INPUT_STRING
+		default:
+			return &inputError{in.Name, fmt.Sprintf("has invalid type %s", in.Type)}
+		}
+
+		if in.Default != "" {
+			if _, err := in.convert(in.Default, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func intsIndex(arr []int, x int) int {
@@ -39,6 +301,17 @@ func intsIndex(arr []int, x int) int {
 }
 
 func (tm *template) Render(values plugins.BindValues, width int) (image.Image, error) {
+	img, _, err := tm.render(values, width, false)
+	return img, err
+}
+
+// RenderDebug renders with the outline of each plugin drawn over,
+// and returns where each plugin was drawn
+func (tm *template) RenderDebug(values plugins.BindValues, width int) (image.Image, []plugins.Geometry, error) {
+	return tm.render(values, width, true)
+}
+
+func (tm *template) render(values plugins.BindValues, width int, debug bool) (image.Image, []plugins.Geometry, error) {
 	if intsIndex(tm.AllWidths, width) < 0 {
 		width = tm.AllWidths[0]
 	}
@@ -49,17 +322,22 @@ func (tm *template) Render(values plugins.BindValues, width int) (image.Image, e
 	ps, err := tm._plugins.Bind(values)
 	if err != nil {
 		log.Error().Err(err).Msg("bind")
-		return nil, err
+		return nil, nil, err
 	}
 
 	dc := imghelper.InitDrawingContext(width, height, tm._bgColor)
-	err = ps.Execute(dc)
+	var geometry []plugins.Geometry
+	if debug {
+		geometry, err = ps.ExecuteDebug(dc)
+	} else {
+		err = ps.Execute(dc)
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("execute")
-		return nil, err
+		return nil, nil, err
 	}
 
-	return dc.Image(), nil
+	return dc.Image(), geometry, nil
 }
 
 func loadTemplate(name string, b []byte) (*template, error) {
@@ -69,7 +347,11 @@ func loadTemplate(name string, b []byte) (*template, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newTemplate(name, m)
+}
 
+// template from yaml config with extends and include resolved
+func newTemplate(name string, m map[string]interface{}) (*template, error) {
 	c := &template{}
 	dec, err := plugins.NewStructDecoder(c)
 	if err != nil {
@@ -79,6 +361,13 @@ func loadTemplate(name string, b []byte) (*template, error) {
 		return nil, err
 	}
 
+	assets, mtime := utils.AssetsVersion(m)
+	c._version, err = rendercache.Version(m, assets)
+	if err != nil {
+		return nil, err
+	}
+	c._mtime = mtime
+
 	if len(c.AllWidths) < 1 {
 		return nil, errors.New("allWidths is required")
 	}
@@ -91,6 +380,18 @@ func loadTemplate(name string, b []byte) (*template, error) {
 		c._bgColor = imghelper.ParseColor(c.BackgroundColor)
 	}
 
+	c._format, err = imghelper.ParseFormat(c.Format)
+	if err != nil {
+		return nil, err
+	}
+	if c._format == "" {
+		c._format = imghelper.FORMAT_JPEG
+	}
+
+	if err = c.validateInputs(); err != nil {
+		return nil, err
+	}
+
 	c._plugins, err = plugins.NewPluginsFromConfig(c.Plugins)
 	if err != nil {
 		return nil, err
@@ -106,15 +407,28 @@ func loadTemplate(name string, b []byte) (*template, error) {
 
 var genericTemplateRx = regexp.MustCompile(`\.yaml$`)
 
-func loadTemplates(log zerolog.Logger, static fs.FS, root string) (map[string]*template, error) {
+// load templates of root. when reloading, prev holds the templates in use
+// and a template which fails to load keeps serving its previous version
+func loadTemplates(log zerolog.Logger, static fs.FS, root string, prev map[string]*template) (map[string]*template, error) {
 	tmpls := map[string]*template{}
 	err := utils.ScanFileMatch(static, root, genericTemplateRx, func(fname, path string, b []byte) error {
 		name := strings.TrimSuffix(fname, ".yaml")
 
 		log.Info().Msgf(`load generic template "%s"`, path)
-		t, err := loadTemplate(name, b)
+		t, err := loadTemplateFile(static, name, path, b)
 		if err != nil {
-			return err
+			if prev == nil {
+				return err
+			}
+			utils.TemplateReloads.WithLabelValues("generic", "error").Inc()
+			log.Error().Err(err).Msgf(`reload generic template "%s", keep previous version`, path)
+			if old, ok := prev[name]; ok {
+				tmpls[name] = old
+			}
+			return nil
+		}
+		if prev != nil {
+			utils.TemplateReloads.WithLabelValues("generic", "ok").Inc()
 		}
 
 		tmpls[name] = t
@@ -127,3 +441,48 @@ func loadTemplates(log zerolog.Logger, static fs.FS, root string) (map[string]*t
 
 	return tmpls, nil
 }
+
+func loadTemplateFile(static fs.FS, name, path string, b []byte) (*template, error) {
+	m, mtime, err := utils.ParseTemplateConfigMtime(static, path, b)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTemplate(name, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if mtime.After(t._mtime) {
+		t._mtime = mtime
+	}
+	return t, nil
+}
+
+// ValidateTemplate loads the content of a generic template named name,
+// templates it extends are read from static
+func ValidateTemplate(static fs.FS, name string, b []byte) error {
+	_, err := loadTemplateFile(static, name, "generic-templates/"+name+".yaml", b)
+	return err
+}
+
+// RenderFile renders the template named name of static with the input
+// parameters params, like a request to the service with upstream media3
+func RenderFile(static fs.FS, media3, name string, params url.Values, width int) (image.Image, error) {
+	path := "generic-templates/" + name + ".yaml"
+	b, err := fs.ReadFile(static, path)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := loadTemplateFile(static, name, path, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(media3, "/") {
+		media3 += "/"
+	}
+	values, err := tmpl.bindRequest(name, params, media3)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Render(values, width)
+}
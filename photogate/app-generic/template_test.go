@@ -2,12 +2,14 @@ package appgeneric
 
 import (
 	"io/fs"
+	"net/url"
 	"testing"
 	"testing/fstest"
 
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/require"
 	"gitlab.sendo.vn/system/photogate/downloader"
+	"gitlab.sendo.vn/system/photogate/plugins"
 )
 
 func init() {
@@ -51,8 +53,182 @@ plugins:
 	err = fstest.TestFS(tDir, "hello")
 	require.Error(t, err)
 
-	tmpls, err := loadTemplates(log.Logger, tDir, ".")
+	tmpls, err := loadTemplates(log.Logger, tDir, ".", nil)
 	require.NoError(t, err)
 	require.Len(t, tmpls, 1)
 	require.NotNil(t, tmpls["something"])
 }
+
+func TestTemplateInputs(t *testing.T) {
+	c, err := loadTemplate("hello", []byte(`
+allWidths: [128]
+inputs:
+- name: source
+  type: image-url
+  required: true
+- name: name
+  default: no name
+- name: count
+  type: int
+- name: price
+  type: price
+plugins: []
+`))
+	require.NoError(t, err)
+
+	values, err := c.bindInputs(url.Values{
+		"source": {"img/a.jpg"},
+		"price":  {"120.000"},
+		"other":  {"x"},
+	}, "https://media3/")
+	require.NoError(t, err)
+	require.Equal(t, "https://media3/img/a.jpg", values["source"])
+	require.Equal(t, "no name", values["name"])
+	require.EqualValues(t, 120000, values["price"])
+	require.NotContains(t, values, "count")
+	require.NotContains(t, values, "other")
+
+	_, err = c.bindInputs(url.Values{"price": {"1"}}, "")
+	require.EqualError(t, err, `input "source" is required`)
+
+	_, err = c.bindInputs(url.Values{"source": {"a"}, "count": {"x"}}, "")
+	require.EqualError(t, err, `input "count" must be an integer`)
+
+	for _, price := range []string{"1,200,000", "1 200 000", "1200000"} {
+		values, err = c.bindInputs(url.Values{"source": {"a"}, "price": {price}}, "")
+		require.NoError(t, err, price)
+		require.EqualValues(t, 1200000, values["price"], price)
+	}
+	for _, price := range []string{"99.5", "99,50", "1.20.000", "-5"} {
+		_, err = c.bindInputs(url.Values{"source": {"a"}, "price": {price}}, "")
+		require.EqualError(t, err, `input "price" must be a non-negative price`, price)
+	}
+
+	_, err = loadTemplate("hello", []byte(`
+allWidths: [128]
+inputs:
+- name: source
+  type: url
+`))
+	require.Error(t, err)
+}
+
+func TestTemplateListInput(t *testing.T) {
+	c, err := loadTemplate("hello", []byte(`
+allWidths: [128]
+inputs:
+- name: products
+  type: list
+  required: true
+  maxItems: 4
+  fields:
+  - name: image
+    type: image-url
+    required: true
+  - name: price
+    type: price
+plugins: []
+`))
+	require.NoError(t, err)
+
+	values, err := c.bindInputs(url.Values{
+		"products[3].image": {"c.jpg"},
+		"products[0].image": {"a.jpg"},
+		"products[0].price": {"10.000"},
+		"products[1].image": {"b.jpg"},
+	}, "https://media3/")
+	require.NoError(t, err)
+	require.Equal(t, []map[string]interface{}{
+		{"image": "https://media3/a.jpg", "price": int64(10000)},
+		{"image": "https://media3/b.jpg"},
+		{"image": "https://media3/c.jpg"},
+	}, values["products"])
+
+	_, err = c.bindInputs(url.Values{}, "")
+	require.EqualError(t, err, `input "products" is required`)
+
+	_, err = c.bindInputs(url.Values{"products[1].price": {"1"}}, "")
+	require.EqualError(t, err, `input "products[1].image" is required`)
+
+	_, err = c.bindInputs(url.Values{"products[4].image": {"a"}}, "")
+	require.EqualError(t, err, `input "products" has more than 4 items`)
+
+	_, err = loadTemplate("hello", []byte(`
+allWidths: [128]
+inputs:
+- name: products
+  type: list
+  fields:
+  - name: price
+    type: money
+`))
+	require.EqualError(t, err, `input "products.price" has invalid type money`)
+}
+
+func TestTemplateExtends(t *testing.T) {
+	static := fstest.MapFS{
+		"tmpls/base.yaml": &fstest.MapFile{
+			Data: []byte(`
+allWidths: [1200]
+plugins:
+- id: left
+  type: group
+  rect: 0,0,0.5,1
+- id: right
+  type: group
+  rect: 0.5,0,1,1
+- include: components/card.yaml
+`),
+		},
+		"tmpls/components/card.yaml": &fstest.MapFile{
+			Data: []byte(`
+plugins:
+- id: card
+  type: group
+  opacity: 0.5
+`),
+		},
+		"tmpls/small.yaml": &fstest.MapFile{
+			Data: []byte(`
+extends: base.yaml
+allWidths: [600]
+plugins:
+- id: left
+  opacity: 0.8
+- id: right
+  remove: true
+- type: group
+`),
+		},
+	}
+
+	tmpls, err := loadTemplates(log.Logger, static, "tmpls", nil)
+	require.NoError(t, err)
+	require.Len(t, tmpls, 2)
+
+	base := tmpls["base"]
+	require.Len(t, base._plugins, 3)
+	require.Equal(t, "card", base._plugins[2].(*plugins.GroupPlugin).Id)
+	require.Equal(t, 0.5, base._plugins[2].(*plugins.GroupPlugin).Opacity)
+
+	small := tmpls["small"]
+	require.Equal(t, []int{600}, small.AllWidths)
+	require.Len(t, small._plugins, 3)
+	left := small._plugins[0].(*plugins.GroupPlugin)
+	require.Equal(t, "left", left.Id)
+	require.Equal(t, plugins.FRectangle{Left: 0, Top: 0, Right: 0.5, Bottom: 1}, left.Rect)
+	require.Equal(t, 0.8, left.Opacity)
+	require.Equal(t, "card", small._plugins[1].(*plugins.GroupPlugin).Id)
+	require.Equal(t, "", small._plugins[2].(*plugins.GroupPlugin).Id)
+
+	static["tmpls/base.yaml"].Data = []byte("extends: small.yaml\n")
+	_, err = loadTemplates(log.Logger, static, "tmpls", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cycle tmpls/base.yaml -> tmpls/small.yaml -> tmpls/base.yaml")
+
+	delete(static, "tmpls/base.yaml")
+	_, err = loadTemplates(log.Logger, static, "tmpls", nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "tmpls/small.yaml: extends base.yaml")
+	require.Contains(t, err.Error(), "tmpls/base.yaml: file does not exist")
+}
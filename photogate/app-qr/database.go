@@ -7,17 +7,10 @@ import (
 	"time"
 
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
-	"gorm.io/driver/mysql"
-	"gorm.io/driver/sqlite"
+	"gitlab.sendo.vn/system/photogate/database"
 	"gorm.io/gorm"
 )
 
-func init() {
-	viper.SetDefault("qr.database.driver", "sqlite")
-	viper.SetDefault("qr.database.dsn", ":memory:")
-}
-
 var (
 	db *gorm.DB
 )
@@ -44,25 +37,7 @@ func initDatabase() {
 		return
 	}
 
-	driver := viper.GetString("qr.database.driver")
-	dsn := viper.GetString("qr.database.dsn")
-
-	var dial gorm.Dialector
-	if driver == "sqlite" {
-		dial = sqlite.Open(dsn)
-	} else if driver == "mysql" {
-		dial = mysql.Open(dsn)
-	} else {
-		log.Fatal().Msgf("not supported driver=%s", driver)
-	}
-
-	var err error
-	db, err = gorm.Open(dial, &gorm.Config{})
-	//Add config to debug ==> Logger: logger.Default.LogMode(logger.Info)
-	if err != nil {
-		log.Fatal().Err(err).Msg("init mysql")
-	}
-
+	db = database.DB()
 	db.AutoMigrate(&QrRecord{})
 }
 
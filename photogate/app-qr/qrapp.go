@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -17,6 +18,8 @@ import (
 	jwtmux "gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen/mux"
 	"gitlab.sendo.vn/system/photogate/logger"
 	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+	"gitlab.sendo.vn/system/photogate/utils"
 	"gorm.io/gorm"
 )
 
@@ -42,7 +45,12 @@ type qrService struct {
 	mr *mux.Router
 	ir *mux.Router
 
-	tmpls map[string]*template
+	// replaced as a whole by ReloadTemplates
+	tmpls   map[string]*template
+	tmplsMu sync.RWMutex
+	static  fs.FS
+	// one reload at a time, each builds on the templates of the last
+	reloadMu sync.Mutex
 
 	log zerolog.Logger
 }
@@ -112,15 +120,17 @@ func NewQrService(templateFs fs.FS) (*qrService, error) {
 
 	log := logger.NamedLogger("qr").Level(logger.GetLogLevel("qr.loglevel"))
 
-	tmpls, err := loadTemplates(log, templateFs, "qr-templates")
+	tmpls, err := loadTemplates(log, templateFs, "qr-templates", nil)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &qrService{
-		mr:    mr,
-		ir:    ir,
-		tmpls: tmpls,
+		mr:     mr,
+		ir:     ir,
+		tmpls:  tmpls,
+		static: templateFs,
+		log:    log,
 	}
 
 	mr.Methods("GET").Path("/{code}/{size}").HandlerFunc(s.handleQrGenImage)
@@ -293,6 +303,8 @@ func (qr *qrService) handleUpdateQr(res http.ResponseWriter, req *http.Request)
 }
 
 func (qr *qrService) _getTemplateOrDefault(t string) *template {
+	qr.tmplsMu.RLock()
+	defer qr.tmplsMu.RUnlock()
 	tm, ok := qr.tmpls[t]
 	if !ok {
 		tm = qr.tmpls["default"]
@@ -300,15 +312,33 @@ func (qr *qrService) _getTemplateOrDefault(t string) *template {
 	return tm
 }
 
-// generate QR by a template
-func (qr *qrService) generateQr(sh QrRecord, size int) ([]byte, error) {
-	tm := qr._getTemplateOrDefault(sh.Template)
+// load templates again after the template dir changed
+func (qr *qrService) ReloadTemplates() {
+	qr.reloadMu.Lock()
+	defer qr.reloadMu.Unlock()
+
+	qr.tmplsMu.RLock()
+	prev := qr.tmpls
+	qr.tmplsMu.RUnlock()
 
+	tmpls, err := loadTemplates(qr.log, qr.static, "qr-templates", prev)
+	if err != nil {
+		qr.log.Error().Err(err).Msg("reload templates")
+		return
+	}
+
+	qr.tmplsMu.Lock()
+	qr.tmpls = tmpls
+	qr.tmplsMu.Unlock()
+}
+
+// generate QR by a template
+func (qr *qrService) generateQr(tm *template, sh QrRecord, size int, format imghelper.Format) ([]byte, error) {
 	img, err := tm.Render(sh.Payload, size)
 	if err != nil {
 		return nil, err
 	}
-	return imghelper.Img2pngBuf(img), nil
+	return imghelper.Encode(img, format), nil
 }
 
 func (qr *qrService) handleQrGenImage(w http.ResponseWriter, r *http.Request) {
@@ -322,20 +352,18 @@ func (qr *qrService) handleQrGenImage(w http.ResponseWriter, r *http.Request) {
 		defer timerEmptyTemplate.ObserveDuration()
 		n, err := chunkDecode(code)
 		if err != nil {
-			w.WriteHeader(400)
-			w.Write(imghelper.Empty1x1_PNG)
+			respondEmptyImage(w, 400)
 			return
 		}
 
 		sh, err = getShortHandById(n)
 		if err != nil {
 			if err == gorm.ErrRecordNotFound {
-				w.WriteHeader(404)
+				respondEmptyImage(w, 404)
 			} else {
-				w.WriteHeader(500)
 				qr.log.Error().Err(err).Msg("get qr payload")
+				respondEmptyImage(w, 500)
 			}
-			w.Write(imghelper.Empty1x1_PNG)
 			return
 		}
 	}
@@ -349,11 +377,37 @@ func (qr *qrService) handleQrGenImage(w http.ResponseWriter, r *http.Request) {
 			Msg("generate qr image")
 		timer.ObserveDuration()
 	}()
-	if b, err := qr.generateQr(sh, size); err != nil {
-		w.WriteHeader(500)
-		w.Write(imghelper.Empty1x1_PNG)
+
+	tm := qr._getTemplateOrDefault(sh.Template)
+	w.Header().Add("Vary", "Accept")
+	format, err := imghelper.NegotiateFormat(r, tm._format)
+	if err != nil {
+		respondEmptyImage(w, 400)
+		return
+	}
+
+	if intsIndex(tm.AllWidths, size) < 0 {
+		size = tm.AllWidths[0]
+	}
+	etag := utils.ETag(rendercache.Key(sh.Template, tm._version, string(format), sh.Payload, strconv.Itoa(size)))
+	if utils.NotModified(r, etag, tm._mtime) {
+		utils.SetCacheHeaders(w, etag, tm._mtime, utils.MaxAge(tm.CacheMaxAge))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if b, err := qr.generateQr(tm, sh, size, format); err != nil {
+		respondEmptyImage(w, 500)
 	} else {
-		w.Header().Add("content-type", "image/png")
+		utils.SetCacheHeaders(w, etag, tm._mtime, utils.MaxAge(tm.CacheMaxAge))
+		w.Header().Add("content-type", format.ContentType())
 		w.Write(b)
 	}
 }
+
+// placeholder of a failed render, cached briefly by clients
+func respondEmptyImage(w http.ResponseWriter, code int) {
+	utils.SetErrorCacheHeaders(w)
+	w.Header().Add("content-type", "image/png")
+	w.WriteHeader(code)
+	w.Write(imghelper.Empty1x1_PNG)
+}
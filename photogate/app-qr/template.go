@@ -2,15 +2,18 @@ package appqr
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io/fs"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"gitlab.sendo.vn/system/photogate/plugins"
 	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
 	"gitlab.sendo.vn/system/photogate/utils"
 	"gopkg.in/yaml.v3"
 )
@@ -24,8 +27,20 @@ type template struct {
 	BackgroundColor string
 	_bgColor        color.Color
 
+	// jpeg, png or webp, when the request asks for no format
+	Format  string
+	_format imghelper.Format
+
+	// Cache-Control max-age of renders, httpCache.maxAge if unset
+	CacheMaxAge *time.Duration
+
 	Plugins  []map[string]interface{}
 	_plugins plugins.Plugins
+
+	// of the config, ETags of renders change with it
+	_version string
+	// of the template files, Last-Modified of renders if not zero
+	_mtime time.Time
 }
 
 func intsIndex(arr []int, x int) int {
@@ -38,6 +53,11 @@ func intsIndex(arr []int, x int) int {
 }
 
 func (tm *template) Render(s string, width int) (image.Image, error) {
+	img, _, err := tm.render(s, width, false)
+	return img, err
+}
+
+func (tm *template) render(s string, width int, debug bool) (image.Image, []plugins.Geometry, error) {
 	if intsIndex(tm.AllWidths, width) < 0 {
 		width = tm.AllWidths[0]
 	}
@@ -50,18 +70,23 @@ func (tm *template) Render(s string, width int) (image.Image, error) {
 	}
 	ps, err := tm._plugins.Bind(values)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	dc := imghelper.InitDrawingContext(width, height, tm._bgColor)
-	err = ps.Execute(dc)
+	var geometry []plugins.Geometry
+	if debug {
+		geometry, err = ps.ExecuteDebug(dc)
+	} else {
+		err = ps.Execute(dc)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	img := dc.Image()
 
-	return img, nil
+	return img, geometry, nil
 }
 
 func loadTemplate(name string, b []byte) (*template, error) {
@@ -71,7 +96,11 @@ func loadTemplate(name string, b []byte) (*template, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newTemplate(name, m)
+}
 
+// template from yaml config with extends and include resolved
+func newTemplate(name string, m map[string]interface{}) (*template, error) {
 	c := &template{}
 	dec, err := plugins.NewStructDecoder(c)
 	if err != nil {
@@ -81,6 +110,13 @@ func loadTemplate(name string, b []byte) (*template, error) {
 		return nil, err
 	}
 
+	assets, mtime := utils.AssetsVersion(m)
+	c._version, err = rendercache.Version(m, assets)
+	if err != nil {
+		return nil, err
+	}
+	c._mtime = mtime
+
 	if len(c.AllWidths) < 1 {
 		return nil, errors.New("allWidths is required")
 	}
@@ -93,6 +129,14 @@ func loadTemplate(name string, b []byte) (*template, error) {
 		c._bgColor = imghelper.ParseColor(c.BackgroundColor)
 	}
 
+	c._format, err = imghelper.ParseFormat(c.Format)
+	if err != nil {
+		return nil, err
+	}
+	if c._format == "" {
+		c._format = imghelper.FORMAT_PNG
+	}
+
 	c._plugins, err = plugins.NewPluginsFromConfig(c.Plugins)
 	if err != nil {
 		return nil, err
@@ -108,15 +152,28 @@ func loadTemplate(name string, b []byte) (*template, error) {
 
 var genericTemplateRx = regexp.MustCompile(`\.yaml$`)
 
-func loadTemplates(log zerolog.Logger, static fs.FS, root string) (map[string]*template, error) {
+// load templates of root. when reloading, prev holds the templates in use
+// and a template which fails to load keeps serving its previous version
+func loadTemplates(log zerolog.Logger, static fs.FS, root string, prev map[string]*template) (map[string]*template, error) {
 	tmpls := map[string]*template{}
 	err := utils.ScanFileMatch(static, root, genericTemplateRx, func(fname, path string, b []byte) error {
 		name := strings.TrimSuffix(fname, ".yaml")
 
 		log.Info().Msgf(`load QR template "%s"`, path)
-		t, err := loadTemplate(name, b)
+		t, err := loadTemplateFile(static, name, path, b)
 		if err != nil {
-			return err
+			if prev == nil {
+				return err
+			}
+			utils.TemplateReloads.WithLabelValues("qr", "error").Inc()
+			log.Error().Err(err).Msgf(`reload QR template "%s", keep previous version`, path)
+			if old, ok := prev[name]; ok {
+				tmpls[name] = old
+			}
+			return nil
+		}
+		if prev != nil {
+			utils.TemplateReloads.WithLabelValues("qr", "ok").Inc()
 		}
 
 		tmpls[name] = t
@@ -129,3 +186,50 @@ func loadTemplates(log zerolog.Logger, static fs.FS, root string) (map[string]*t
 
 	return tmpls, nil
 }
+
+func loadTemplateFile(static fs.FS, name, path string, b []byte) (*template, error) {
+	m, mtime, err := utils.ParseTemplateConfigMtime(static, path, b)
+	if err != nil {
+		return nil, err
+	}
+	t, err := newTemplate(name, m)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if mtime.After(t._mtime) {
+		t._mtime = mtime
+	}
+	return t, nil
+}
+
+// ValidateTemplate loads the content of a QR template named name,
+// templates it extends are read from static
+func ValidateTemplate(static fs.FS, name string, b []byte) error {
+	_, err := loadTemplateFile(static, name, "qr-templates/"+name+".yaml", b)
+	return err
+}
+
+// PreviewTemplate renders the content of a QR template named name with
+// payload, templates it extends are read from static. a debug render
+// outlines the plugins and returns where each was drawn
+func PreviewTemplate(static fs.FS, name string, b []byte, payload string, width int, debug bool) (image.Image, []plugins.Geometry, error) {
+	t, err := loadTemplateFile(static, name, "qr-templates/"+name+".yaml", b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.render(payload, width, debug)
+}
+
+// RenderFile renders the QR template named name of static with payload
+func RenderFile(static fs.FS, name string, payload string, width int) (image.Image, error) {
+	path := "qr-templates/" + name + ".yaml"
+	b, err := fs.ReadFile(static, path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadTemplateFile(static, name, path, b)
+	if err != nil {
+		return nil, err
+	}
+	return t.Render(payload, width)
+}
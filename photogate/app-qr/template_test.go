@@ -51,7 +51,7 @@ plugins:
 	err = fstest.TestFS(tDir, "hello")
 	require.Error(t, err)
 
-	tmpls, err := loadTemplates(log.Logger, tDir, ".")
+	tmpls, err := loadTemplates(log.Logger, tDir, ".", nil)
 	require.NoError(t, err)
 	require.Len(t, tmpls, 1)
 	require.NotNil(t, tmpls["something"])
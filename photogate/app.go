@@ -6,7 +6,10 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
@@ -17,7 +20,10 @@ import (
 	appfb "gitlab.sendo.vn/system/photogate/app-fb"
 	appgeneric "gitlab.sendo.vn/system/photogate/app-generic"
 	appqr "gitlab.sendo.vn/system/photogate/app-qr"
+	"gitlab.sendo.vn/system/photogate/database"
 	"gitlab.sendo.vn/system/photogate/downloader"
+	"gitlab.sendo.vn/system/photogate/jobs"
+	"gitlab.sendo.vn/system/photogate/templatestore"
 	"gitlab.sendo.vn/system/photogate/utils"
 )
 
@@ -33,6 +39,36 @@ type handlerService interface {
 	InternalHandler() http.Handler
 }
 
+// service whose templates are reloaded when the template dir changes
+type reloadableService interface {
+	ReloadTemplates()
+}
+
+func init() {
+	// dir layered over the embedded static dir, same layout.
+	// its templates are reloaded on change, empty to disable
+	viper.SetDefault("templates.dir", "")
+	viper.SetDefault("templates.reloadDelay", time.Second)
+	// templates saved in the database are layered over both dirs.
+	// how often to check for templates activated by other instances
+	viper.SetDefault("templates.store.pollInterval", 10*time.Second)
+
+	// results of render jobs, should be shared by instances
+	viper.SetDefault("jobs.dir", filepath.Join(os.TempDir(), "photogate-jobs"))
+	// jobs run at once by an instance, 0 to run none
+	viper.SetDefault("jobs.workers", 1)
+	// how often to look for jobs submitted to other instances
+	viper.SetDefault("jobs.pollInterval", 5*time.Second)
+	// how long finished jobs and their results are kept, 0 to keep them
+	viper.SetDefault("jobs.retention", 24*time.Hour)
+	// url of the service in the result urls posted to job callbacks
+	viper.SetDefault("jobs.baseUrl", "")
+	// attempts to post to a job callback, the wait after a failed attempt
+	// starts at backoff and doubles
+	viper.SetDefault("jobs.callback.attempts", 6)
+	viper.SetDefault("jobs.callback.backoff", 10*time.Second)
+}
+
 func init() {
 	var err error
 	staticFs, err = fs.Sub(__embedFs, "static")
@@ -85,35 +121,98 @@ func NewApp() (*App, error) {
 
 	media3 := viper.GetString("media3.url")
 
+	app := &App{
+		r:      r,
+		chStop: make(chan struct{}),
+	}
+
+	templateFs := staticFs
+	templateDir := viper.GetString("templates.dir")
+	if templateDir != "" {
+		if _, err := os.Stat(templateDir); err != nil {
+			return nil, errors.Wrap(err, "templates.dir")
+		}
+		templateFs = utils.NewOverlayFS(os.DirFS(templateDir), staticFs)
+	}
+
+	store, err := templatestore.New(database.DB())
+	if err != nil {
+		return nil, errors.Wrap(err, "template store")
+	}
+	templateFs = utils.NewOverlayFS(store.FS(), templateFs)
+	utils.Init(templateFs)
+
+	store.SetValidator("generic", func(name string, b []byte) error {
+		return appgeneric.ValidateTemplate(templateFs, name, b)
+	})
+	store.SetValidator("qr", func(name string, b []byte) error {
+		return appqr.ValidateTemplate(templateFs, name, b)
+	})
+	store.SetValidator("fb", func(name string, b []byte) error {
+		return appfb.ValidateTemplate(b)
+	})
+	registerService(r, "/templates", templatestore.NewService(store))
+
+	var reloadables []reloadableService
+
 	{
-		qrSvc, err := appqr.NewQrService(staticFs)
+		qrSvc, err := appqr.NewQrService(templateFs)
 		if err != nil {
 			return nil, errors.Wrap(err, "qr-service")
 		}
 
 		registerService(r, "/qr", qrSvc)
+		reloadables = append(reloadables, qrSvc)
 	}
 
+	jobStore, err := jobs.New(database.DB(), viper.GetString("jobs.dir"))
+	if err != nil {
+		return nil, errors.Wrap(err, "job store")
+	}
+	jobStore.SetCallback(viper.GetString("jobs.baseUrl"),
+		viper.GetInt("jobs.callback.attempts"), viper.GetDuration("jobs.callback.backoff"))
+	registerService(r, "/jobs", jobs.NewService(jobStore))
+
 	{
-		qrSvc, err := appgeneric.NewGenericService(media3, staticFs)
+		qrSvc, err := appgeneric.NewGenericService(media3, templateFs)
 		if err != nil {
 			return nil, errors.Wrap(err, "generic-service")
 		}
 
 		registerService(r, "/template/", qrSvc)
+		reloadables = append(reloadables, qrSvc)
+		jobStore.SetRunner("generic", qrSvc.BatchRunner())
 	}
 
 	{
-		fbApp, err := appfb.NewFbImageService(media3, staticFs)
+		fbApp, err := appfb.NewFbImageService(media3, templateFs, store)
 		if err != nil {
 			return nil, errors.Wrap(err, "fb-service")
 		}
 		registerService(r, "/fb", fbApp)
+		fbApp.Start(app.chStop)
+		reloadables = append(reloadables, fbApp)
 	}
 
-	app := &App{
-		r:      r,
-		chStop: make(chan struct{}),
+	reloadAll := func() {
+		for _, s := range reloadables {
+			s.ReloadTemplates()
+		}
+	}
+	store.OnChange(reloadAll)
+	if interval := viper.GetDuration("templates.store.pollInterval"); interval > 0 {
+		store.Poll(interval, app.chStop)
+	}
+
+	jobStore.Start(viper.GetInt("jobs.workers"), viper.GetDuration("jobs.pollInterval"),
+		viper.GetDuration("jobs.retention"), app.chStop)
+
+	if templateDir != "" {
+		log.Info().Msgf(`watch template dir "%s"`, templateDir)
+		err := utils.WatchDir(templateDir, viper.GetDuration("templates.reloadDelay"), reloadAll, app.chStop)
+		if err != nil {
+			return nil, errors.Wrap(err, "watch templates.dir")
+		}
 	}
 
 	return app, nil
@@ -134,6 +233,7 @@ func (app *App) Start(ctx context.Context, addr string) error {
 	go srv.Serve(lis)
 
 	<-ctx.Done()
+	close(app.chStop)
 	srv.Shutdown(context.Background())
 
 	return nil
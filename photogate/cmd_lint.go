@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gitlab.sendo.vn/system/photogate/downloader"
+	"gitlab.sendo.vn/system/photogate/lint"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+// photogate lint [dir]
+//
+// lint the templates of dir, default static, without starting the server.
+// files they use are read from dir then the embedded static dir. prints
+// file:line diagnostics, exit code is 1 if there are any
+func runLint(args []string) int {
+	dir := "static"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	templates := os.DirFS(dir)
+	static := utils.NewOverlayFS(templates, staticFs)
+	utils.Init(static)
+	downloader.Init()
+
+	diags, err := lint.Run(templates, static)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, d := range diags {
+		d.File = filepath.Join(dir, d.File)
+		fmt.Println(d)
+	}
+	if len(diags) > 0 {
+		return 1
+	}
+	return 0
+}
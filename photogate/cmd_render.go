@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	appfb "gitlab.sendo.vn/system/photogate/app-fb"
+	appgeneric "gitlab.sendo.vn/system/photogate/app-generic"
+	appqr "gitlab.sendo.vn/system/photogate/app-qr"
+	"gitlab.sendo.vn/system/photogate/downloader"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+// renders a template outside of the server, with the same code
+type renderer struct {
+	service  string
+	template string
+	static   fs.FS
+	media3   string
+	width    int
+	// jpg, png or webp
+	format string
+}
+
+// photogate render --template name [--service generic|qr|fb] [--set key=value]... -o out.jpg
+// photogate render --template name --csv rows.csv -o dir
+//
+// render a template with the values of --set, like the query parameters of
+// a request. values which are paths of local files, like ./a.jpg, are read
+// from disk. qr templates render the qr_payload value, fb templates the
+// source image with price and promotion_price.
+//
+// with --csv, the header row names the values and each row is rendered into
+// dir, to the file of its output column, which must be in dir, or
+// <template>-<row>.<format>.
+// the extension of an output file sets its format.
+// --set values are the defaults of every row, local paths are relative to
+// the csv file. exit code is 1 if a render failed
+func runRender(args []string) int {
+	flags := pflag.NewFlagSet("render", pflag.ContinueOnError)
+	var (
+		r      renderer
+		sets   []string
+		output string
+		csvIn  string
+		dir    string
+	)
+	flags.StringVar(&r.service, "service", "generic", "generic, qr or fb")
+	flags.StringVar(&r.template, "template", "", "name of the template")
+	flags.StringArrayVar(&sets, "set", nil, "key=value of the template, repeatable")
+	flags.IntVar(&r.width, "width", 0, "width of generic and qr renders, default the first of allWidths")
+	flags.StringVarP(&output, "output", "o", "", "output file, or dir of a csv render")
+	flags.StringVar(&csvIn, "csv", "", "csv file of the values to render, one image per row")
+	flags.StringVar(&r.format, "format", "", "jpg, png or webp, default from the output file, jpg for csv")
+	flags.StringVar(&dir, "dir", viper.GetString("templates.dir"), "dir layered over the embedded static dir")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if r.template == "" || output == "" {
+		fmt.Fprintln(os.Stderr, "--template and -o are required")
+		return 2
+	}
+	switch r.service {
+	case "generic", "qr", "fb":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid service %s\n", r.service)
+		return 2
+	}
+	if csvIn == "" {
+		r.format = outputFormat(output, r.format)
+	}
+	if r.format == "" || r.format == "jpeg" {
+		r.format = "jpg"
+	}
+	if r.format != "jpg" && r.format != "png" && r.format != "webp" {
+		fmt.Fprintf(os.Stderr, "invalid format %s\n", r.format)
+		return 2
+	}
+
+	defaults := url.Values{}
+	for _, s := range sets {
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			fmt.Fprintf(os.Stderr, "--set %s: not key=value\n", s)
+			return 2
+		}
+		defaults.Set(s[:i], localValue(s[i+1:], "."))
+	}
+
+	r.static = staticFs
+	if dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		r.static = utils.NewOverlayFS(os.DirFS(dir), staticFs)
+	}
+	r.media3 = viper.GetString("media3.url")
+	utils.Init(r.static)
+	utils.AllowFileScheme()
+	downloader.Init()
+
+	if csvIn != "" {
+		return r.renderCSV(csvIn, defaults, output)
+	}
+
+	b, err := r.render(defaults)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = os.WriteFile(output, b, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// file uri of a value which is the path of a local file relative to base,
+// like ./a.jpg, or an absolute path of an existing file. other absolute
+// paths are media3 paths, like /product/a.jpg
+func localValue(v, base string) string {
+	p := v
+	switch {
+	case strings.HasPrefix(v, "./"), strings.HasPrefix(v, "../"):
+		p = filepath.Join(base, p)
+	case filepath.IsAbs(v):
+		if st, err := os.Stat(p); err != nil || !st.Mode().IsRegular() {
+			return v
+		}
+	default:
+		return v
+	}
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return v
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(p)}).String()
+}
+
+// format of an output file by its extension, def if unknown
+func outputFormat(name, def string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".png":
+		return "png"
+	case ".webp":
+		return "webp"
+	case ".jpg", ".jpeg":
+		return "jpg"
+	}
+	return def
+}
+
+// encoded image of the template rendered with values
+func (r *renderer) render(values url.Values) ([]byte, error) {
+	var (
+		img image.Image
+		err error
+	)
+	switch r.service {
+	case "qr":
+		img, err = appqr.RenderFile(r.static, r.template, values.Get("qr_payload"), r.width)
+	case "fb":
+		img, err = r.renderFb(values)
+	default:
+		img, err = appgeneric.RenderFile(r.static, r.media3, r.template, values, r.width)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := imghelper.ParseFormat(r.format)
+	if err != nil {
+		return nil, err
+	}
+	return imghelper.Encode(img, format), nil
+}
+
+// the source image is read like the service downloads it from media3,
+// unless it is a local file or an url
+func (r *renderer) renderFb(values url.Values) (image.Image, error) {
+	source := values.Get("source")
+	if source == "" {
+		return nil, fmt.Errorf("source is required")
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file", "http", "https":
+	default:
+		source = strings.TrimSuffix(r.media3, "/") + "/" + strings.TrimPrefix(source, "/")
+	}
+
+	src, err := imghelper.LoadImage(source)
+	if err != nil {
+		return nil, fmt.Errorf("source: %w", err)
+	}
+	return appfb.RenderFile(r.static, r.template, src, values)
+}
+
+// path of the output file name of a csv row, which must be in dir
+func outputPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("output %s: must be relative to the output dir", name)
+	}
+	out := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, out)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output %s: not a file in the output dir", name)
+	}
+	return out, nil
+}
+
+// render each row of the csv file into dir, see runRender
+func (r *renderer) renderCSV(path string, defaults url.Values, dir string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+
+	rd := csv.NewReader(f)
+	header, err := rd.Read()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: header: %s\n", path, err)
+		return 2
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	base := filepath.Dir(path)
+	failed := false
+	for row := 1; ; row++ {
+		record, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a parse error has the line
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			return 1
+		}
+		line, _ := rd.FieldPos(0)
+
+		values := url.Values{}
+		for k, v := range defaults {
+			values[k] = v
+		}
+		name := fmt.Sprintf("%s-%d.%s", r.template, row, r.format)
+		for i, k := range header {
+			v := strings.TrimSpace(record[i])
+			if k == "output" {
+				if v != "" {
+					name = v
+				}
+				continue
+			}
+			if v != "" {
+				values.Set(k, localValue(v, base))
+			}
+		}
+
+		out, err := outputPath(dir, name)
+		if err == nil {
+			rr := *r
+			rr.format = outputFormat(name, r.format)
+			var b []byte
+			b, err = rr.render(values)
+			if err == nil {
+				err = os.WriteFile(out, b, 0644)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, line, err)
+			failed = true
+			continue
+		}
+		fmt.Println(out)
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
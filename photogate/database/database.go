@@ -0,0 +1,64 @@
+package database
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func init() {
+	viper.SetDefault("database.driver", "sqlite")
+	viper.SetDefault("database.dsn", ":memory:")
+}
+
+var (
+	db     *gorm.DB
+	dbOnce sync.Once
+)
+
+// DB returns the database shared by services, opened on first use
+func DB() *gorm.DB {
+	dbOnce.Do(open)
+	return db
+}
+
+func open() {
+	driver := viper.GetString("database.driver")
+	dsn := viper.GetString("database.dsn")
+	// config written before the database was shared by services
+	if viper.IsSet("qr.database.driver") {
+		driver = viper.GetString("qr.database.driver")
+		dsn = viper.GetString("qr.database.dsn")
+	}
+
+	var dial gorm.Dialector
+	if driver == "sqlite" {
+		dial = sqlite.Open(dsn)
+	} else if driver == "mysql" {
+		dial = mysql.Open(dsn)
+	} else {
+		log.Fatal().Msgf("not supported driver=%s", driver)
+	}
+
+	var err error
+	db, err = gorm.Open(dial, &gorm.Config{})
+	//Add config to debug ==> Logger: logger.Default.LogMode(logger.Info)
+	if err != nil {
+		log.Fatal().Err(err).Msg("init database")
+	}
+
+	// each connection to an in-memory sqlite has its own empty database,
+	// the services must share one
+	if driver == "sqlite" && (dsn == ":memory:" || strings.Contains(dsn, "mode=memory")) {
+		sqlDB, err := db.DB()
+		if err != nil {
+			log.Fatal().Err(err).Msg("init database")
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+)
+
+// downloads by tag and result: hit, revalidated by a conditional get,
+// coalesced with a download in flight, or miss
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "photogate_download_cache_total",
+	Help: "Downloads served by the download cache",
+}, []string{TagName, "result"})
+
+func init() {
+	// downloaded files kept in memory, 0 to disable
+	viper.SetDefault("downloader.cache.memoryBytes", 128<<20)
+	// files are also kept on disk in dir, empty to disable
+	viper.SetDefault("downloader.cache.dir", "")
+	viper.SetDefault("downloader.cache.diskBytes", 1<<30)
+	// how long a file is used without revalidation when its response
+	// has neither Cache-Control max-age nor Expires
+	viper.SetDefault("downloader.cache.defaultMaxAge", 5*time.Minute)
+}
+
+// downloads are one group of the cache, its files are kept in a sub dir
+// which is indexed again after a restart
+const cacheGroup = "downloads"
+
+func newCacheFromConfig() (*rendercache.Cache, error) {
+	return rendercache.New("downloader",
+		viper.GetInt64("downloader.cache.memoryBytes"),
+		viper.GetString("downloader.cache.dir"),
+		viper.GetInt64("downloader.cache.diskBytes"))
+}
+
+// validators and freshness of a cached file
+type cacheMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// ms, the file is used without revalidation until then
+	Expires int64 `json:"expires"`
+}
+
+// a cached file is its meta as a json line followed by the body
+func encodeCached(meta cacheMeta, body []byte) []byte {
+	b, _ := json.Marshal(meta)
+	b = append(b, '\n')
+	return append(b, body...)
+}
+
+func decodeCached(b []byte) (cacheMeta, []byte, bool) {
+	var meta cacheMeta
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 || json.Unmarshal(b[:i], &meta) != nil {
+		return meta, nil, false
+	}
+	return meta, b[i+1:], true
+}
+
+// until when a response with header h is fresh, ms. false if it must
+// not be cached
+func freshUntil(h http.Header, now time.Time) (int64, bool) {
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "no-store" || d == "private":
+			return 0, false
+		case d == "no-cache":
+			return now.UnixNano() / 1e6, true
+		case strings.HasPrefix(d, "max-age="):
+			if n, err := strconv.Atoi(d[len("max-age="):]); err == nil {
+				return now.Add(time.Duration(n)*time.Second).UnixNano() / 1e6, true
+			}
+		}
+	}
+	if e := h.Get("Expires"); e != "" {
+		t, err := http.ParseTime(e)
+		if err != nil {
+			// invalid dates mean already expired
+			return now.UnixNano() / 1e6, true
+		}
+		return t.UnixNano() / 1e6, true
+	}
+	return now.Add(viper.GetDuration("downloader.cache.defaultMaxAge")).UnixNano() / 1e6, true
+}
+
+// cache the body of a response with header h, validators of prev are
+// kept if h has none, as in a 304
+func (ds *downloadService) store(key string, h http.Header, prev cacheMeta, body []byte) {
+	expires, ok := freshUntil(h, time.Now())
+	if !ok {
+		return
+	}
+	meta := cacheMeta{ETag: h.Get("ETag"), LastModified: h.Get("Last-Modified"), Expires: expires}
+	if meta.ETag == "" {
+		meta.ETag = prev.ETag
+	}
+	if meta.LastModified == "" {
+		meta.LastModified = prev.LastModified
+	}
+	ds.cache.Replace(cacheGroup, key, encodeCached(meta, body))
+}
@@ -0,0 +1,129 @@
+package downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+)
+
+func TestDownloadCache(t *testing.T) {
+	var requests, conditional, version int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&conditional, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/expired":
+			w.Header().Set("Expires", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+		case "/revalidated":
+			// stale at first, fresh for a minute once revalidated
+			w.Header().Set("ETag", `"r1"`)
+			if r.Header.Get("If-None-Match") == `"r1"` {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0")
+		case "/changed":
+			v := strconv.Itoa(int(atomic.LoadInt32(&version)))
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", v)
+			if r.Header.Get("If-None-Match") == v {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("version " + v))
+			return
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("body of " + r.URL.Path))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	dl := newDownloadService(2)
+	var err error
+	dl.cache, err = rendercache.New("test", 1<<20, dir, 1<<20)
+	require.NoError(t, err)
+
+	lookups := func(result string) float64 {
+		return testutil.ToFloat64(cacheLookups.WithLabelValues("test", result))
+	}
+	get := func(path string) string {
+		b, err := dl.Download(upstream.URL+path, "test")
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	cases := []struct {
+		path        string
+		requests    int32
+		conditional int32
+	}{
+		// fresh for a minute
+		{"/fresh", 1, 0},
+		// revalidated each time
+		{"/etag", 3, 2},
+		// stale without validators
+		{"/expired", 3, 0},
+		{"/no-store", 3, 0},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&conditional, 0)
+		for i := 0; i < 3; i++ {
+			require.Equal(t, "body of "+c.path, get(c.path))
+		}
+		require.Equal(t, c.requests, atomic.LoadInt32(&requests), c.path)
+		require.Equal(t, c.conditional, atomic.LoadInt32(&conditional), c.path)
+	}
+
+	// revalidation and new bodies replace the file on disk
+	require.Equal(t, "body of /revalidated", get("/revalidated"))
+	require.Equal(t, "body of /revalidated", get("/revalidated"))
+	require.Equal(t, "version 0", get("/changed"))
+	atomic.StoreInt32(&version, 1)
+	require.Equal(t, "version 1", get("/changed"))
+
+	// fresh on disk after a restart
+	dl.cache, err = rendercache.New("test", 1<<20, dir, 1<<20)
+	require.NoError(t, err)
+	atomic.StoreInt32(&requests, 0)
+	require.Equal(t, "body of /fresh", get("/fresh"))
+	require.Equal(t, "body of /revalidated", get("/revalidated"))
+	require.EqualValues(t, 0, atomic.LoadInt32(&requests))
+	b, ok := dl.cache.Get(rendercache.Key(upstream.URL+"/changed", ""))
+	require.True(t, ok)
+	_, body, ok := decodeCached(b)
+	require.True(t, ok)
+	require.Equal(t, "version 1", string(body))
+
+	// errors are not cached, but counted as misses
+	atomic.StoreInt32(&requests, 0)
+	misses := lookups("miss")
+	for i := 0; i < 2; i++ {
+		_, err = dl.Download(upstream.URL+"/missing", "test")
+		require.Error(t, err)
+	}
+	require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+	require.Equal(t, misses+2, lookups("miss"))
+}
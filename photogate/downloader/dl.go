@@ -2,11 +2,11 @@
 package downloader
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"runtime"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,6 +15,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"gitlab.sendo.vn/system/photogate/logger"
+	"gitlab.sendo.vn/system/photogate/rendercache"
 )
 
 var (
@@ -41,7 +42,13 @@ func Init() {
 	if dlsvc != nil {
 		log.Fatal().Msg("downloader already init")
 	}
-	dlsvc = newDownloadService(viper.GetInt("downloader.concurrent"))
+	dlsvc = newDownloadService(Concurrency())
+
+	var err error
+	dlsvc.cache, err = newCacheFromConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("downloader cache")
+	}
 }
 
 type DownloadError struct {
@@ -56,18 +63,18 @@ func (e *DownloadError) Error() string {
 type downloadService struct {
 	client http.Client
 
-	cond *sync.Cond
-
-	dlCurrent int
-	dlMax     int
+	limit *Limiter
+	// nil to download every time
+	cache *rendercache.Cache
+	// downloads in flight by uri
+	flight flightGroup
 
 	log zerolog.Logger
 }
 
 func newDownloadService(max int) *downloadService {
 	return &downloadService{
-		cond:  sync.NewCond(&sync.Mutex{}),
-		dlMax: max,
+		limit: NewLimiter(max),
 		client: http.Client{
 			Timeout: time.Second * 10,
 		},
@@ -75,22 +82,59 @@ func newDownloadService(max int) *downloadService {
 	}
 }
 
+// Download the body of uri. it is cached as the upstream allows, stale
+// files are revalidated with a conditional get. the body must not be changed
 func (ds *downloadService) Download(uri string, tag string) ([]byte, error) {
-	start := time.Now()
+	return ds.DownloadContext(context.Background(), uri, tag)
+}
 
-	ds.cond.L.Lock()
-	for ds.dlCurrent >= ds.dlMax {
-		ds.cond.Wait()
+// DownloadContext is Download returning when ctx is done. concurrent
+// downloads of uri share one fetch, which goes on for the others
+func (ds *downloadService) DownloadContext(ctx context.Context, uri string, tag string) ([]byte, error) {
+	var (
+		key    string
+		cached []byte
+		meta   cacheMeta
+	)
+	if ds.cache != nil {
+		key = rendercache.Key(uri, "")
+		if b, ok := ds.cache.Get(key); ok {
+			meta, cached, ok = decodeCached(b)
+			if ok && meta.Expires > time.Now().UnixNano()/1e6 {
+				cacheLookups.WithLabelValues(tag, "hit").Inc()
+				return cached, nil
+			}
+			if !ok {
+				cached = nil
+			}
+		}
 	}
-	ds.dlCurrent++
-	ds.cond.L.Unlock()
 
-	defer func() {
-		ds.cond.L.Lock()
-		ds.dlCurrent--
-		ds.cond.L.Unlock()
-		ds.cond.Signal()
-	}()
+	b, err, shared := ds.flight.do(ctx, uri, func() ([]byte, error) {
+		return ds.fetch(uri, tag, key, meta, cached)
+	})
+	if shared {
+		coalescedDownloads.WithLabelValues(tag).Inc()
+		if ds.cache != nil {
+			cacheLookups.WithLabelValues(tag, "coalesced").Inc()
+		}
+	}
+	return b, err
+}
+
+// fetch uri with a slot of the limiter, cached is revalidated if not nil.
+// counted as a miss of the cache unless revalidated, errors too
+func (ds *downloadService) fetch(uri, tag, key string, meta cacheMeta, cached []byte) ([]byte, error) {
+	start := time.Now()
+	result := "miss"
+	if ds.cache != nil {
+		defer func() {
+			cacheLookups.WithLabelValues(tag, result).Inc()
+		}()
+	}
+
+	ds.limit.Acquire(context.Background())
+	defer ds.limit.Release()
 
 	waitTime := time.Since(start)
 	if waitTime < time.Millisecond {
@@ -115,12 +159,32 @@ func (ds *downloadService) Download(uri string, tag string) ([]byte, error) {
 		}
 	}()
 
-	resp, err := ds.client.Get(uri)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := ds.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	code = resp.StatusCode
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		result = "revalidated"
+		ds.store(key, resp.Header, meta, cached)
+		return cached, nil
+	}
+
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(resp.Body)
 
@@ -133,11 +197,20 @@ func (ds *downloadService) Download(uri string, tag string) ([]byte, error) {
 		return nil, err
 	}
 
+	if ds.cache != nil && resp.StatusCode == http.StatusOK {
+		ds.store(key, resp.Header, cacheMeta{}, b)
+	}
 	return b, nil
 }
 
 func Download(uri string, tag string) (b []byte, err error) {
+	return DownloadContext(context.Background(), uri, tag)
+}
+
+// DownloadContext is Download which returns when ctx is done, without
+// canceling the download for other callers of uri
+func DownloadContext(ctx context.Context, uri string, tag string) (b []byte, err error) {
 	timer := prometheus.NewTimer(imageDownloadDuration.With(prometheus.Labels{"tag": tag}))
 	defer timer.ObserveDuration()
-	return dlsvc.Download(uri, tag)
+	return dlsvc.DownloadContext(ctx, uri, tag)
 }
@@ -0,0 +1,63 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// downloads by tag which joined one in flight instead of fetching again
+var coalescedDownloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "photogate_download_coalesced_total",
+	Help: "Downloads which shared the result of a download in flight",
+}, []string{TagName})
+
+type flightCall struct {
+	done chan struct{}
+	b    []byte
+	err  error
+	// callers which joined the call
+	dups int
+}
+
+// flightGroup runs one call at a time by key, concurrent callers of the
+// key share its result
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do runs fn unless a call of key is in flight, and returns its result.
+// fn runs in its own goroutine so that a caller whose ctx is done returns
+// without canceling the call of the others. shared is true if the caller
+// joined a call in flight
+func (g *flightGroup) do(ctx context.Context, key string, fn func() ([]byte, error)) (b []byte, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	c, shared := g.calls[key]
+	if shared {
+		c.dups++
+	} else {
+		c = &flightCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.b, c.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.b, c.err, shared
+	case <-ctx.Done():
+		return nil, ctx.Err(), shared
+	}
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/rendercache"
+)
+
+func TestCoalescedDownloads(t *testing.T) {
+	var requests int32
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(arrived)
+		}
+		<-release
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("body"))
+	}))
+	defer upstream.Close()
+
+	dl := newDownloadService(2)
+	var err error
+	dl.cache, err = rendercache.New("test", 1<<20, "", 0)
+	require.NoError(t, err)
+	uri := upstream.URL + "/a"
+	lookups := func(result string) float64 {
+		return testutil.ToFloat64(cacheLookups.WithLabelValues("coalesced-test", result))
+	}
+
+	// the first caller gives up, the download goes on for the others
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := dl.DownloadContext(ctx, uri, "coalesced-test")
+		first <- err
+	}()
+	<-arrived
+
+	const n = 10
+	var wg sync.WaitGroup
+	wg.Add(n)
+	results := make([]string, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			b, err := dl.Download(uri, "coalesced-test")
+			if err == nil {
+				results[i] = string(b)
+			}
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		dl.flight.mu.Lock()
+		defer dl.flight.mu.Unlock()
+		c := dl.flight.calls[uri]
+		return c != nil && c.dups == n
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	require.ErrorIs(t, <-first, context.Canceled)
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	for _, r := range results {
+		require.Equal(t, "body", r)
+	}
+	// each caller is counted once
+	require.EqualValues(t, 1, lookups("miss"))
+	require.EqualValues(t, n, lookups("coalesced"))
+	require.EqualValues(t, n, testutil.ToFloat64(coalescedDownloads.WithLabelValues("coalesced-test")))
+
+	// a later download fetches again
+	b, err := dl.Download(uri, "test")
+	require.NoError(t, err)
+	require.Equal(t, "body", string(b))
+	require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+}
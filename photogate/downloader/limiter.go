@@ -0,0 +1,44 @@
+package downloader
+
+import (
+	"context"
+
+	"github.com/spf13/viper"
+)
+
+// Limiter bounds how many callers run at once
+type Limiter struct {
+	sem chan struct{}
+}
+
+func NewLimiter(max int) *Limiter {
+	if max < 1 {
+		max = 1
+	}
+	return &Limiter{sem: make(chan struct{}, max)}
+}
+
+// Acquire waits for a free slot, or until ctx is done
+func (l *Limiter) Acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot of a successful Acquire
+func (l *Limiter) Release() {
+	<-l.sem
+}
+
+// Max is how many callers run at once
+func (l *Limiter) Max() int {
+	return cap(l.sem)
+}
+
+// Concurrency is how many downloads run at once
+func Concurrency() int {
+	return viper.GetInt("downloader.concurrent")
+}
@@ -0,0 +1,260 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+const (
+	CallbackPending   = "pending"
+	CallbackDelivered = "delivered"
+	CallbackFailed    = "failed"
+)
+
+const (
+	// longest wait between attempts
+	maxCallbackBackoff = 30 * time.Minute
+	callbackTimeout    = 10 * time.Second
+)
+
+// an attempt to post the summary of a finished job to its callback
+type Delivery struct {
+	ID      uint64 `gorm:"primarykey" json:"-"`
+	JobID   string `gorm:"size:32;index" json:"job_id"`
+	Attempt int    `json:"attempt"`
+	// status of the response, 0 if there was none
+	Code  int    `json:"code"`
+	Error string `gorm:"size:1000" json:"error,omitempty"`
+	Ctime int64  `json:"ctime"`
+	// ms
+	Duration int64 `json:"duration"`
+}
+
+// body posted to the callback of a job
+type callbackSummary struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Total  int    `json:"total"`
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+	Error  string `json:"error,omitempty"`
+	// url of the result of a done job
+	Result string `json:"result,omitempty"`
+	Etime  int64  `json:"etime"`
+}
+
+// callback of a submitted job, any http host is allowed since only
+// photogate.jobs.admin may submit
+func checkCallback(callback, secret string) error {
+	if callback == "" {
+		return nil
+	}
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback must be an http url")
+	}
+	if secret == "" {
+		return errors.New("callback requires a secret")
+	}
+	return nil
+}
+
+// Sign is the signature of a callback body posted at timestamp, the hex
+// hmac-sha256 of "<timestamp>.<body>" with the secret of the job
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver the summary of the finished job at, if it has a callback which
+// was not attempted yet
+func (s *Store) scheduleCallback(id string, at int64) {
+	res := s.db.Model(&Job{}).
+		Where("id = ? AND callback <> '' AND callback_attempts = 0", id).
+		Updates(map[string]interface{}{"callback_status": CallbackPending, "callback_next": at})
+	if res.Error != nil {
+		log.Error().Err(res.Error).Str("job", id).Msg("schedule callback")
+		return
+	}
+	select {
+	case s.callbackWake <- struct{}{}:
+	default:
+	}
+}
+
+// Deliveries returns the attempts to post the summary of the job, oldest first
+func (s *Store) Deliveries(id string) ([]Delivery, error) {
+	if _, err := s.Get(id); err != nil {
+		return nil, err
+	}
+	var ds []Delivery
+	err := s.db.Where(map[string]interface{}{"job_id": id}).Order("id").Find(&ds).Error
+	return ds, err
+}
+
+func (s *Store) deliverLoop(pollInterval time.Duration, stop <-chan struct{}) {
+	for {
+		wait := s.deliverDue(pollInterval)
+		select {
+		case <-stop:
+			return
+		case <-s.callbackWake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliver pending callbacks which are due, and return how long until
+// the next one, at most pollInterval
+func (s *Store) deliverDue(pollInterval time.Duration) time.Duration {
+	for {
+		now := utils.MakeTimestamp()
+		var job Job
+		res := s.db.Omit("request").
+			Where("callback_status = ? AND callback_next <= ?", CallbackPending, now).
+			Order("callback_next").
+			Limit(1).
+			Find(&job)
+		if res.Error != nil {
+			log.Error().Err(res.Error).Msg("find callbacks")
+			return pollInterval
+		}
+		if res.RowsAffected == 0 {
+			break
+		}
+
+		// no other instance attempts it meanwhile
+		res = s.db.Model(&Job{}).
+			Where("id = ? AND callback_status = ? AND callback_next = ?", job.ID, CallbackPending, job.CallbackNext).
+			Update("callback_next", now+2*callbackTimeout.Milliseconds())
+		if res.Error != nil {
+			log.Error().Err(res.Error).Msg("claim callback")
+			return pollInterval
+		}
+		if res.RowsAffected == 1 {
+			s.deliver(&job)
+		}
+	}
+
+	var next int64
+	err := s.db.Model(&Job{}).
+		Where("callback_status = ?", CallbackPending).
+		Select("COALESCE(MIN(callback_next), 0)").
+		Scan(&next).
+		Error
+	if err != nil || next == 0 {
+		return pollInterval
+	}
+	wait := time.Duration(next-utils.MakeTimestamp()) * time.Millisecond
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > pollInterval {
+		wait = pollInterval
+	}
+	return wait
+}
+
+// wait before the attempt after attempt
+func (s *Store) callbackDelay(attempt int) time.Duration {
+	d := s.callbackBackoff
+	for i := 1; i < attempt && d < maxCallbackBackoff; i++ {
+		d *= 2
+	}
+	if d > maxCallbackBackoff {
+		d = maxCallbackBackoff
+	}
+	return d
+}
+
+func (s *Store) deliver(job *Job) {
+	summary := callbackSummary{
+		ID:     job.ID,
+		Kind:   job.Kind,
+		Status: job.Status,
+		Total:  job.Total,
+		Done:   job.Done,
+		Failed: job.Failed,
+		Error:  job.Error,
+		Etime:  job.Etime,
+	}
+	if job.Status == StatusDone {
+		summary.Result = s.baseURL + "/internal/jobs/" + job.ID + "/result"
+	}
+	body, _ := json.Marshal(summary)
+
+	attempt := job.CallbackAttempts + 1
+	d := Delivery{JobID: job.ID, Attempt: attempt, Ctime: utils.MakeTimestamp()}
+	start := time.Now()
+	err := s.post(job, body, &d)
+	d.Duration = time.Since(start).Milliseconds()
+	if err != nil {
+		d.Error = err.Error()
+		if len(d.Error) > 1000 {
+			d.Error = d.Error[:1000]
+		}
+	}
+	if err := s.db.Create(&d).Error; err != nil {
+		log.Error().Err(err).Str("job", job.ID).Msg("record delivery")
+	}
+
+	updates := map[string]interface{}{"callback_attempts": attempt}
+	delivered := err == nil && d.Code >= 200 && d.Code < 300
+	// no response, or a server error. client errors would fail again
+	retry := d.Code == 0 || d.Code >= 500 || d.Code == http.StatusTooManyRequests || d.Code == http.StatusRequestTimeout
+	switch {
+	case delivered:
+		updates["callback_status"] = CallbackDelivered
+	case retry && attempt < s.callbackAttempts:
+		updates["callback_next"] = utils.MakeTimestamp() + s.callbackDelay(attempt).Milliseconds()
+	default:
+		updates["callback_status"] = CallbackFailed
+	}
+	if err := s.db.Model(&Job{}).Where(map[string]interface{}{"ID": job.ID}).Updates(updates).Error; err != nil {
+		log.Error().Err(err).Str("job", job.ID).Msg("update callback")
+	}
+
+	lg := log.Info()
+	if !delivered {
+		lg = log.Warn().Err(err)
+	}
+	lg.Str("job", job.ID).Int("attempt", attempt).Int("code", d.Code).Msg("job callback")
+}
+
+func (s *Store) post(job *Job, body []byte, d *Delivery) error {
+	req, err := http.NewRequest(http.MethodPost, job.Callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Photogate-Timestamp", ts)
+	req.Header.Set("X-Photogate-Signature", "sha256="+Sign(job.CallbackSecret, ts, body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	d.Code = resp.StatusCode
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package jobs
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallback(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		summaries []callbackSummary
+		codes     = []int{http.StatusBadGateway, http.StatusOK}
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sig := "sha256=" + Sign("secret", r.Header.Get("X-Photogate-Timestamp"), body)
+		if r.Header.Get("X-Photogate-Signature") != sig {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		var summary callbackSummary
+		json.Unmarshal(body, &summary)
+		summaries = append(summaries, summary)
+		code := http.StatusBadRequest
+		if len(codes) > 0 {
+			code, codes = codes[0], codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	defer receiver.Close()
+
+	s := newTestStore(t)
+	s.SetCallback("http://photogate/", 3, 10*time.Millisecond)
+	stop := make(chan struct{})
+	defer close(stop)
+	s.Start(1, time.Hour, 0, stop)
+
+	_, err := s.Submit("test", []byte("a"), "ftp://host", "secret")
+	require.Error(t, err)
+	_, err = s.Submit("test", []byte("a"), receiver.URL, "")
+	require.Error(t, err)
+
+	// a server error is attempted again
+	job, err := s.Submit("test", []byte("a,fail"), receiver.URL, "secret")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, err = s.Get(job.ID)
+		require.NoError(t, err)
+		return job.CallbackStatus == CallbackDelivered
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, job.CallbackAttempts)
+
+	ds, err := s.Deliveries(job.ID)
+	require.NoError(t, err)
+	require.Len(t, ds, 2)
+	require.Equal(t, http.StatusBadGateway, ds[0].Code)
+	require.NotEmpty(t, ds[0].Error)
+	require.Equal(t, http.StatusOK, ds[1].Code)
+	require.Empty(t, ds[1].Error)
+
+	mu.Lock()
+	require.Equal(t, callbackSummary{
+		ID: job.ID, Kind: "test", Status: StatusDone, Total: 2, Done: 2, Failed: 1,
+		Result: "http://photogate/internal/jobs/" + job.ID + "/result",
+		Etime:  job.Etime,
+	}, summaries[1])
+	mu.Unlock()
+
+	// a client error is not, nor is a wrong signature
+	job, err = s.Submit("test", []byte("a"), receiver.URL, "other")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		job, err = s.Get(job.ID)
+		require.NoError(t, err)
+		return job.CallbackStatus == CallbackFailed
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, job.CallbackAttempts)
+
+	// canceled jobs are posted too
+	job, err = s.Submit("test", []byte("wait"), receiver.URL, "secret")
+	require.NoError(t, err)
+	waitStatus(t, s, job.ID, StatusRunning)
+	_, err = s.Cancel(job.ID)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		last := summaries[len(summaries)-1]
+		return last.ID == job.ID && last.Status == StatusCanceled
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,168 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen"
+	jwtmux "gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen/mux"
+)
+
+// max size of the request of a job
+const maxRequestSize = 16 << 20
+
+type jobService struct {
+	store *Store
+	ir    *mux.Router
+}
+
+// NewService serves the store under /internal/jobs
+func NewService(store *Store) *jobService {
+	s := &jobService{store: store}
+	s.ir = s.router()
+	s.ir.Use(
+		jwtmux.NewJwtAuthenticationMiddleware(
+			jwtmux.AllowByFunc(checkAllowedRole),
+			jwtmux.WithCustomClaims(&jwtauthen.XClaims{}),
+		),
+	)
+	return s
+}
+
+// routes without authentication
+func (s *jobService) router() *mux.Router {
+	ir := mux.NewRouter()
+	ir.Methods("POST").Path("/{kind}").HandlerFunc(s.handleSubmit).Name("SUBMIT_JOB")
+	ir.Methods("GET").Path("/{id:[0-9a-f]{32}}").HandlerFunc(s.handleGet).Name("GET_JOB")
+	ir.Methods("GET").Path("/{id:[0-9a-f]{32}}/result").HandlerFunc(s.handleResult).Name("GET_JOB_RESULT")
+	ir.Methods("POST").Path("/{id:[0-9a-f]{32}}/cancel").HandlerFunc(s.handleCancel).Name("CANCEL_JOB")
+	ir.Methods("GET").Path("/{id:[0-9a-f]{32}}/deliveries").HandlerFunc(s.handleDeliveries).Name("GET_JOB_DELIVERIES")
+	return ir
+}
+
+func checkAllowedRole(r *http.Request, c jwtauthen.Claims) bool {
+	route := mux.CurrentRoute(r)
+	switch name := route.GetName(); name {
+	case "GET_JOB", "GET_JOB_RESULT", "GET_JOB_DELIVERIES":
+		requireRole := "photogate.jobs.viewer"
+		requireAdminRole := "photogate.jobs.admin"
+		return c.ContainRole(requireRole) || c.ContainRole(requireAdminRole)
+	case "SUBMIT_JOB", "CANCEL_JOB":
+		// a job may post its summary to any callback url
+		requireAdminRole := "photogate.jobs.admin"
+		return c.ContainRole(requireAdminRole)
+	}
+	return false
+}
+
+func (s *jobService) MainHandler() http.Handler {
+	return nil
+}
+
+func (s *jobService) InternalHandler() http.Handler {
+	return s.ir
+}
+
+func respondData(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func respondError(w http.ResponseWriter, code int, msg string) {
+	respondData(w, code, map[string]string{"error": msg})
+}
+
+func respondJobError(w http.ResponseWriter, err error) {
+	var rerr *RequestError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		respondError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrFinished):
+		respondError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrInvalidKind), errors.As(err, &rerr):
+		respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// body is the request of the job, like the body of POST /internal/template/batch
+// for kind generic. query param callback and header X-Callback-Secret are
+// optional, see Job. responds the queued job
+func (s *jobService) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(b) > maxRequestSize {
+		respondError(w, http.StatusBadRequest, "request is larger than 16MB")
+		return
+	}
+
+	job, err := s.store.Submit(mux.Vars(r)["kind"], b, r.URL.Query().Get("callback"), r.Header.Get("X-Callback-Secret"))
+	if err != nil {
+		respondJobError(w, err)
+		return
+	}
+	respondData(w, http.StatusAccepted, job)
+}
+
+// status and progress of the job
+func (s *jobService) handleGet(w http.ResponseWriter, r *http.Request) {
+	job, err := s.store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		respondJobError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, job)
+}
+
+// zip of a done job
+func (s *jobService) handleResult(w http.ResponseWriter, r *http.Request) {
+	job, err := s.store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		respondJobError(w, err)
+		return
+	}
+	if job.Status != StatusDone {
+		respondError(w, http.StatusConflict, "job is "+job.Status)
+		return
+	}
+
+	f, err := os.Open(s.store.ResultPath(job.ID))
+	if err != nil {
+		// purged, or done by an instance with another dir
+		respondError(w, http.StatusNotFound, "result not found")
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+job.ID+`.zip"`)
+	io.Copy(w, f)
+}
+
+func (s *jobService) handleCancel(w http.ResponseWriter, r *http.Request) {
+	job, err := s.store.Cancel(mux.Vars(r)["id"])
+	if err != nil {
+		respondJobError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, job)
+}
+
+// attempts to post the summary of the job to its callback
+func (s *jobService) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	ds, err := s.store.Deliveries(mux.Vars(r)["id"])
+	if err != nil {
+		respondJobError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, ds)
+}
@@ -0,0 +1,509 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	StatusQueued   = "queued"
+	StatusRunning  = "running"
+	StatusDone     = "done"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+)
+
+const (
+	// how often a running job saves its progress
+	progressInterval = time.Second
+	// a running job without progress for this long is queued again,
+	// the instance running it stopped
+	staleAfter = time.Minute
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrInvalidKind = errors.New("invalid kind of job")
+	ErrFinished    = errors.New("job is finished")
+)
+
+// request of a job was rejected by the runner of its kind
+type RequestError struct {
+	Err error
+}
+
+func (e *RequestError) Error() string {
+	return "invalid request: " + e.Err.Error()
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Runner runs the requests of jobs of a kind
+type Runner interface {
+	// Check returns the number of items of a request which can be run
+	Check(req []byte) (int, error)
+	// Run writes the result of a request to w, progress is called after
+	// each item. it stops early once ctx is done
+	Run(ctx context.Context, req []byte, w io.Writer, progress func(failed bool)) error
+}
+
+// a submitted request, its result is a file of the store dir once done
+type Job struct {
+	ID      string `gorm:"primaryKey;size:32" json:"id"`
+	Kind    string `gorm:"size:20" json:"kind"`
+	Status  string `gorm:"size:20;index" json:"status"`
+	Request []byte `gorm:"type:longblob" json:"-"`
+	// items of the request, done counts the failed ones
+	Total  int `json:"total"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+	// why a failed job stopped
+	Error string `gorm:"size:1000" json:"error,omitempty"`
+	Ctime int64  `json:"ctime"`
+	Mtime int64  `json:"mtime"`
+	// when the job finished, 0 until then
+	Etime int64 `json:"etime,omitempty"`
+
+	// url posted a summary of the job once finished, signed with the
+	// secret. see Sign
+	Callback       string `gorm:"size:1000" json:"callback,omitempty"`
+	CallbackSecret string `gorm:"size:200" json:"-"`
+	// pending until the summary is delivered or attempts run out
+	CallbackStatus   string `gorm:"size:20;index" json:"callback_status,omitempty"`
+	CallbackAttempts int    `json:"callback_attempts,omitempty"`
+	// when to attempt next
+	CallbackNext int64 `json:"-"`
+}
+
+type Store struct {
+	db  *gorm.DB
+	dir string
+
+	mu      sync.Mutex
+	runners map[string]Runner
+	// jobs running on this instance
+	cancels map[string]context.CancelFunc
+
+	// a job was submitted
+	wake chan struct{}
+
+	// a callback is pending
+	callbackWake     chan struct{}
+	client           http.Client
+	callbackAttempts int
+	callbackBackoff  time.Duration
+	// of the result urls of callbacks
+	baseURL string
+}
+
+// New stores jobs in db and their results in dir
+func New(db *gorm.DB, dir string) (*Store, error) {
+	if err := db.AutoMigrate(&Job{}, &Delivery{}); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{
+		db:      db,
+		dir:     dir,
+		runners: map[string]Runner{},
+		cancels: map[string]context.CancelFunc{},
+		wake:    make(chan struct{}, 1),
+
+		callbackWake:     make(chan struct{}, 1),
+		client:           http.Client{Timeout: callbackTimeout},
+		callbackAttempts: 6,
+		callbackBackoff:  10 * time.Second,
+	}, nil
+}
+
+// SetCallback sets the base url of the result urls posted to callbacks,
+// and how many times and how soon a failed callback is attempted again.
+// the wait doubles after each attempt
+func (s *Store) SetCallback(baseURL string, attempts int, backoff time.Duration) {
+	s.baseURL = strings.TrimSuffix(baseURL, "/")
+	s.callbackAttempts = attempts
+	s.callbackBackoff = backoff
+}
+
+func (s *Store) SetRunner(kind string, r Runner) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runners[kind] = r
+}
+
+func (s *Store) runner(kind string) Runner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runners[kind]
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Submit queues a job of the request, checked by the runner of kind.
+// callback is optional, see Job
+func (s *Store) Submit(kind string, req []byte, callback, secret string) (*Job, error) {
+	r := s.runner(kind)
+	if r == nil {
+		return nil, ErrInvalidKind
+	}
+	if err := checkCallback(callback, secret); err != nil {
+		return nil, &RequestError{err}
+	}
+	n, err := r.Check(req)
+	if err != nil {
+		return nil, &RequestError{err}
+	}
+
+	now := utils.MakeTimestamp()
+	job := &Job{
+		ID:      newID(),
+		Kind:    kind,
+		Status:  StatusQueued,
+		Request: req,
+		Total:   n,
+		Ctime:   now,
+		Mtime:   now,
+
+		Callback:       callback,
+		CallbackSecret: secret,
+	}
+	if err = s.db.Create(job).Error; err != nil {
+		return nil, err
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get returns the job without its request
+func (s *Store) Get(id string) (*Job, error) {
+	var job Job
+	res := s.db.Omit("request").Where(map[string]interface{}{"ID": id}).Limit(1).Find(&job)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+// Cancel stops a queued or running job, its result is discarded
+func (s *Store) Cancel(id string) (*Job, error) {
+	now := utils.MakeTimestamp()
+	canceled := map[string]interface{}{"status": StatusCanceled, "mtime": now, "etime": now}
+	res := s.db.Model(&Job{}).
+		Where("id = ? AND status = ?", id, StatusQueued).
+		Updates(canceled)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 1 {
+		s.scheduleCallback(id, now)
+	} else {
+		res = s.db.Model(&Job{}).
+			Where("id = ? AND status = ?", id, StatusRunning).
+			Updates(canceled)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		// delivered once the run saved its progress, or later if the
+		// instance running it stopped
+		if res.RowsAffected == 1 {
+			s.scheduleCallback(id, now+staleAfter.Milliseconds())
+		}
+	}
+
+	s.mu.Lock()
+	if cancel, ok := s.cancels[id]; ok {
+		cancel()
+	}
+	s.mu.Unlock()
+
+	job, err := s.Get(id)
+	if err == nil && res.RowsAffected == 0 {
+		err = ErrFinished
+	}
+	return job, err
+}
+
+// ResultPath is the file of the result of a done job
+func (s *Store) ResultPath(id string) string {
+	return filepath.Join(s.dir, id+".zip")
+}
+
+// Start runs queued jobs with workers goroutines, looking for jobs of
+// other instances every pollInterval, and deletes jobs finished for longer
+// than retention, 0 to keep them. until stop is closed
+func (s *Store) Start(workers int, pollInterval, retention time.Duration, stop <-chan struct{}) {
+	for i := 0; i < workers; i++ {
+		go s.work(pollInterval, stop)
+	}
+	go s.deliverLoop(pollInterval, stop)
+
+	go func() {
+		t := time.NewTicker(pollInterval)
+		defer t.Stop()
+		for {
+			s.requeueStale()
+			if retention > 0 {
+				s.purge(retention)
+			}
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+func (s *Store) work(pollInterval time.Duration, stop <-chan struct{}) {
+	for {
+		job, err := s.claim()
+		if err != nil {
+			log.Error().Err(err).Msg("claim job")
+		}
+		if job != nil {
+			s.run(job, stop)
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.wake:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// the oldest queued job, now running on this instance. nil if there is none
+func (s *Store) claim() (*Job, error) {
+	for {
+		var job Job
+		res := s.db.Where(map[string]interface{}{"Status": StatusQueued}).
+			Order("ctime, id").
+			Limit(1).
+			Find(&job)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return nil, res.Error
+		}
+
+		res = s.db.Model(&Job{}).
+			Where("id = ? AND status = ?", job.ID, StatusQueued).
+			Updates(map[string]interface{}{"status": StatusRunning, "mtime": utils.MakeTimestamp()})
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		// else claimed by another worker
+		if res.RowsAffected == 1 {
+			job.Status = StatusRunning
+			return &job, nil
+		}
+	}
+}
+
+func (s *Store) run(job *Job, stop <-chan struct{}) {
+	lg := log.With().Str("job", job.ID).Str("kind", job.Kind).Logger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.mu.Lock()
+	s.cancels[job.ID] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.cancels, job.ID)
+		s.mu.Unlock()
+	}()
+
+	r := s.runner(job.Kind)
+	if r == nil {
+		s.finish(job.ID, StatusFailed, 0, 0, ErrInvalidKind.Error())
+		return
+	}
+
+	result := s.ResultPath(job.ID)
+	tmp := result + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		s.finish(job.ID, StatusFailed, 0, 0, err.Error())
+		return
+	}
+	defer os.Remove(tmp)
+
+	// save progress, which also tells running jobs apart from jobs of
+	// stopped instances. a job canceled by another instance is stopped
+	var done, failed int64
+	progressDone := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		stop := stop
+		for {
+			select {
+			case <-stop:
+				cancel()
+				stop = nil
+			case <-progressDone:
+				return
+			case <-t.C:
+				res := s.db.Model(&Job{}).
+					Where("id = ? AND status = ?", job.ID, StatusRunning).
+					Updates(map[string]interface{}{
+						"done":   atomic.LoadInt64(&done),
+						"failed": atomic.LoadInt64(&failed),
+						"mtime":  utils.MakeTimestamp(),
+					})
+				if res.Error == nil && res.RowsAffected == 0 {
+					cancel()
+				}
+			}
+		}
+	}()
+
+	lg.Info().Int("total", job.Total).Msg("run job")
+	err = r.Run(ctx, job.Request, f, func(itemFailed bool) {
+		atomic.AddInt64(&done, 1)
+		if itemFailed {
+			atomic.AddInt64(&failed, 1)
+		}
+	})
+	close(progressDone)
+	wg.Wait()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	nd, nf := int(atomic.LoadInt64(&done)), int(atomic.LoadInt64(&failed))
+
+	stopping := false
+	select {
+	case <-stop:
+		stopping = true
+	default:
+	}
+
+	switch {
+	case err == nil:
+		if err = os.Rename(tmp, result); err != nil {
+			s.finish(job.ID, StatusFailed, nd, nf, err.Error())
+			return
+		}
+		if !s.finish(job.ID, StatusDone, nd, nf, "") {
+			// canceled after its last item
+			os.Remove(result)
+		}
+		lg.Info().Int("failed", nf).Msg("job done")
+	case stopping:
+		// run again by the next instance
+		s.db.Model(&Job{}).
+			Where("id = ? AND status = ?", job.ID, StatusRunning).
+			Updates(map[string]interface{}{"status": StatusQueued, "done": 0, "failed": 0, "mtime": utils.MakeTimestamp()})
+		lg.Info().Msg("job queued again")
+	case ctx.Err() != nil:
+		s.db.Model(&Job{}).
+			Where(map[string]interface{}{"ID": job.ID}).
+			Updates(map[string]interface{}{"done": nd, "failed": nf})
+		s.scheduleCallback(job.ID, utils.MakeTimestamp())
+		lg.Info().Msg("job canceled")
+	default:
+		s.finish(job.ID, StatusFailed, nd, nf, err.Error())
+		lg.Error().Err(err).Msg("job failed")
+	}
+}
+
+// false if the job is not running anymore, as it was canceled
+func (s *Store) finish(id, status string, done, failed int, msg string) bool {
+	if len(msg) > 1000 {
+		msg = msg[:1000]
+	}
+	now := utils.MakeTimestamp()
+	res := s.db.Model(&Job{}).
+		Where("id = ? AND status = ?", id, StatusRunning).
+		Updates(map[string]interface{}{
+			"status": status,
+			"done":   done,
+			"failed": failed,
+			"error":  msg,
+			"mtime":  now,
+			"etime":  now,
+		})
+	if res.Error != nil {
+		log.Error().Err(res.Error).Str("job", id).Msg("finish job")
+	}
+	if res.RowsAffected != 1 {
+		return false
+	}
+	s.scheduleCallback(id, now)
+	return true
+}
+
+// queue again the jobs of instances which stopped while running them
+func (s *Store) requeueStale() {
+	before := utils.MakeTimestamp() - staleAfter.Milliseconds()
+	res := s.db.Model(&Job{}).
+		Where("status = ? AND mtime < ?", StatusRunning, before).
+		Updates(map[string]interface{}{"status": StatusQueued, "done": 0, "failed": 0, "mtime": utils.MakeTimestamp()})
+	if res.Error != nil {
+		log.Error().Err(res.Error).Msg("requeue stale jobs")
+	} else if res.RowsAffected > 0 {
+		log.Info().Int64("jobs", res.RowsAffected).Msg("requeue stale jobs")
+	}
+}
+
+// delete jobs finished before retention and their results
+func (s *Store) purge(retention time.Duration) {
+	before := utils.MakeTimestamp() - retention.Milliseconds()
+	var ids []string
+	err := s.db.Model(&Job{}).
+		Where("status IN ? AND etime < ? AND callback_status <> ?",
+			[]string{StatusDone, StatusFailed, StatusCanceled}, before, CallbackPending).
+		Pluck("id", &ids).
+		Error
+	if err != nil {
+		log.Error().Err(err).Msg("purge jobs")
+		return
+	}
+	for _, id := range ids {
+		if err := os.Remove(s.ResultPath(id)); err != nil && !os.IsNotExist(err) {
+			log.Error().Err(err).Str("job", id).Msg("purge job result")
+			continue
+		}
+		if err := s.db.Where(map[string]interface{}{"job_id": id}).Delete(&Delivery{}).Error; err != nil {
+			log.Error().Err(err).Str("job", id).Msg("purge job deliveries")
+			continue
+		}
+		if err := s.db.Delete(&Job{ID: id}).Error; err != nil {
+			log.Error().Err(err).Str("job", id).Msg("purge job")
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// request is the items to write, an item "wait" blocks until ctx is done
+// and an item "fail" fails
+type testRunner struct{}
+
+func (testRunner) Check(req []byte) (int, error) {
+	if len(req) == 0 {
+		return 0, errors.New("empty")
+	}
+	return len(strings.Split(string(req), ",")), nil
+}
+
+func (testRunner) Run(ctx context.Context, req []byte, w io.Writer, progress func(failed bool)) error {
+	for _, item := range strings.Split(string(req), ",") {
+		switch item {
+		case "wait":
+			<-ctx.Done()
+			return ctx.Err()
+		case "fail":
+			progress(true)
+		default:
+			if _, err := io.WriteString(w, item); err != nil {
+				return err
+			}
+			progress(false)
+		}
+	}
+	return nil
+}
+
+func newTestStore(t *testing.T) *Store {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	s, err := New(db, t.TempDir())
+	require.NoError(t, err)
+	s.SetRunner("test", testRunner{})
+	return s
+}
+
+func waitStatus(t *testing.T, s *Store, id, status string) *Job {
+	var job *Job
+	require.Eventually(t, func() bool {
+		var err error
+		job, err = s.Get(id)
+		require.NoError(t, err)
+		return job.Status == status
+	}, 5*time.Second, 10*time.Millisecond)
+	return job
+}
+
+func TestJobs(t *testing.T) {
+	s := newTestStore(t)
+	stop := make(chan struct{})
+	defer close(stop)
+	s.Start(1, time.Hour, 0, stop)
+
+	job, err := s.Submit("test", []byte("a,fail,b"), "", "")
+	require.NoError(t, err)
+	require.Equal(t, 3, job.Total)
+
+	job = waitStatus(t, s, job.ID, StatusDone)
+	require.Equal(t, 3, job.Done)
+	require.Equal(t, 1, job.Failed)
+	require.NotZero(t, job.Etime)
+	b, err := os.ReadFile(s.ResultPath(job.ID))
+	require.NoError(t, err)
+	require.Equal(t, "ab", string(b))
+
+	_, err = s.Cancel(job.ID)
+	require.ErrorIs(t, err, ErrFinished)
+
+	job, err = s.Submit("test", []byte("a,wait"), "", "")
+	require.NoError(t, err)
+	waitStatus(t, s, job.ID, StatusRunning)
+	job, err = s.Cancel(job.ID)
+	require.NoError(t, err)
+	require.Equal(t, StatusCanceled, job.Status)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(s.ResultPath(job.ID) + ".tmp")
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(s.ResultPath(job.ID))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = s.Submit("other", []byte("a"), "", "")
+	require.ErrorIs(t, err, ErrInvalidKind)
+	_, err = s.Submit("test", nil, "", "")
+	var rerr *RequestError
+	require.True(t, errors.As(err, &rerr))
+	_, err = s.Get("missing")
+	require.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestJobsRetention(t *testing.T) {
+	s := newTestStore(t)
+
+	// a job left running by a stopped instance
+	job, err := s.Submit("test", []byte("a"), "", "")
+	require.NoError(t, err)
+	require.NoError(t, s.db.Model(&Job{}).Where("id = ?", job.ID).
+		Updates(map[string]interface{}{"status": StatusRunning, "done": 1, "mtime": 0}).Error)
+	s.requeueStale()
+	job, err = s.Get(job.ID)
+	require.NoError(t, err)
+	require.Equal(t, StatusQueued, job.Status)
+	require.Equal(t, 0, job.Done)
+
+	stop := make(chan struct{})
+	s.Start(1, time.Hour, 0, stop)
+	waitStatus(t, s, job.ID, StatusDone)
+	close(stop)
+
+	// finished long ago
+	require.NoError(t, s.db.Model(&Job{}).Where("id = ?", job.ID).Update("etime", 1).Error)
+	s.purge(time.Hour)
+	_, err = s.Get(job.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = os.Stat(s.ResultPath(job.ID))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestJobService(t *testing.T) {
+	s := newTestStore(t)
+	h := NewService(s).router()
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/test", "a,b")
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var job Job
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	require.Equal(t, StatusQueued, job.Status)
+
+	w = do(http.MethodGet, "/"+job.ID+"/result", "")
+	require.Equal(t, http.StatusConflict, w.Code)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	s.Start(1, time.Hour, 0, stop)
+	waitStatus(t, s, job.ID, StatusDone)
+
+	w = do(http.MethodGet, "/"+job.ID, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"status":"done"`)
+	w = do(http.MethodGet, "/"+job.ID+"/result", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	require.Equal(t, "ab", w.Body.String())
+
+	w = do(http.MethodPost, "/"+job.ID+"/cancel", "")
+	require.Equal(t, http.StatusConflict, w.Code)
+	w = do(http.MethodGet, "/"+strings.Repeat("0", 32), "")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	w = do(http.MethodPost, "/test", "")
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	// no token
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/test", strings.NewReader("a,b")),
+		httptest.NewRequest(http.MethodGet, "/"+job.ID+"/result", nil),
+		httptest.NewRequest(http.MethodPost, "/"+job.ID+"/cancel", nil),
+		httptest.NewRequest(http.MethodGet, "/"+job.ID+"/deliveries", nil),
+	} {
+		w = httptest.NewRecorder()
+		NewService(s).InternalHandler().ServeHTTP(w, req)
+		require.Equal(t, http.StatusUnauthorized, w.Code, req.URL.Path)
+	}
+}
@@ -0,0 +1,177 @@
+// Package lint checks template files offline, with the loaders of the
+// services and the checks of their LintTemplate
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	appfb "gitlab.sendo.vn/system/photogate/app-fb"
+	appgeneric "gitlab.sendo.vn/system/photogate/app-generic"
+	appqr "gitlab.sendo.vn/system/photogate/app-qr"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Diagnostic is a problem at a line of a template file
+type Diagnostic struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+type linter func(static fs.FS, name string, b []byte) []plugins.Problem
+
+// template dirs and the linter of their templates
+var dirs = []struct {
+	dir  string
+	lint linter
+}{
+	{"fb-templates", func(_ fs.FS, _ string, b []byte) []plugins.Problem {
+		return appfb.LintTemplate(b)
+	}},
+	{"generic-templates", appgeneric.LintTemplate},
+	{"qr-templates", appqr.LintTemplate},
+}
+
+var templateRx = regexp.MustCompile(`\.yaml$`)
+
+// Run lints the templates of the template dirs of templates, files they
+// use are read from static. diagnostics are sorted by file and line
+func Run(templates, static fs.FS) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	for _, d := range dirs {
+		err := utils.ScanFileMatch(templates, d.dir, templateRx, func(fname, path string, b []byte) error {
+			name := strings.TrimSuffix(fname, ".yaml")
+			for _, p := range d.lint(static, name, b) {
+				diags = append(diags, Diagnostic{
+					File:    path,
+					Line:    Locate(b, p),
+					Message: p.Message,
+				})
+			}
+			return nil
+		})
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Line < diags[j].Line
+	})
+	return diags, nil
+}
+
+var yamlLineRx = regexp.MustCompile(`line (\d+)`)
+
+// Locate returns the line of the plugin and field of p in the yaml content
+// b of a template, or of the closest node found
+func Locate(b []byte, p plugins.Problem) int {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		if m := yamlLineRx.FindStringSubmatch(err.Error()); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			return n
+		}
+		return 1
+	}
+	if len(doc.Content) == 0 {
+		return 1
+	}
+
+	node := doc.Content[0]
+	line := node.Line
+	for level, i := range p.Path {
+		key, seq := mappingValue(node, "plugins")
+		if seq == nil || seq.Kind != yaml.SequenceNode {
+			return line
+		}
+		line = key.Line
+
+		id := ""
+		if level < len(p.Ids) {
+			id = p.Ids[level]
+		}
+		// plugins of an extended template or an include are not in b,
+		// indexes of the loaded plugins are not indexes in b
+		extended, _ := mappingValue(node, "extends")
+		exact := (level > 0 || extended == nil) && !hasInclude(seq)
+
+		node = pluginNode(seq, i, id, exact)
+		if node == nil {
+			return line
+		}
+		line = node.Line
+	}
+
+	for _, field := range strings.Split(p.Field, ".") {
+		if field == "" {
+			break
+		}
+		key, value := mappingValue(node, field)
+		if key == nil {
+			break
+		}
+		line, node = key.Line, value
+	}
+	return line
+}
+
+// like config fields are matched, see plugins.NewStructDecoder
+func normalizeKey(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+}
+
+func mappingValue(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	key = normalizeKey(key)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if normalizeKey(node.Content[i].Value) == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func hasInclude(seq *yaml.Node) bool {
+	for _, n := range seq.Content {
+		if k, _ := mappingValue(n, "include"); k != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// plugin i of seq, found by id when it has one
+func pluginNode(seq *yaml.Node, i int, id string, exact bool) *yaml.Node {
+	if id != "" {
+		for _, n := range seq.Content {
+			if _, v := mappingValue(n, "id"); v != nil && v.Value == id {
+				return n
+			}
+		}
+	}
+	if exact && i < len(seq.Content) {
+		return seq.Content[i]
+	}
+	return nil
+}
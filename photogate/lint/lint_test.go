@@ -0,0 +1,80 @@
+package lint
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins"
+	"gitlab.sendo.vn/system/photogate/utils"
+)
+
+func TestLocate(t *testing.T) {
+	b := []byte(`allWidths: [600]
+plugins:
+- type: image
+  image: a.png
+- type: group
+  plugins:
+  - type: text
+    font_size: 12
+  - id: price
+    type: text
+    binding:
+      text: price
+`)
+	require.Equal(t, 1, Locate(b, plugins.Problem{Field: "allWidths"}))
+	require.Equal(t, 3, Locate(b, plugins.Problem{Path: []int{0}, Ids: []string{""}}))
+	require.Equal(t, 4, Locate(b, plugins.Problem{Path: []int{0}, Ids: []string{""}, Field: "image"}))
+	require.Equal(t, 8, Locate(b, plugins.Problem{Path: []int{1, 0}, Ids: []string{"", ""}, Field: "fontSize"}))
+	require.Equal(t, 12, Locate(b, plugins.Problem{Path: []int{1, 5}, Ids: []string{"", "price"}, Field: "binding.text"}))
+	// unknown field
+	require.Equal(t, 7, Locate(b, plugins.Problem{Path: []int{1, 0}, Ids: []string{"", ""}, Field: "color"}))
+
+	// plugins of the parent are before the plugins of b
+	b = []byte("extends: base.yaml\nplugins:\n- type: image\n")
+	require.Equal(t, 2, Locate(b, plugins.Problem{Path: []int{0}, Ids: []string{""}}))
+
+	require.Equal(t, 2, Locate([]byte("a: 1\nb: [\n"), plugins.Problem{}))
+}
+
+func TestRun(t *testing.T) {
+	templates := fstest.MapFS{
+		"generic-templates/ok.yaml": &fstest.MapFile{Data: []byte(`allWidths: [100]
+inputs:
+- name: price
+plugins:
+- type: text
+  fontUri: ../static/fonts/Roboto-Bold.ttf
+  fontSize: 12
+  y: 50
+  binding:
+    text: price
+`)},
+		"generic-templates/bad.yaml": &fstest.MapFile{Data: []byte(`extends: ok.yaml
+plugins:
+- type: text
+  fontUri: ../static/fonts/Roboto-Bold.ttf
+  fontSize: 12
+  y: 500
+  binding:
+    text: "{{.name}}"
+`)},
+		"qr-templates/bad.yaml": &fstest.MapFile{Data: []byte(`allWidths: [100]
+plugins:
+- type: qr
+  size: 2
+`)},
+	}
+	utils.Init(templates)
+
+	diags, err := Run(templates, templates)
+	require.NoError(t, err)
+	require.Equal(t, []Diagnostic{
+		// plugins of ok.yaml are before the plugins of bad.yaml
+		{"generic-templates/bad.yaml", 2, `binding text: key "name" is never bound`},
+		{"generic-templates/bad.yaml", 2, "text is drawn outside the 100x100 image, at 0,488 size 1x12"},
+		{"qr-templates/bad.yaml", 4, "configure plugin #0 (qr): field size must in (0, 1]"},
+	}, diags)
+	require.Equal(t, "qr-templates/bad.yaml:4: configure plugin #0 (qr): field size must in (0, 1]", diags[2].String())
+}
@@ -34,6 +34,8 @@ func init() {
 	{
 		var showConfig bool
 		pflag.BoolVarP(&showConfig, "show-config", "s", false, "")
+		// flags after a subcommand, like render --set, are its own
+		pflag.CommandLine.SetInterspersed(false)
 		pflag.Parse()
 		if showConfig {
 			if b, err := yaml.Marshal(viper.AllSettings()); err != nil {
@@ -60,6 +62,13 @@ func SetupSignals(cleanup func()) {
 }
 
 func main() {
+	switch pflag.Arg(0) {
+	case "lint":
+		os.Exit(runLint(pflag.Args()[1:]))
+	case "render":
+		os.Exit(runRender(pflag.Args()[1:]))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -0,0 +1,236 @@
+package plugins
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// condition like `promotion_price > 0 && promotion_price < price`,
+// written with go expression syntax. identifiers are keys of BindValues,
+// supported operators are ! && || == != < <= > >= + - * /
+type condition struct {
+	src  string
+	expr ast.Expr
+}
+
+func compileCondition(s string) (*condition, error) {
+	expr, err := parser.ParseExpr(s)
+	if err != nil {
+		return nil, fmt.Errorf(`invalid condition "%s": %s`, s, err)
+	}
+
+	if err = checkConditionExpr(expr); err != nil {
+		return nil, fmt.Errorf(`invalid condition "%s": %s`, s, err)
+	}
+	return &condition{src: s, expr: expr}, nil
+}
+
+func checkConditionExpr(expr ast.Expr) error {
+	var err error
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if err != nil || n == nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.ParenExpr, *ast.Ident:
+			return true
+		case *ast.BasicLit:
+			if n.Kind == token.INT || n.Kind == token.FLOAT || n.Kind == token.STRING {
+				return true
+			}
+		case *ast.UnaryExpr:
+			if n.Op == token.NOT || n.Op == token.SUB {
+				return true
+			}
+		case *ast.BinaryExpr:
+			switch n.Op {
+			case token.LAND, token.LOR, token.EQL, token.NEQ, token.LSS, token.LEQ,
+				token.GTR, token.GEQ, token.ADD, token.SUB, token.MUL, token.QUO:
+				return true
+			}
+		}
+		err = &unsupportedExprError{n}
+		return false
+	})
+	return err
+}
+
+type unsupportedExprError struct {
+	node ast.Node
+}
+
+func (e *unsupportedExprError) Error() string {
+	if b, ok := e.node.(*ast.BinaryExpr); ok {
+		return fmt.Sprintf("unsupported operator %s", b.Op)
+	}
+	if u, ok := e.node.(*ast.UnaryExpr); ok {
+		return fmt.Sprintf("unsupported operator %s", u.Op)
+	}
+	return fmt.Sprintf("unsupported expression %T", e.node)
+}
+
+func (c *condition) eval(values BindValues) (bool, error) {
+	v, err := c.evalExpr(c.expr, values)
+	if err != nil {
+		return false, fmt.Errorf(`condition "%s": %s`, c.src, err)
+	}
+	return truthy(v), nil
+}
+
+func (c *condition) evalExpr(node ast.Expr, values BindValues) (interface{}, error) {
+	switch n := node.(type) {
+	case *ast.ParenExpr:
+		return c.evalExpr(n.X, values)
+	case *ast.Ident:
+		switch n.Name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+		return values.Get(n.Name), nil
+	case *ast.BasicLit:
+		switch n.Kind {
+		case token.INT, token.FLOAT:
+			return strconv.ParseFloat(n.Value, 64)
+		case token.STRING:
+			return strconv.Unquote(n.Value)
+		}
+	case *ast.UnaryExpr:
+		x, err := c.evalExpr(n.X, values)
+		if err != nil {
+			return nil, err
+		}
+		switch n.Op {
+		case token.NOT:
+			return !truthy(x), nil
+		case token.SUB:
+			f, ok := toNumber(x)
+			if !ok {
+				return nil, fmt.Errorf("-%v is not a number", x)
+			}
+			return -f, nil
+		}
+	case *ast.BinaryExpr:
+		return c.evalBinary(n, values)
+	}
+	return nil, &unsupportedExprError{node}
+}
+
+func (c *condition) evalBinary(n *ast.BinaryExpr, values BindValues) (interface{}, error) {
+	x, err := c.evalExpr(n.X, values)
+	if err != nil {
+		return nil, err
+	}
+
+	// short circuit
+	switch n.Op {
+	case token.LAND:
+		if !truthy(x) {
+			return false, nil
+		}
+		y, err := c.evalExpr(n.Y, values)
+		return truthy(y), err
+	case token.LOR:
+		if truthy(x) {
+			return true, nil
+		}
+		y, err := c.evalExpr(n.Y, values)
+		return truthy(y), err
+	}
+
+	y, err := c.evalExpr(n.Y, values)
+	if err != nil {
+		return nil, err
+	}
+
+	fx, xok := toNumber(x)
+	fy, yok := toNumber(y)
+	if xok && yok {
+		switch n.Op {
+		case token.EQL:
+			return fx == fy, nil
+		case token.NEQ:
+			return fx != fy, nil
+		case token.LSS:
+			return fx < fy, nil
+		case token.LEQ:
+			return fx <= fy, nil
+		case token.GTR:
+			return fx > fy, nil
+		case token.GEQ:
+			return fx >= fy, nil
+		case token.ADD:
+			return fx + fy, nil
+		case token.SUB:
+			return fx - fy, nil
+		case token.MUL:
+			return fx * fy, nil
+		case token.QUO:
+			if fy == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return fx / fy, nil
+		}
+		return nil, &unsupportedExprError{n}
+	}
+
+	sx, sy := cast.ToString(x), cast.ToString(y)
+	switch n.Op {
+	case token.EQL:
+		return sx == sy, nil
+	case token.NEQ:
+		return sx != sy, nil
+	case token.LSS:
+		return sx < sy, nil
+	case token.LEQ:
+		return sx <= sy, nil
+	case token.GTR:
+		return sx > sy, nil
+	case token.GEQ:
+		return sx >= sy, nil
+	case token.ADD:
+		return sx + sy, nil
+	case token.SUB, token.MUL, token.QUO:
+		return nil, fmt.Errorf("%v %s %v: not numbers", x, n.Op, y)
+	}
+	return nil, &unsupportedExprError{n}
+}
+
+// missing values and empty strings are 0
+func toNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case nil:
+		return 0, true
+	case bool:
+		return 0, false
+	case string:
+		x = strings.TrimSpace(x)
+		if x == "" {
+			return 0, true
+		}
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	f, err := cast.ToFloat64E(v)
+	return f, err == nil
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return x != "" && x != "0" && x != "false"
+	}
+	f, ok := toNumber(v)
+	return ok && f != 0
+}
@@ -0,0 +1,86 @@
+package plugins
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+func TestCondition(t *testing.T) {
+	values := BindValues{
+		"price":           int64(145000),
+		"promotion_price": "125000",
+		"name":            "abc",
+		"empty":           "",
+	}
+
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"promotion_price < price", true},
+		{"promotion_price > 0 && promotion_price < price", true},
+		{"missing > 0 && missing < price", false},
+		{"!(price == promotion_price)", true},
+		{"(price - promotion_price) / price > 0.1", true},
+		{`name == "abc" || missing`, true},
+		{`name != "abc"`, false},
+		{"empty", false},
+		{"!missing", true},
+		{"price", true},
+		{"true && !false", true},
+	}
+	for _, c := range tests {
+		cond, err := compileCondition(c.cond)
+		require.NoError(t, err, c.cond)
+		ok, err := cond.eval(values)
+		require.NoError(t, err, c.cond)
+		require.Equal(t, c.want, ok, c.cond)
+	}
+
+	for _, s := range []string{"price <", "f(price)", "price % 2", "price[0]", "a.b"} {
+		_, err := compileCondition(s)
+		require.Error(t, err, s)
+	}
+
+	cond, err := compileCondition("name - 1 > 0")
+	require.NoError(t, err)
+	_, err = cond.eval(values)
+	require.Error(t, err)
+}
+
+func TestConditionalPlugin(t *testing.T) {
+	ps, err := NewPluginsFromConfig([]map[string]interface{}{
+		{
+			"type":     "text",
+			"fontUri":  "../static/fonts/Roboto-Bold.ttf",
+			"fontSize": 10,
+			"when":     "promotion_price > 0 && promotion_price < price",
+			"binding":  map[string]interface{}{"text": "{{price .price}}"},
+		},
+		{
+			"type":    "qr",
+			"size":    0.5,
+			"when":    "qr",
+			"binding": map[string]interface{}{"text": "qr"},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ps.Configure())
+
+	bound, err := ps.Bind(BindValues{"price": 100, "promotion_price": 90})
+	require.NoError(t, err)
+	require.Len(t, bound, 2)
+	require.IsType(t, &TextPlugin{}, bound[0])
+	require.IsType(t, disabledPlugin{}, bound[1])
+
+	bound, err = ps.Bind(BindValues{"price": 100, "qr": "https://sendo.vn"})
+	require.NoError(t, err)
+	require.IsType(t, disabledPlugin{}, bound[0])
+	require.IsType(t, &QrPlugin{}, bound[1])
+
+	dc := imghelper.InitDrawingContext(100, 100, color.White)
+	require.NoError(t, bound.Execute(dc))
+}
@@ -0,0 +1,197 @@
+package plugins
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"golang.org/x/image/font/basicfont"
+)
+
+// Box is an area in pixels of the rendered image
+type Box struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func newBox(r image.Rectangle) *Box {
+	return &Box{r.Min.X, r.Min.Y, r.Dx(), r.Dy()}
+}
+
+func newFloatBox(x, y, w, h float64) *Box {
+	return &Box{int(math.Floor(x)), int(math.Floor(y)), int(math.Ceil(w)), int(math.Ceil(h))}
+}
+
+// Geometry is where a plugin was drawn, for debug renders
+type Geometry struct {
+	// index in the list of plugins, path of nested plugins
+	// is the index in each level
+	Index int    `json:"index"`
+	Path  []int  `json:"path"`
+	Type  string `json:"type"`
+	Id    string `json:"id,omitempty"`
+	// condition of the plugin is false
+	Disabled bool `json:"disabled,omitempty"`
+	// rect of the plugin
+	Rect *Box `json:"rect,omitempty"`
+	// what was drawn in rect, like the resized image or the text
+	Content *Box `json:"content,omitempty"`
+	// point a plugin is centered on
+	Anchor   *image.Point `json:"anchor,omitempty"`
+	Children []Geometry   `json:"children,omitempty"`
+}
+
+// plugin that knows where it draws on dc
+type geometryPlugin interface {
+	geometry(dc *gg.Context, g *Geometry)
+}
+
+// move and scale geometry drawn on a layer to where the layer is drawn
+func (g *Geometry) transform(dx, dy int, sx, sy float64) {
+	scale := func(b *Box) {
+		if b == nil {
+			return
+		}
+		x, y := float64(b.X)*sx, float64(b.Y)*sy
+		*b = *newFloatBox(x, y, float64(b.Width)*sx, float64(b.Height)*sy)
+		b.X += dx
+		b.Y += dy
+	}
+	scale(g.Rect)
+	scale(g.Content)
+	if g.Anchor != nil {
+		g.Anchor.X = int(float64(g.Anchor.X)*sx) + dx
+		g.Anchor.Y = int(float64(g.Anchor.Y)*sy) + dy
+	}
+	for i := range g.Children {
+		g.Children[i].transform(dx, dy, sx, sy)
+	}
+}
+
+func (g *Geometry) setPath(parent []int) {
+	g.Path = append(append([]int{}, parent...), g.Index)
+	for i := range g.Children {
+		g.Children[i].setPath(g.Path)
+	}
+}
+
+// Geometry of bound plugins executed on dc, in pixels of dc
+func (ps Plugins) Geometry(dc *gg.Context) []Geometry {
+	gs := make([]Geometry, 0, len(ps))
+	for i, p := range ps {
+		g := Geometry{Index: i, Type: p.Type()}
+		if dp, ok := p.(disabledPlugin); ok {
+			p = dp.Plugin
+			g.Disabled = true
+		}
+		if ip, ok := p.(interface{ pluginId() string }); ok {
+			g.Id = ip.pluginId()
+		}
+		if gp, ok := p.(geometryPlugin); ok && !g.Disabled {
+			gp.geometry(dc, &g)
+		}
+		g.setPath(nil)
+		gs = append(gs, g)
+	}
+	return gs
+}
+
+// ExecuteDebug executes plugins on dc, then outlines where each plugin
+// was drawn and labels it with its index and type
+func (ps Plugins) ExecuteDebug(dc *gg.Context) ([]Geometry, error) {
+	if err := ps.Execute(dc); err != nil {
+		return nil, err
+	}
+	gs := ps.Geometry(dc)
+	DrawGeometry(dc, gs)
+	return gs, nil
+}
+
+var debugColors = []color.NRGBA{
+	{230, 25, 75, 255},
+	{60, 180, 75, 255},
+	{0, 130, 200, 255},
+	{245, 130, 48, 255},
+	{145, 30, 180, 255},
+	{240, 50, 230, 255},
+	{0, 128, 128, 255},
+	{128, 128, 0, 255},
+}
+
+// DrawGeometry outlines rects with a line, contents with a dashed
+// line and anchors with a cross, labeled by path and type
+func DrawGeometry(dc *gg.Context, gs []Geometry) {
+	dc.Push()
+	defer dc.Pop()
+	dc.ResetClip()
+	dc.SetFontFace(basicfont.Face7x13)
+	dc.SetLineWidth(1)
+
+	var draw func(gs []Geometry)
+	draw = func(gs []Geometry) {
+		for i := range gs {
+			g := &gs[i]
+			if g.Disabled {
+				continue
+			}
+			drawGeometry(dc, g)
+			draw(g.Children)
+		}
+	}
+	draw(gs)
+}
+
+func drawGeometry(dc *gg.Context, g *Geometry) {
+	// siblings and nesting levels get different colors
+	dc.SetColor(debugColors[(len(g.Path)*3+g.Index)%len(debugColors)])
+
+	var label image.Point
+	switch {
+	case g.Rect != nil:
+		label = image.Point{g.Rect.X, g.Rect.Y}
+	case g.Content != nil:
+		label = image.Point{g.Content.X, g.Content.Y}
+	case g.Anchor != nil:
+		label = *g.Anchor
+	default:
+		return
+	}
+
+	if b := g.Rect; b != nil {
+		dc.SetDash()
+		dc.DrawRectangle(float64(b.X)+0.5, float64(b.Y)+0.5, float64(b.Width-1), float64(b.Height-1))
+		dc.Stroke()
+	}
+	if b := g.Content; b != nil {
+		dc.SetDash(4, 3)
+		dc.DrawRectangle(float64(b.X)+0.5, float64(b.Y)+0.5, float64(b.Width-1), float64(b.Height-1))
+		dc.Stroke()
+		dc.SetDash()
+	}
+	if a := g.Anchor; a != nil {
+		x, y := float64(a.X)+0.5, float64(a.Y)+0.5
+		dc.DrawLine(x-6, y, x+6, y)
+		dc.DrawLine(x, y-6, x, y+6)
+		dc.Stroke()
+	}
+
+	path := make([]string, len(g.Path))
+	for i, n := range g.Path {
+		path[i] = fmt.Sprint(n)
+	}
+	text := fmt.Sprintf("#%s %s", strings.Join(path, "."), g.Type)
+	if g.Id != "" {
+		text += " " + g.Id
+	}
+	w, h := dc.MeasureString(text)
+	x, y := float64(label.X), float64(label.Y)
+	dc.DrawRectangle(x, y, w+4, h+4)
+	dc.Fill()
+	dc.SetColor(color.White)
+	dc.DrawString(text, x+2, y+h+1)
+}
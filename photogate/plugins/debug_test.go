@@ -0,0 +1,64 @@
+package plugins
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+func TestGeometry(t *testing.T) {
+	// configured without loading the image
+	img := &ImagePlugin{
+		Rect:   FRectangle{0, 0, 0.5, 1},
+		HAlign: HALIGN_CENTER,
+		VAlign: VALIGN_MIDDLE,
+		Mode:   MODE_CLIP,
+		_img:   image.NewRGBA(image.Rect(0, 0, 20, 10)),
+	}
+
+	plugins, err := NewPluginsFromConfig([]map[string]interface{}{
+		{"type": "test-fill", "color": "fff", "when": "hidden"},
+		{"type": "group", "id": "badge", "rect": "0.5,0.5,1,1", "plugins": []map[string]interface{}{
+			{"type": "qr", "text": "a", "anchor": "0.5,0.5", "size": 0.5},
+		}},
+		{"type": "grid", "rect": "0.5,0,1,0.5", "binding": map[string]string{"items": "products"},
+			"plugins": []map[string]interface{}{{"type": "test-fill", "color": "000"}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, plugins.Configure())
+	plugins = append(Plugins{img}, plugins...)
+	plugins, err = plugins.Bind(BindValues{"products": []map[string]interface{}{{}, {}, {}, {}}})
+	require.NoError(t, err)
+
+	dc := imghelper.InitDrawingContext(100, 100, color.White)
+	gs, err := plugins.ExecuteDebug(dc)
+	require.NoError(t, err)
+	require.Len(t, gs, 4)
+
+	require.Equal(t, "image", gs[0].Type)
+	require.Equal(t, &Box{0, 0, 50, 100}, gs[0].Rect)
+	require.Equal(t, &Box{0, 38, 50, 25}, gs[0].Content)
+
+	require.True(t, gs[1].Disabled)
+	require.Nil(t, gs[1].Rect)
+
+	require.Equal(t, "badge", gs[2].Id)
+	require.Equal(t, &Box{50, 50, 50, 50}, gs[2].Rect)
+	require.Len(t, gs[2].Children, 1)
+	qr := gs[2].Children[0]
+	require.Equal(t, []int{2, 0}, qr.Path)
+	require.Equal(t, &image.Point{75, 75}, qr.Anchor)
+	require.Equal(t, &Box{63, 63, 25, 25}, qr.Content)
+
+	require.Len(t, gs[3].Children, 4)
+	require.Equal(t, "cell", gs[3].Children[3].Type)
+	require.Equal(t, &Box{75, 25, 25, 25}, gs[3].Children[3].Rect)
+	require.Equal(t, "test-fill", gs[3].Children[3].Children[0].Type)
+	require.Equal(t, []int{3, 3, 0}, gs[3].Children[3].Children[0].Path)
+
+	// rect of the image is outlined
+	require.NotEqual(t, color.RGBA{255, 255, 255, 255}, dc.Image().At(0, 50))
+}
@@ -0,0 +1,90 @@
+package plugins
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+// PluginError locates an error in a list of plugins. errors of children
+// of group and grid plugins are nested PluginErrors
+type PluginError struct {
+	// decode, configure, bind or render
+	Op    string
+	Index int
+	Type  string
+	Id    string
+	// config field of the plugin, empty if unknown
+	Field string
+	Err   error
+}
+
+func (e *PluginError) Error() string {
+	return fmt.Sprintf("%s plugin #%d (%s): %s", e.Op, e.Index, e.Type, e.Err)
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// FieldError is an error about a config field of a plugin
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func fieldErrorf(field string, format string, args ...interface{}) error {
+	return &FieldError{field, fmt.Errorf(format, args...)}
+}
+
+// mapstructure quotes the go name of the field, like
+// "1 error(s) decoding:\n\n* 'FontSize' expected type 'float64'"
+var decodeFieldRx = regexp.MustCompile(`'([^']+)'`)
+
+// FontSize to fontSize, Rect.Right to rect.right
+func configFieldName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, s := range parts {
+		if s != "" {
+			parts[i] = strings.ToLower(s[:1]) + s[1:]
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func newPluginError(op string, i int, p Plugin, err error) *PluginError {
+	pe := &PluginError{Op: op, Index: i, Err: err}
+	if p != nil {
+		pe.Type = p.Type()
+		if ip, ok := p.(interface{ pluginId() string }); ok {
+			pe.Id = ip.pluginId()
+		}
+	}
+
+	// the field is reported by the nested error of a child plugin
+	var child *PluginError
+	var fe *FieldError
+	var me *mapstructure.Error
+	if errors.As(err, &child) {
+		return pe
+	}
+	if errors.As(err, &fe) {
+		pe.Field = fe.Field
+	} else if errors.As(err, &me) && len(me.Errors) > 0 {
+		if m := decodeFieldRx.FindStringSubmatch(me.Errors[0]); m != nil {
+			pe.Field = configFieldName(m[1])
+		}
+	}
+	return pe
+}
@@ -0,0 +1,177 @@
+package plugins
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/spf13/cast"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// functions available in binding expressions, they must not have side effects
+var exprFuncs = template.FuncMap{
+	// formatting
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"title": cases.Title(language.Vietnamese).String,
+	"trim":  strings.TrimSpace,
+	// 1234567 => 1.234.567
+	"number": func(v interface{}) string {
+		return printer.Sprintf("%d", toInt64(v))
+	},
+	// 1234567 => 1.234.567đ
+	"price": func(v interface{}) string {
+		return printer.Sprintf("%dđ", toInt64(v))
+	},
+	"default": func(def, v interface{}) interface{} {
+		if cast.ToString(v) == "" {
+			return def
+		}
+		return v
+	},
+	"truncate": func(n int, v interface{}) string {
+		return utils.Ellipsis(cast.ToString(v), n)
+	},
+
+	// integer math, prices are integer
+	"add": func(a, b interface{}) int64 { return toInt64(a) + toInt64(b) },
+	"sub": func(a, b interface{}) int64 { return toInt64(a) - toInt64(b) },
+	"mul": func(a, b interface{}) int64 { return toInt64(a) * toInt64(b) },
+	"div": func(a, b interface{}) (int64, error) {
+		if toInt64(b) == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return toInt64(a) / toInt64(b), nil
+	},
+	"mod": func(a, b interface{}) (int64, error) {
+		if toInt64(b) == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return toInt64(a) % toInt64(b), nil
+	},
+	// price customer pays: promotion price if there is a promotion
+	"saleprice": func(price, promotionPrice interface{}) int64 {
+		p, pp := toInt64(price), toInt64(promotionPrice)
+		if pp > 0 && (p <= 0 || pp < p) {
+			return pp
+		}
+		return p
+	},
+	// discount of price in percent, rounded
+	"percent": func(price, promotionPrice interface{}) int64 {
+		p, pp := toInt64(price), toInt64(promotionPrice)
+		if p <= 0 || pp <= 0 || pp >= p {
+			return 0
+		}
+		return int64(math.Round(float64(p-pp) * 100 / float64(p)))
+	},
+}
+
+// decimal number from bound value, 0 if invalid. grouped prices like
+// 120.000 are read like price inputs
+func toInt64(v interface{}) int64 {
+	s, ok := v.(string)
+	if !ok {
+		return cast.ToInt64(v)
+	}
+	if n, ok := utils.ParsePrice(s); ok {
+		return n
+	}
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return int64(f)
+}
+
+// binding value which is a text/template instead of a key
+func isBindExpr(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+type bindExpr struct {
+	tmpl *template.Template
+	// keys of BindValues used by the expression
+	keys []string
+}
+
+func compileBindExpr(name, s string) (*bindExpr, error) {
+	tmpl, err := template.New(name).Funcs(exprFuncs).Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &bindExpr{tmpl: tmpl}
+	seen := map[string]bool{}
+	walkFieldNodes(tmpl.Tree.Root, func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			e.keys = append(e.keys, key)
+		}
+	})
+	return e, nil
+}
+
+func (e *bindExpr) eval(values BindValues) (string, error) {
+	// missing keys are empty instead of "<no value>"
+	data := make(BindValues, len(values)+len(e.keys))
+	for _, k := range e.keys {
+		data[k] = ""
+	}
+	for k, v := range values {
+		data[k] = v
+	}
+
+	var sb strings.Builder
+	if err := e.tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// call cb with the first identifier of each field like .price
+func walkFieldNodes(node parse.Node, cb func(string)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			walkFieldNodes(c, cb)
+		}
+	case *parse.ActionNode:
+		walkFieldNodes(n.Pipe, cb)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			walkFieldNodes(c, cb)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			walkFieldNodes(a, cb)
+		}
+	case *parse.FieldNode:
+		cb(n.Ident[0])
+	case *parse.IfNode:
+		walkFieldNodes(n.Pipe, cb)
+		walkFieldNodes(n.List, cb)
+		walkFieldNodes(n.ElseList, cb)
+	case *parse.RangeNode:
+		walkFieldNodes(n.Pipe, cb)
+		walkFieldNodes(n.List, cb)
+		walkFieldNodes(n.ElseList, cb)
+	case *parse.WithNode:
+		walkFieldNodes(n.Pipe, cb)
+		walkFieldNodes(n.List, cb)
+		walkFieldNodes(n.ElseList, cb)
+	}
+}
@@ -0,0 +1,68 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindExpr(t *testing.T) {
+	values := BindValues{
+		"product_name":    "rau cải",
+		"price":           int64(145000),
+		"promotion_price": "125000",
+		"upstream":        "https://media3.scdn.vn",
+		"source":          "img/a.jpg",
+		"grouped_price":   "120.000",
+		"grouped_sale":    "90,000",
+	}
+
+	tests := []struct {
+		expr, want string
+	}{
+		{`{{.product_name | upper}} - giảm {{percent .price .promotion_price}}%`, "RAU CẢI - giảm 14%"},
+		{`{{.upstream}}/{{.source}}`, "https://media3.scdn.vn/img/a.jpg"},
+		{`{{price .price}}`, "145.000đ"},
+		{`{{number (div .promotion_price 1000)}}.`, "125."},
+		{`{{printf "%03d" (mod .price 1000)}}`, "000"},
+		{`{{sub .price .promotion_price | price}}`, "20.000đ"},
+		{`{{.missing | default "none"}}`, "none"},
+		// grouped like price inputs, not decimals
+		{`{{price .grouped_price}}`, "120.000đ"},
+		{`{{saleprice .grouped_price .grouped_sale | price}} -{{percent .grouped_price .grouped_sale}}%`, "90.000đ -25%"},
+		{`{{.product_name | title | truncate 6}}`, "Rau..."},
+	}
+
+	for _, c := range tests {
+		e, err := compileBindExpr("test", c.expr)
+		require.NoError(t, err)
+		s, err := e.eval(values)
+		require.NoError(t, err, c.expr)
+		require.Equal(t, c.want, s, c.expr)
+	}
+
+	e, err := compileBindExpr("test", `{{div .price 0}}`)
+	require.NoError(t, err)
+	_, err = e.eval(values)
+	require.Error(t, err)
+
+	_, err = compileBindExpr("test", `{{.price | nosuchfunc}}`)
+	require.Error(t, err)
+}
+
+func TestBindExprField(t *testing.T) {
+	p := &TextPlugin{
+		BindMapping: BindMapping{Binding: map[string]string{
+			"text": "{{.product_name | upper}}",
+			"x":    "{{mul .index 100}}",
+		}},
+		FontUri:  "../static/fonts/Roboto-Bold.ttf",
+		FontSize: 12,
+	}
+	require.NoError(t, p.Configure())
+
+	b, err := p.Bind(BindValues{"product_name": "abc", "index": 2})
+	require.NoError(t, err)
+	require.Equal(t, "ABC", b.(*TextPlugin).Text)
+	require.EqualValues(t, 200, b.(*TextPlugin).X)
+}
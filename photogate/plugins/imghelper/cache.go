@@ -0,0 +1,172 @@
+package imghelper
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+)
+
+// lookups by kind, decode or resize, and result, hit or miss
+var imageCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "photogate_image_cache_lookups_total",
+	Help: "Lookups of decoded and resized images in the image cache",
+}, []string{"kind", "result"})
+
+var imageCacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "photogate_image_cache_bytes",
+	Help: "Pixel memory of the images in the image cache",
+})
+
+var imageCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "photogate_image_cache_evictions_total",
+	Help: "Images evicted from the image cache",
+})
+
+func init() {
+	// pixel memory of the decoded and resized images kept for reuse
+	// by all templates, 0 to disable
+	viper.SetDefault("imageCache.maxBytes", 256<<20)
+}
+
+type cachedImage struct {
+	key  string
+	img  image.Image
+	size int64
+}
+
+// images by key bounded by their pixel memory, least recently used
+// evicted first
+type imageCache struct {
+	mu    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+	// key of each cached image, to find its resized variants
+	keys map[image.Image]string
+}
+
+var images = newImageCache()
+
+func newImageCache() *imageCache {
+	return &imageCache{
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+		keys:  map[image.Image]string{},
+	}
+}
+
+func (c *imageCache) get(key string) (image.Image, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*cachedImage).img, true
+}
+
+func (c *imageCache) keyOf(img image.Image) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, ok := c.keys[img]
+	return key, ok
+}
+
+// max is read on each add, the config is loaded after init
+func (c *imageCache) add(key string, img image.Image, max int64) {
+	e := &cachedImage{key: key, img: img, size: pixelBytes(img)}
+	if e.size > max {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.keys[img] = key
+	c.size += e.size
+	for c.size > max {
+		old := c.ll.Remove(c.ll.Back()).(*cachedImage)
+		delete(c.items, old.key)
+		delete(c.keys, old.img)
+		c.size -= old.size
+		imageCacheEvictions.Inc()
+	}
+	imageCacheBytes.Set(float64(c.size))
+}
+
+// memory of the pixels of img
+func pixelBytes(img image.Image) int64 {
+	switch m := img.(type) {
+	case *image.RGBA:
+		return int64(len(m.Pix))
+	case *image.NRGBA:
+		return int64(len(m.Pix))
+	case *image.RGBA64:
+		return int64(len(m.Pix))
+	case *image.NRGBA64:
+		return int64(len(m.Pix))
+	case *image.Gray:
+		return int64(len(m.Pix))
+	case *image.Paletted:
+		return int64(len(m.Pix))
+	case *image.CMYK:
+		return int64(len(m.Pix))
+	case *image.YCbCr:
+		return int64(len(m.Y) + len(m.Cb) + len(m.Cr))
+	case *image.NYCbCrA:
+		return int64(len(m.Y) + len(m.Cb) + len(m.Cr) + len(m.A))
+	}
+	s := img.Bounds().Size()
+	return int64(s.X) * int64(s.Y) * 4
+}
+
+// DecodeImage decodes b, or returns the image decoded before from the
+// same content. the image is shared and must not be changed
+func DecodeImage(b []byte) (image.Image, error) {
+	sum := sha256.Sum256(b)
+	key := hex.EncodeToString(sum[:])
+	if img, ok := images.get(key); ok {
+		imageCacheLookups.WithLabelValues("decode", "hit").Inc()
+		return img, nil
+	}
+	imageCacheLookups.WithLabelValues("decode", "miss").Inc()
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	images.add(key, img, viper.GetInt64("imageCache.maxBytes"))
+	return img, nil
+}
+
+// ResizeCached resizes src to w x h with resize, named mode, or returns
+// the variant resized before if src is a cached image. the image is
+// shared and must not be changed
+func ResizeCached(src image.Image, mode string, w, h int, resize func(image.Image, int, int) image.Image) image.Image {
+	srcKey, ok := images.keyOf(src)
+	if !ok {
+		return resize(src, w, h)
+	}
+	key := fmt.Sprintf("%s@%s:%dx%d", srcKey, mode, w, h)
+	if img, ok := images.get(key); ok {
+		imageCacheLookups.WithLabelValues("resize", "hit").Inc()
+		return img
+	}
+	imageCacheLookups.WithLabelValues("resize", "miss").Inc()
+
+	img := resize(src, w, h)
+	images.add(key, img, viper.GetInt64("imageCache.maxBytes"))
+	return img
+}
@@ -0,0 +1,64 @@
+package imghelper
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageCache(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	src.Set(0, 0, color.White)
+	b := Img2pngBuf(src)
+
+	images = newImageCache()
+	defer func() { images = newImageCache() }()
+
+	// decoded once by content
+	img, err := DecodeImage(b)
+	require.NoError(t, err)
+	again, err := DecodeImage(append([]byte{}, b...))
+	require.NoError(t, err)
+	require.True(t, img == again)
+	require.EqualValues(t, 40*20*4, images.size)
+
+	// resized once by mode and size
+	resizes := 0
+	resize := func(img image.Image, w, h int) image.Image {
+		resizes++
+		return ResizeStretch(img, w, h)
+	}
+	small := ResizeCached(img, "stretch", 10, 5, resize)
+	require.Equal(t, image.Pt(10, 5), small.Bounds().Size())
+	require.True(t, small == ResizeCached(img, "stretch", 10, 5, resize))
+	ResizeCached(img, "stretch", 20, 10, resize)
+	require.Equal(t, 2, resizes)
+
+	// images not from the cache are resized each time
+	ResizeCached(src, "stretch", 10, 5, resize)
+	ResizeCached(src, "stretch", 10, 5, resize)
+	require.Equal(t, 4, resizes)
+
+	// least recently used evicted first
+	c := newImageCache()
+	a := image.NewGray(image.Rect(0, 0, 10, 10))
+	c.add("a", a, 250)
+	c.add("b", image.NewGray(image.Rect(0, 0, 10, 10)), 250)
+	c.get("a")
+	c.add("c", image.NewGray(image.Rect(0, 0, 10, 10)), 250)
+	_, ok := c.get("b")
+	require.False(t, ok)
+	_, ok = c.get("a")
+	require.True(t, ok)
+	require.EqualValues(t, 200, c.size)
+	key, ok := c.keyOf(a)
+	require.True(t, ok)
+	require.Equal(t, "a", key)
+
+	// larger than the cache
+	c.add("d", image.NewGray(image.Rect(0, 0, 20, 20)), 250)
+	_, ok = c.get("d")
+	require.False(t, ok)
+}
@@ -0,0 +1,129 @@
+package imghelper
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chai2010/webp"
+)
+
+// Format is an encoding of rendered images
+type Format string
+
+const (
+	FORMAT_JPEG Format = "jpeg"
+	FORMAT_PNG  Format = "png"
+	FORMAT_WEBP Format = "webp"
+)
+
+// preferred when the Accept header ranks formats equally
+var formats = []Format{FORMAT_WEBP, FORMAT_PNG, FORMAT_JPEG}
+
+// ParseFormat parses a format name like jpg, jpeg, png or webp.
+// empty is no format
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "":
+		return "", nil
+	case "jpg", "jpeg":
+		return FORMAT_JPEG, nil
+	case "png":
+		return FORMAT_PNG, nil
+	case "webp":
+		return FORMAT_WEBP, nil
+	}
+	return "", fmt.Errorf("invalid format %s, must be jpeg, png or webp", s)
+}
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Extension is the file name extension of f, without the dot
+func (f Format) Extension() string {
+	if f == FORMAT_JPEG {
+		return "jpg"
+	}
+	return string(f)
+}
+
+func Img2webpBuf(img image.Image) []byte {
+	buf := &bytes.Buffer{}
+	if err := webp.Encode(buf, img, &webp.Options{Quality: 90}); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Encode img in format f, jpeg if f is empty
+func Encode(img image.Image, f Format) []byte {
+	switch f {
+	case FORMAT_PNG:
+		return Img2pngBuf(img)
+	case FORMAT_WEBP:
+		return Img2webpBuf(img)
+	}
+	return Img2jpegBuf(img)
+}
+
+// quality of each media range of an Accept header
+func parseAccept(accept string) map[string]float64 {
+	q := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mt == "" {
+			continue
+		}
+		v := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if f, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					v = f
+				}
+			}
+		}
+		q[mt] = v
+	}
+	return q
+}
+
+// NegotiateFormat picks the format of the format query parameter, else
+// the format the Accept header ranks highest among those it names,
+// else def. Responses should vary on Accept
+func NegotiateFormat(r *http.Request, def Format) (Format, error) {
+	if s := r.URL.Query().Get("format"); s != "" {
+		return ParseFormat(s)
+	}
+
+	accept := parseAccept(r.Header.Get("Accept"))
+	best, bestQ := Format(""), 0.0
+	// the default wins ties
+	for _, f := range append([]Format{def}, formats...) {
+		q, ok := accept[f.ContentType()]
+		if f == FORMAT_JPEG && !ok {
+			q, ok = accept["image/jpg"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	if best != "" {
+		return best, nil
+	}
+
+	// a default refused by the client, like image/png;q=0
+	if q, ok := accept[def.ContentType()]; ok && q == 0 {
+		for _, f := range formats {
+			if q, ok := accept[f.ContentType()]; !ok || q > 0 {
+				return f, nil
+			}
+		}
+	}
+	return def, nil
+}
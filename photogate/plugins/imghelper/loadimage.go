@@ -1,18 +1,17 @@
 package imghelper
 
 import (
-	"bytes"
 	"image"
 
 	"gitlab.sendo.vn/system/photogate/utils"
 )
 
-// load image via static or http
+// load image via static or http, decoded once by content. the image is
+// shared and must not be changed
 func LoadImage(uri string) (image.Image, error) {
 	b, err := utils.SimpleGetFile(uri)
 	if err != nil {
 		return nil, err
 	}
-	img, _, err := image.Decode(bytes.NewReader(b))
-	return img, err
+	return DecodeImage(b)
 }
@@ -0,0 +1,281 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"image"
+	"sort"
+
+	"github.com/fogleman/gg"
+	"github.com/mitchellh/mapstructure"
+)
+
+// LintScope holds the keys of the values a template is rendered with.
+// the scope of a list key is the keys of its items, nil if unknown
+type LintScope map[string]LintScope
+
+// Problem is found by Lint or loading a template
+type Problem struct {
+	// index of the plugin in each level of nested plugins,
+	// empty for a problem of the template
+	Path []int
+	// id of the plugin in each level, empty if it has none
+	Ids []string
+	// config field, like fontUri or binding.text. empty if unknown
+	Field   string
+	Message string
+}
+
+// NewProblem locates the error of loading a template
+func NewProblem(err error) Problem {
+	p := Problem{Message: err.Error()}
+
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) {
+		// without the file name added by loaders
+		p.Message = pluginErr.Error()
+	}
+	for errors.As(err, &pluginErr) {
+		p.Path = append(p.Path, pluginErr.Index)
+		p.Ids = append(p.Ids, pluginErr.Id)
+		p.Field = pluginErr.Field
+		err = pluginErr.Err
+	}
+
+	var me *mapstructure.Error
+	if p.Path == nil && errors.As(err, &me) && len(me.Errors) > 0 {
+		if m := decodeFieldRx.FindStringSubmatch(me.Errors[0]); m != nil {
+			p.Field = configFieldName(m[1])
+		}
+	}
+	return p
+}
+
+// location of a plugin in nested plugins
+type pluginLoc struct {
+	path []int
+	ids  []string
+}
+
+func (l pluginLoc) child(i int, id string) pluginLoc {
+	return pluginLoc{
+		path: append(append([]int{}, l.path...), i),
+		ids:  append(append([]string{}, l.ids...), id),
+	}
+}
+
+func (l pluginLoc) problem(field, format string, args ...interface{}) Problem {
+	return Problem{Path: l.path, Ids: l.ids, Field: field, Message: fmt.Sprintf(format, args...)}
+}
+
+// Lint checks plugins configured for a template rendered at widths with
+// values of scope: keys bound which are not in scope, widths, and plugins
+// drawn outside the image or their group
+func (ps Plugins) Lint(scope LintScope, widths []int, widthHeightRatio float64) []Problem {
+	var problems []Problem
+	ps.lintBindings(pluginLoc{}, scope, &problems)
+
+	seenWidths := map[int]bool{}
+	seenPaths := map[string]bool{}
+	for _, w := range widths {
+		h := int(float64(w) / widthHeightRatio)
+		switch {
+		case w <= 0:
+			problems = append(problems, Problem{Field: "allWidths", Message: fmt.Sprintf("width %d must be positive", w)})
+			continue
+		case seenWidths[w]:
+			problems = append(problems, Problem{Field: "allWidths", Message: fmt.Sprintf("width %d is listed twice", w)})
+			continue
+		case h <= 0:
+			problems = append(problems, Problem{Field: "widthHeightRatio", Message: fmt.Sprintf("height of width %d is 0", w)})
+			continue
+		}
+		seenWidths[w] = true
+
+		var outside []Problem
+		lintGeometry(ps.Geometry(gg.NewContext(w, h)), nil, image.Rect(0, 0, w, h),
+			fmt.Sprintf("the %dx%d image", w, h), &outside)
+		for _, p := range outside {
+			// report a plugin once, at the first width
+			if k := fmt.Sprint(p.Path); !seenPaths[k] {
+				seenPaths[k] = true
+				problems = append(problems, p)
+			}
+		}
+	}
+	return problems
+}
+
+func (m *BindMapping) bindMapping() *BindMapping {
+	return m
+}
+
+// keys of the values used by the condition
+func (c *condition) keys() []string {
+	var keys []string
+	ast.Inspect(c.expr, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name != "true" && id.Name != "false" {
+			keys = append(keys, id.Name)
+		}
+		return true
+	})
+	return keys
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ps Plugins) lintBindings(loc pluginLoc, scope LintScope, problems *[]Problem) {
+	for i, p := range ps {
+		var pl pluginLoc
+		if bp, ok := p.(interface{ bindMapping() *BindMapping }); ok {
+			m := bp.bindMapping()
+			pl = loc.child(i, m.Id)
+
+			for _, field := range sortedKeys(m.Binding) {
+				keys := []string{m.Binding[field]}
+				if e, ok := m._exprs[field]; ok {
+					keys = e.keys
+				}
+				for _, k := range keys {
+					if _, ok := scope[k]; !ok {
+						*problems = append(*problems, pl.problem("binding."+field,
+							`binding %s: key "%s" is never bound`, field, k))
+					}
+				}
+			}
+			if m._when != nil {
+				for _, k := range m._when.keys() {
+					if _, ok := scope[k]; !ok {
+						*problems = append(*problems, pl.problem("when", `when: key "%s" is never bound`, k))
+					}
+				}
+			}
+		} else {
+			pl = loc.child(i, "")
+		}
+
+		switch p := p.(type) {
+		case *GroupPlugin:
+			p.lintChildren(pl, scope, problems)
+		case *GridPlugin:
+			p.lintChildren(pl, scope, problems)
+		}
+	}
+}
+
+// children are bound with the values of scope, see scope
+func (p *GroupPlugin) lintChildren(loc pluginLoc, scope LintScope, problems *[]Problem) {
+	scoped := scope
+	if len(p.Values) > 0 {
+		scoped = make(LintScope, len(scope)+len(p.Values))
+		for k, v := range scope {
+			scoped[k] = v
+		}
+		for _, k := range sortedKeys(p.Values) {
+			key := p.Values[k]
+			if e, ok := p._values[k]; ok {
+				for _, ek := range e.keys {
+					if _, ok := scope[ek]; !ok {
+						*problems = append(*problems, loc.problem("values."+k,
+							`values %s: key "%s" is never bound`, k, ek))
+					}
+				}
+				scoped[k] = nil
+			} else if s, ok := scope[key]; ok {
+				scoped[k] = s
+			} else {
+				*problems = append(*problems, loc.problem("values."+k,
+					`values %s: key "%s" is never bound`, k, key))
+				delete(scoped, k)
+			}
+		}
+	}
+	p._plugins.lintBindings(loc, scoped, problems)
+}
+
+// cells are bound with the values of scope and of an item, see Bind
+func (p *GridPlugin) lintChildren(loc pluginLoc, scope LintScope, problems *[]Problem) {
+	var items LintScope
+	if key, ok := p.Binding["items"]; ok {
+		if _, isExpr := p._exprs["items"]; isExpr {
+			return
+		}
+		// keys of the items are unknown
+		if items = scope[key]; items == nil {
+			return
+		}
+	} else {
+		items = LintScope{}
+		for _, item := range p.Items {
+			for k := range item {
+				items[k] = nil
+			}
+		}
+	}
+
+	cellScope := make(LintScope, len(scope)+len(items)+1)
+	for k, v := range scope {
+		cellScope[k] = v
+	}
+	for k, v := range items {
+		cellScope[k] = v
+	}
+	cellScope["index"] = nil
+	p._cell.lintChildren(loc, cellScope, problems)
+}
+
+// visible area of a plugin, false if unknown
+func (g *Geometry) area() (image.Rectangle, string, bool) {
+	rect := func(b *Box) image.Rectangle {
+		// text without a value still has a position
+		w, h := b.Width, b.Height
+		if w == 0 {
+			w = 1
+		}
+		if h == 0 {
+			h = 1
+		}
+		return image.Rect(b.X, b.Y, b.X+w, b.Y+h)
+	}
+	switch {
+	case g.Rect != nil:
+		return rect(g.Rect), "rect", true
+	case g.Content != nil:
+		return rect(g.Content), "", true
+	case g.Anchor != nil:
+		return image.Rect(g.Anchor.X, g.Anchor.Y, g.Anchor.X+1, g.Anchor.Y+1), "anchor", true
+	}
+	return image.Rectangle{}, "", false
+}
+
+func lintGeometry(gs []Geometry, ids []string, bounds image.Rectangle, parent string, problems *[]Problem) {
+	for i := range gs {
+		g := &gs[i]
+		gids := append(append([]string{}, ids...), g.Id)
+		r, field, ok := g.area()
+		if !ok {
+			continue
+		}
+		if !r.Overlaps(bounds) {
+			*problems = append(*problems, Problem{
+				Path:  g.Path,
+				Ids:   gids,
+				Field: field,
+				Message: fmt.Sprintf("%s is drawn outside %s, at %d,%d size %dx%d",
+					g.Type, parent, r.Min.X, r.Min.Y, r.Dx(), r.Dy()),
+			})
+			continue
+		}
+		if g.Rect != nil {
+			lintGeometry(g.Children, gids, r.Intersect(bounds), "its "+g.Type, problems)
+		}
+	}
+}
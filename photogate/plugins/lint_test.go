@@ -0,0 +1,70 @@
+package plugins
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLint(t *testing.T) {
+	ps, err := NewPluginsFromConfig([]map[string]interface{}{
+		{"type": "qr", "text": "a", "size": 0.5, "when": "price > 0",
+			"binding": map[string]string{"text": "{{.name}} {{.url}}"}},
+		{"type": "group", "id": "badge", "rect": "0.5,0.5,1,1",
+			"values": map[string]string{"title": "name", "label": "{{.code}}"},
+			"plugins": []map[string]interface{}{
+				{"type": "qr", "text": "a", "size": 0.5, "anchor": "2,0.5",
+					"binding": map[string]string{"text": "title", "color": "color"}},
+			}},
+		{"type": "grid", "binding": map[string]string{"items": "products"},
+			"plugins": []map[string]interface{}{
+				{"type": "test-fill", "binding": map[string]string{"color": "{{.color}}{{.index}}"}},
+			}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ps.Configure())
+
+	scope := LintScope{
+		"name":     nil,
+		"price":    nil,
+		"products": LintScope{"image": nil},
+	}
+	problems := ps.Lint(scope, []int{100, 100, 0}, 1)
+	require.Equal(t, []Problem{
+		{[]int{0}, []string{""}, "binding.text", `binding text: key "url" is never bound`},
+		{[]int{1}, []string{"badge"}, "values.label", `values label: key "code" is never bound`},
+		// title is bound from name
+		{[]int{1, 0}, []string{"badge", ""}, "binding.color", `binding color: key "color" is never bound`},
+		// index is bound by the grid
+		{[]int{2, 0}, []string{"", ""}, "binding.color", `binding color: key "color" is never bound`},
+		{[]int{1, 0}, []string{"badge", ""}, "", "qr is drawn outside its group, at 138,63 size 25x25"},
+		{nil, nil, "allWidths", "width 100 is listed twice"},
+		{nil, nil, "allWidths", "width 0 must be positive"},
+	}, problems)
+}
+
+func TestNewProblem(t *testing.T) {
+	_, err := NewPluginsFromConfig([]map[string]interface{}{
+		{"type": "qr", "text": "a", "size": "big"},
+	})
+	p := NewProblem(errors.New("wrapped: " + err.Error()))
+	require.Nil(t, p.Path)
+
+	p = NewProblem(err)
+	require.Equal(t, []int{0}, p.Path)
+	require.Equal(t, "size", p.Field)
+
+	ps, err := NewPluginsFromConfig([]map[string]interface{}{
+		{"type": "qr", "text": "a", "size": 0.5},
+		{"type": "group", "id": "badge", "plugins": []map[string]interface{}{
+			{"type": "qr", "id": "code", "text": "a", "size": 2},
+		}},
+	})
+	require.NoError(t, err)
+	p = NewProblem(ps.Configure())
+	require.Equal(t, []int{1, 0}, p.Path)
+	require.Equal(t, []string{"badge", "code"}, p.Ids)
+	require.Equal(t, "size", p.Field)
+	require.Equal(t, "configure plugin #1 (group): configure plugin #0 (qr): field size must in (0, 1]", p.Message)
+}
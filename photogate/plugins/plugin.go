@@ -3,8 +3,10 @@ package plugins
 import (
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/fogleman/gg"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cast"
 )
@@ -20,6 +22,19 @@ type bindablePlugin interface {
 	Bind(BindValues) (Plugin, error)
 }
 
+type conditionalPlugin interface {
+	enabled(BindValues) (bool, error)
+}
+
+// plugin whose condition is false, skipped by Plugins.Execute
+type disabledPlugin struct {
+	Plugin
+}
+
+func (disabledPlugin) Apply(*gg.Context) error {
+	return nil
+}
+
 type BindValues map[string]interface{}
 
 func (v BindValues) Get(key string) interface{} {
@@ -31,14 +46,202 @@ func (v BindValues) GetString(key string) string {
 }
 
 type BindMapping struct {
+	// name of the plugin, a template extending this one
+	// overrides the plugin by its id
+	Id string
+	// plugin field => key in BindValues, or an expression
+	// like "{{.product_name | upper}}" evaluated with BindValues
 	Binding map[string]string
 	binded  bool
+	// plugin is rendered only when the condition holds, see condition
+	When string
+
+	_exprs map[string]*bindExpr
+	_when  *condition
+}
+
+// plugin fields tagged `bind:"reconfigure"` are used by _configure,
+// binding a new value to them configures the bound copy again
+type reconfigurablePlugin interface {
+	_configure() error
+}
+
+type bindableField struct {
+	// name of struct field
+	name        string
+	reconfigure bool
+}
+
+var bindableFieldsCache sync.Map
+
+// field names are matched case insensitive and without underscores,
+// so both fontSize and font_size are field FontSize
+func normalizeFieldName(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+}
+
+// exported fields of plugin struct t, by normalized name
+func bindableFields(t reflect.Type) map[string]bindableField {
+	if v, ok := bindableFieldsCache.Load(t); ok {
+		return v.(map[string]bindableField)
+	}
+
+	fields := map[string]bindableField{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				if f.Type != reflect.TypeOf(BindMapping{}) {
+					walk(f.Type)
+				}
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			fields[normalizeFieldName(f.Name)] = bindableField{
+				name:        f.Name,
+				reconfigure: f.Tag.Get("bind") == "reconfigure",
+			}
+		}
+	}
+	walk(t)
+
+	bindableFieldsCache.Store(t, fields)
+	return fields
+}
+
+// normalize field names, check they exist in plugin p
+// and compile binding expressions
+func (m *BindMapping) validate(p Plugin) error {
+	fields := bindableFields(reflect.TypeOf(p).Elem())
+
+	binding := make(map[string]string, len(m.Binding))
+	m._exprs = nil
+	for field, key := range m.Binding {
+		name := normalizeFieldName(field)
+		if _, ok := fields[name]; !ok {
+			return fieldErrorf("binding", "binding field %s not found", field)
+		}
+		binding[name] = key
+
+		if isBindExpr(key) {
+			e, err := compileBindExpr(field, key)
+			if err != nil {
+				return &FieldError{"binding", errors.Wrapf(err, "binding field %s", field)}
+			}
+			if m._exprs == nil {
+				m._exprs = map[string]*bindExpr{}
+			}
+			m._exprs[name] = e
+		}
+	}
+	m.Binding = binding
+
+	m._when = nil
+	if m.When != "" {
+		c, err := compileCondition(m.When)
+		if err != nil {
+			return &FieldError{"when", err}
+		}
+		m._when = c
+	}
+	return nil
+}
+
+func (m BindMapping) pluginId() string {
+	return m.Id
+}
+
+// evaluate when condition, true if there is no condition
+func (m BindMapping) enabled(values BindValues) (bool, error) {
+	if m._when == nil {
+		return true, nil
+	}
+	return m._when.eval(values)
+}
+
+func (m BindMapping) isBound(field string) bool {
+	_, ok := m.Binding[normalizeFieldName(field)]
+	return ok
+}
+
+// decode bound values into a copy of plugin p, fields missing from values
+// keep their configured value. return p itself if no field changed
+func (m BindMapping) bind(p Plugin, values BindValues) (Plugin, error) {
+	if len(m.Binding) == 0 {
+		return p, nil
+	}
+	fields := bindableFields(reflect.TypeOf(p).Elem())
+
+	input := make(map[string]interface{}, len(m.Binding))
+	for field, key := range m.Binding {
+		v, ok := values[key]
+		if e, isExpr := m._exprs[field]; isExpr {
+			s, err := e.eval(values)
+			if err != nil {
+				return nil, errors.Wrapf(err, "binding field %s", field)
+			}
+			v, ok = s, true
+		}
+		if !ok {
+			continue
+		}
+		input[fields[field].name] = v
+	}
+
+	orig := reflect.ValueOf(p).Elem()
+	cp := reflect.New(orig.Type())
+	cp.Elem().Set(orig)
+	// decoding into the maps and slices of the template would change
+	// them for every render, bound fields get their own
+	for name := range input {
+		unshare(cp.Elem().FieldByName(name))
+	}
+
+	dec, err := NewStructDecoder(cp.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if err = dec.Decode(input); err != nil {
+		return nil, err
+	}
+
+	changed, reconfigure := false, false
+	for field := range m.Binding {
+		f := fields[field]
+		if !reflect.DeepEqual(orig.FieldByName(f.name).Interface(), cp.Elem().FieldByName(f.name).Interface()) {
+			changed = true
+			reconfigure = reconfigure || f.reconfigure
+		}
+	}
+
+	if !changed {
+		return p, nil
+	}
+
+	newP := cp.Interface().(Plugin)
+	if rp, ok := newP.(reconfigurablePlugin); ok && reconfigure {
+		if err = rp._configure(); err != nil {
+			return nil, err
+		}
+	}
+	return newP, nil
 }
 
-// convert all strings to lowercase
-func (m BindMapping) normalize() {
-	for k, v := range m.Binding {
-		m.Binding[strings.ToLower(k)] = strings.ToLower(v)
+// zero the maps, slices and pointers of v which a shallow copy shares
+// with its original, so that decoding allocates new ones
+func unshare(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr, reflect.Interface:
+		v.Set(reflect.Zero(v.Type()))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				unshare(f)
+			}
+		}
 	}
 }
 
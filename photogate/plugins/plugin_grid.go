@@ -0,0 +1,222 @@
+package plugins
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/fogleman/gg"
+	"github.com/pkg/errors"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+func init() {
+	register(&GridPlugin{})
+}
+
+// GridPlugin lays out one cell per item in rows and columns, each cell is
+// a group of plugins whose values are the item values over the values of
+// the template, plus "index" of the item from 0
+type GridPlugin struct {
+	BindMapping
+
+	Rect FRectangle
+	// usually bound to a list input like products
+	Items []map[string]interface{}
+	// 0 for no limit
+	MaxItems int
+	// 0 for ceil(sqrt(number of items))
+	Columns int
+	// space between cells in pixels
+	Gutter int
+	// size the cell plugins are designed for. when set, cells keep this
+	// ratio and are rendered at this size then scaled to the cell, so the
+	// same cell works for any number of items.
+	// by default cells fill the grid and plugins draw at the cell size
+	CellWidth  int
+	CellHeight int
+	// position of the cells in the grid rect, and of the last row
+	// when it is not full. left, center or right / top, middle or bottom
+	HAlign  H_ALIGN
+	VAlign  V_ALIGN
+	Plugins []map[string]interface{}
+
+	_cell  *GroupPlugin
+	_cells []*GroupPlugin
+}
+
+func (GridPlugin) Type() string {
+	return "grid"
+}
+
+func (p *GridPlugin) Configure() error {
+	if err := p.BindMapping.validate(p); err != nil {
+		return err
+	}
+
+	if p.Rect.Right == 0 {
+		p.Rect.Right = 1
+	}
+	if p.Rect.Bottom == 0 {
+		p.Rect.Bottom = 1
+	}
+	if p.MaxItems < 0 || p.Columns < 0 || p.Gutter < 0 {
+		return errors.New("maxItems, columns and gutter must not be negative")
+	}
+	if (p.CellWidth > 0) != (p.CellHeight > 0) {
+		return fieldErrorf("cellWidth", "cellWidth and cellHeight must be set together")
+	}
+
+	switch p.HAlign {
+	case HALIGN_LEFT, HALIGN_CENTER, HALIGN_RIGHT:
+		// pass
+	case "":
+		p.HAlign = HALIGN_CENTER
+	default:
+		return fieldErrorf("halign", "invalid halign")
+	}
+
+	switch p.VAlign {
+	case VALIGN_TOP, VALIGN_MIDDLE, VALIGN_BOTTOM:
+		// pass
+	case "":
+		p.VAlign = VALIGN_MIDDLE
+	default:
+		return fieldErrorf("valign", "invalid valign")
+	}
+
+	p._cell = &GroupPlugin{Plugins: p.Plugins}
+	return p._cell.Configure()
+}
+
+func (p *GridPlugin) Bind(values BindValues) (Plugin, error) {
+	bp, err := p.BindMapping.bind(p, values)
+	if err != nil {
+		return nil, err
+	}
+
+	g := *bp.(*GridPlugin)
+	items := g.Items
+	if g.MaxItems > 0 && len(items) > g.MaxItems {
+		items = items[:g.MaxItems]
+	}
+
+	g._cells = make([]*GroupPlugin, 0, len(items))
+	for i, item := range items {
+		itemValues := make(BindValues, len(values)+len(item)+1)
+		for k, v := range values {
+			itemValues[k] = v
+		}
+		for k, v := range item {
+			itemValues[k] = v
+		}
+		itemValues["index"] = i
+
+		cell, err := g._cell.Bind(itemValues)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("grid item #%d", i))
+		}
+		g._cells = append(g._cells, cell.(*GroupPlugin))
+	}
+	return &g, nil
+}
+
+// offset of a block aligned in free space
+func alignOffset(free int, start, center bool) int {
+	switch {
+	case start:
+		return 0
+	case center:
+		return free / 2
+	default:
+		return free
+	}
+}
+
+func (p GridPlugin) Apply(dc *gg.Context) error {
+	r := p.Rect.Transform(dc.Width(), dc.Height())
+	for i, cell := range p.layout(r) {
+		if err := p.drawCell(dc, p._cells[i], cell); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("grid item #%d", i))
+		}
+	}
+	return nil
+}
+
+// rect of each cell in r, row by row
+func (p GridPlugin) layout(r image.Rectangle) []image.Rectangle {
+	n := len(p._cells)
+	if n == 0 {
+		return nil
+	}
+
+	cols := p.Columns
+	if cols == 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(n))))
+	}
+	rows := (n + cols - 1) / cols
+
+	cellW := (r.Dx() - (cols-1)*p.Gutter) / cols
+	cellH := (r.Dy() - (rows-1)*p.Gutter) / rows
+	if p.CellWidth > 0 {
+		ratio := float64(p.CellWidth) / float64(p.CellHeight)
+		if float64(cellW)/float64(cellH) > ratio {
+			cellW = int(float64(cellH) * ratio)
+		} else {
+			cellH = int(float64(cellW) / ratio)
+		}
+	}
+	if cellW <= 0 || cellH <= 0 {
+		return nil
+	}
+
+	blockH := rows*cellH + (rows-1)*p.Gutter
+	top := r.Min.Y + alignOffset(r.Dy()-blockH, p.VAlign == VALIGN_TOP, p.VAlign == VALIGN_MIDDLE)
+
+	cells := make([]image.Rectangle, 0, n)
+	for row := 0; row < rows; row++ {
+		count := n - row*cols
+		if count > cols {
+			count = cols
+		}
+		rowW := count*cellW + (count-1)*p.Gutter
+		left := r.Min.X + alignOffset(r.Dx()-rowW, p.HAlign == HALIGN_LEFT, p.HAlign == HALIGN_CENTER)
+		y := top + row*(cellH+p.Gutter)
+
+		for col := 0; col < count; col++ {
+			x := left + col*(cellW+p.Gutter)
+			cells = append(cells, image.Rect(x, y, x+cellW, y+cellH))
+		}
+	}
+	return cells
+}
+
+func (p GridPlugin) drawCell(dc *gg.Context, cell *GroupPlugin, r image.Rectangle) error {
+	if p.CellWidth == 0 {
+		return cell.draw(dc, r)
+	}
+
+	layer := gg.NewContext(p.CellWidth, p.CellHeight)
+	if err := cell.draw(layer, image.Rect(0, 0, p.CellWidth, p.CellHeight)); err != nil {
+		return err
+	}
+	dc.DrawImage(imghelper.ResizeStretch(layer.Image(), r.Dx(), r.Dy()), r.Min.X, r.Min.Y)
+	return nil
+}
+
+func (p GridPlugin) geometry(dc *gg.Context, g *Geometry) {
+	r := p.Rect.Transform(dc.Width(), dc.Height())
+	g.Rect = newBox(r)
+	for i, cell := range p.layout(r) {
+		cg := Geometry{Index: i, Type: "cell"}
+		if p.CellWidth == 0 {
+			p._cells[i].geometryAt(cell, &cg)
+		} else {
+			// drawn at the cell size, then scaled to the cell
+			p._cells[i].geometryAt(image.Rect(0, 0, p.CellWidth, p.CellHeight), &cg)
+			cg.transform(cell.Min.X, cell.Min.Y,
+				float64(cell.Dx())/float64(p.CellWidth), float64(cell.Dy())/float64(p.CellHeight))
+		}
+		g.Children = append(g.Children, cg)
+	}
+}
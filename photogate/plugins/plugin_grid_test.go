@@ -0,0 +1,137 @@
+package plugins
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+func renderGrid(t *testing.T, cfg map[string]interface{}, colors ...string) func(x, y int) color.RGBA {
+	cfg["type"] = "grid"
+	cfg["binding"] = map[string]string{"items": "products"}
+	cfg["plugins"] = []map[string]interface{}{
+		{"type": "test-fill", "binding": map[string]string{"color": "color"}},
+	}
+	plugins, err := NewPluginsFromConfig([]map[string]interface{}{cfg})
+	require.NoError(t, err)
+	require.NoError(t, plugins.Configure())
+
+	items := make([]map[string]interface{}, 0, len(colors))
+	for _, c := range colors {
+		items = append(items, map[string]interface{}{"color": c})
+	}
+	plugins, err = plugins.Bind(BindValues{"products": items})
+	require.NoError(t, err)
+
+	dc := imghelper.InitDrawingContext(100, 100, color.White)
+	require.NoError(t, plugins.Execute(dc))
+	return func(x, y int) color.RGBA {
+		r, g, b, a := dc.Image().At(x, y).RGBA()
+		return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	}
+}
+
+func TestGrid(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	red := color.RGBA{255, 0, 0, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	black := color.RGBA{0, 0, 0, 255}
+
+	t.Run("auto columns", func(t *testing.T) {
+		at := renderGrid(t, map[string]interface{}{}, "f00", "0f0", "00f", "000")
+		require.Equal(t, red, at(25, 25))
+		require.Equal(t, green, at(75, 25))
+		require.Equal(t, blue, at(25, 75))
+		require.Equal(t, black, at(75, 75))
+	})
+
+	t.Run("last row centered", func(t *testing.T) {
+		at := renderGrid(t, map[string]interface{}{"gutter": 10}, "f00", "0f0", "00f")
+		require.Equal(t, red, at(20, 20))
+		require.Equal(t, white, at(50, 20))
+		require.Equal(t, green, at(80, 20))
+		require.Equal(t, white, at(10, 80))
+		require.Equal(t, blue, at(50, 80))
+		require.Equal(t, white, at(90, 80))
+	})
+
+	t.Run("columns and max items", func(t *testing.T) {
+		at := renderGrid(t, map[string]interface{}{"columns": 3, "maxItems": 2, "halign": "left"},
+			"f00", "0f0", "00f")
+		require.Equal(t, red, at(10, 50))
+		require.Equal(t, green, at(50, 50))
+		require.Equal(t, white, at(90, 50))
+	})
+
+	t.Run("cell size", func(t *testing.T) {
+		// 2 cells of ratio 1 in one row are 50x50, in the middle
+		at := renderGrid(t, map[string]interface{}{"cellWidth": 10, "cellHeight": 10}, "f00", "0f0")
+		require.Equal(t, white, at(25, 20))
+		require.Equal(t, red, at(25, 50))
+		require.Equal(t, green, at(75, 50))
+		require.Equal(t, white, at(75, 80))
+	})
+
+	t.Run("no items", func(t *testing.T) {
+		at := renderGrid(t, map[string]interface{}{})
+		require.Equal(t, white, at(50, 50))
+	})
+}
+
+func TestGridItemValues(t *testing.T) {
+	plugins, err := NewPluginsFromConfig([]map[string]interface{}{{
+		"type":    "grid",
+		"items":   []map[string]interface{}{{"n": 1}, {"n": 2}},
+		"columns": 1,
+		"plugins": []map[string]interface{}{{
+			"type":    "test-fill",
+			"when":    "index == 1",
+			"binding": map[string]string{"color": "{{.base}}{{.n}}"},
+		}},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, plugins.Configure())
+
+	plugins, err = plugins.Bind(BindValues{"base": "00"})
+	require.NoError(t, err)
+
+	grid := plugins[0].(*GridPlugin)
+	require.Len(t, grid._cells, 2)
+	require.IsType(t, disabledPlugin{}, grid._cells[0]._plugins[0])
+	require.Equal(t, "002", grid._cells[1]._plugins[0].(*fillPlugin).Color)
+}
+
+func TestGridBindTwice(t *testing.T) {
+	plugins, err := NewPluginsFromConfig([]map[string]interface{}{{
+		"type":    "grid",
+		"binding": map[string]string{"items": "products"},
+		"items":   []map[string]interface{}{{"color": "f00"}},
+		"plugins": []map[string]interface{}{
+			{"type": "test-fill", "binding": map[string]string{"color": "color"}},
+		},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, plugins.Configure())
+	colors := func(values BindValues) []string {
+		bound, err := plugins.Bind(values)
+		require.NoError(t, err)
+		var colors []string
+		for _, cell := range bound[0].(*GridPlugin)._cells {
+			colors = append(colors, cell._plugins[0].(*fillPlugin).Color)
+		}
+		return colors
+	}
+
+	first := []map[string]interface{}{{"color": "0f0"}, {"color": "00f"}}
+	require.Equal(t, []string{"0f0", "00f"}, colors(BindValues{"products": first}))
+	// items of the first render must not stay in the template
+	require.Equal(t, []string{"000"}, colors(BindValues{"products": []map[string]interface{}{{"color": "000"}}}))
+	require.Equal(t, []string{"f00"}, colors(BindValues{}))
+
+	grid := plugins[0].(*GridPlugin)
+	require.Equal(t, []map[string]interface{}{{"color": "f00"}}, grid.Items, "template must not change")
+	require.Empty(t, grid._cells)
+}
@@ -0,0 +1,195 @@
+package plugins
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/fogleman/gg"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	register(&GroupPlugin{})
+}
+
+// GroupPlugin renders child plugins into a layer of its own rect, children
+// position themselves against the layer instead of the whole canvas.
+// the layer is composited back with opacity and clipped to clip
+type GroupPlugin struct {
+	BindMapping
+
+	Rect FRectangle
+	// in (0, 1], default 1
+	Opacity float64
+	// part of the layer which is drawn, relative to the group rect.
+	// default the whole group
+	Clip FRectangle
+	// values seen by children under another name: child key => key in
+	// BindValues or an expression, so the same children can be reused
+	// for several products
+	Values  map[string]string
+	Plugins []map[string]interface{}
+
+	_plugins Plugins
+	_values  map[string]*bindExpr
+}
+
+func (GroupPlugin) Type() string {
+	return "group"
+}
+
+func (p *GroupPlugin) Configure() error {
+	if err := p.BindMapping.validate(p); err != nil {
+		return err
+	}
+
+	if p.Rect.Right == 0 {
+		p.Rect.Right = 1
+	}
+	if p.Rect.Bottom == 0 {
+		p.Rect.Bottom = 1
+	}
+	if p.Clip == (FRectangle{}) {
+		p.Clip = FRectangle{0, 0, 1, 1}
+	}
+	if p.Opacity == 0 {
+		p.Opacity = 1
+	}
+	if p.Opacity < 0 || p.Opacity > 1 {
+		return fieldErrorf("opacity", "opacity %v out of range (0, 1]", p.Opacity)
+	}
+
+	if err := p.compileValues(); err != nil {
+		return err
+	}
+
+	plugins, err := NewPluginsFromConfig(p.Plugins)
+	if err != nil {
+		return err
+	}
+	if err = plugins.Configure(); err != nil {
+		return err
+	}
+	p._plugins = plugins
+	return nil
+}
+
+func (p *GroupPlugin) compileValues() error {
+	p._values = nil
+	for k, key := range p.Values {
+		if !isBindExpr(key) {
+			continue
+		}
+		e, err := compileBindExpr(k, key)
+		if err != nil {
+			return &FieldError{"values", errors.Wrapf(err, "value %s", k)}
+		}
+		if p._values == nil {
+			p._values = map[string]*bindExpr{}
+		}
+		p._values[k] = e
+	}
+	return nil
+}
+
+// values of children: parent values with Values applied
+func (p *GroupPlugin) scope(values BindValues) (BindValues, error) {
+	if len(p.Values) == 0 {
+		return values, nil
+	}
+
+	scoped := make(BindValues, len(values)+len(p.Values))
+	for k, v := range values {
+		scoped[k] = v
+	}
+	for k, key := range p.Values {
+		if e, ok := p._values[k]; ok {
+			s, err := e.eval(values)
+			if err != nil {
+				return nil, errors.Wrapf(err, "value %s", k)
+			}
+			scoped[k] = s
+		} else if v, ok := values[key]; ok {
+			scoped[k] = v
+		} else {
+			// do not leak a parent value with the same name
+			delete(scoped, k)
+		}
+	}
+	return scoped, nil
+}
+
+func (p *GroupPlugin) Bind(values BindValues) (Plugin, error) {
+	bp, err := p.BindMapping.bind(p, values)
+	if err != nil {
+		return nil, err
+	}
+
+	g := *bp.(*GroupPlugin)
+	if bp != p && p.isBound("values") {
+		if err = g.compileValues(); err != nil {
+			return nil, err
+		}
+	}
+	scoped, err := g.scope(values)
+	if err != nil {
+		return nil, err
+	}
+	g._plugins, err = p._plugins.Bind(scoped)
+	if err != nil {
+		return nil, errors.Wrap(err, "group")
+	}
+	return &g, nil
+}
+
+func (p GroupPlugin) Apply(dc *gg.Context) error {
+	return p.draw(dc, p.Rect.Transform(dc.Width(), dc.Height()))
+}
+
+func (p GroupPlugin) geometry(dc *gg.Context, g *Geometry) {
+	p.geometryAt(p.Rect.Transform(dc.Width(), dc.Height()), g)
+}
+
+// geometry of the group drawn at r, see draw
+func (p GroupPlugin) geometryAt(r image.Rectangle, g *Geometry) {
+	g.Rect = newBox(r)
+	if r.Empty() {
+		return
+	}
+
+	g.Children = p._plugins.Geometry(gg.NewContext(r.Dx(), r.Dy()))
+	for i := range g.Children {
+		g.Children[i].transform(r.Min.X, r.Min.Y, 1, 1)
+	}
+}
+
+// render children into a layer of size r and draw it at r
+func (p GroupPlugin) draw(dc *gg.Context, r image.Rectangle) error {
+	if r.Empty() {
+		return nil
+	}
+
+	layer := gg.NewContext(r.Dx(), r.Dy())
+	if err := p._plugins.Execute(layer); err != nil {
+		return errors.Wrap(err, "group")
+	}
+
+	bounds := image.Rect(0, 0, r.Dx(), r.Dy())
+	clip := p.Clip.Transform(r.Dx(), r.Dy()).Intersect(bounds)
+	opacity := math.Max(0, math.Min(1, p.Opacity))
+	if clip == bounds && opacity == 1 {
+		dc.DrawImage(layer.Image(), r.Min.X, r.Min.Y)
+		return nil
+	}
+	if clip.Empty() || opacity == 0 {
+		return nil
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, clip.Dx(), clip.Dy()))
+	mask := image.NewUniform(color.Alpha{uint8(opacity*255 + 0.5)})
+	draw.DrawMask(out, out.Bounds(), layer.Image(), clip.Min, mask, image.Point{}, draw.Src)
+	dc.DrawImage(out, r.Min.X+clip.Min.X, r.Min.Y+clip.Min.Y)
+	return nil
+}
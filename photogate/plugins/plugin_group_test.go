@@ -0,0 +1,164 @@
+package plugins
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/fogleman/gg"
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/plugins/imghelper"
+)
+
+func init() {
+	register(&fillPlugin{})
+}
+
+// fill the whole context with color
+type fillPlugin struct {
+	BindMapping
+
+	Color string
+}
+
+func (fillPlugin) Type() string {
+	return "test-fill"
+}
+
+func (p *fillPlugin) Configure() error {
+	return p.BindMapping.validate(p)
+}
+
+func (p fillPlugin) Apply(dc *gg.Context) error {
+	dc.SetHexColor(p.Color)
+	dc.DrawRectangle(0, 0, float64(dc.Width()), float64(dc.Height()))
+	dc.Fill()
+	return nil
+}
+
+func (p *fillPlugin) Bind(values BindValues) (Plugin, error) {
+	return p.BindMapping.bind(p, values)
+}
+
+func renderGroup(t *testing.T, cfg map[string]interface{}, values BindValues) *gg.Context {
+	cfg["type"] = "group"
+	plugins, err := NewPluginsFromConfig([]map[string]interface{}{cfg})
+	require.NoError(t, err)
+	require.NoError(t, plugins.Configure())
+
+	plugins, err = plugins.Bind(values)
+	require.NoError(t, err)
+
+	dc := imghelper.InitDrawingContext(100, 100, color.White)
+	require.NoError(t, plugins.Execute(dc))
+	return dc
+}
+
+func requireColor(t *testing.T, dc *gg.Context, x, y int, want color.RGBA) {
+	r, g, b, a := dc.Image().At(x, y).RGBA()
+	got := color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+	require.Equal(t, want, got, "pixel %d,%d", x, y)
+}
+
+func TestGroup(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 255}
+	red := color.RGBA{255, 0, 0, 255}
+
+	t.Run("rect", func(t *testing.T) {
+		dc := renderGroup(t, map[string]interface{}{
+			"rect":    "0.5,0.5,1,1",
+			"plugins": []map[string]interface{}{{"type": "test-fill", "color": "f00"}},
+		}, nil)
+		requireColor(t, dc, 25, 25, white)
+		requireColor(t, dc, 49, 75, white)
+		requireColor(t, dc, 50, 50, red)
+		requireColor(t, dc, 99, 99, red)
+	})
+
+	t.Run("clip", func(t *testing.T) {
+		dc := renderGroup(t, map[string]interface{}{
+			"rect":    "0.5,0.5,1,1",
+			"clip":    "0,0,0.5,1",
+			"plugins": []map[string]interface{}{{"type": "test-fill", "color": "f00"}},
+		}, nil)
+		requireColor(t, dc, 60, 60, red)
+		requireColor(t, dc, 80, 60, white)
+	})
+
+	t.Run("opacity", func(t *testing.T) {
+		dc := renderGroup(t, map[string]interface{}{
+			"opacity": 0.5,
+			"plugins": []map[string]interface{}{{"type": "test-fill", "color": "000"}},
+		}, nil)
+		requireColor(t, dc, 50, 50, color.RGBA{127, 127, 127, 255})
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		dc := renderGroup(t, map[string]interface{}{
+			"rect": "0.5,0,1,1",
+			"plugins": []map[string]interface{}{{
+				"type":    "group",
+				"rect":    "0,0.5,1,1",
+				"plugins": []map[string]interface{}{{"type": "test-fill", "color": "f00"}},
+			}},
+		}, nil)
+		requireColor(t, dc, 75, 25, white)
+		requireColor(t, dc, 25, 75, white)
+		requireColor(t, dc, 75, 75, red)
+	})
+
+	t.Run("values", func(t *testing.T) {
+		cfg := func(key string) map[string]interface{} {
+			return map[string]interface{}{
+				"values": map[string]string{"color": key},
+				"plugins": []map[string]interface{}{
+					{"type": "test-fill", "when": `color != ""`, "binding": map[string]string{"color": "color"}},
+				},
+			}
+		}
+		dc := renderGroup(t, cfg("color2"), BindValues{"color": "000", "color2": "f00"})
+		requireColor(t, dc, 50, 50, red)
+
+		// parent color must not leak when color2 is missing
+		dc = renderGroup(t, cfg("color2"), BindValues{"color": "000"})
+		requireColor(t, dc, 50, 50, white)
+
+		dc = renderGroup(t, cfg("{{.r}}00"), BindValues{"r": "f"})
+		requireColor(t, dc, 50, 50, red)
+	})
+
+	t.Run("bound values", func(t *testing.T) {
+		plugins, err := NewPluginsFromConfig([]map[string]interface{}{{
+			"type":    "group",
+			"binding": map[string]string{"values": "vals"},
+			"values":  map[string]string{"other": "x"},
+			"plugins": []map[string]interface{}{
+				{"type": "test-fill", "when": `color != ""`, "binding": map[string]string{"color": "color"}},
+			},
+		}})
+		require.NoError(t, err)
+		require.NoError(t, plugins.Configure())
+		render := func(values BindValues) *gg.Context {
+			bound, err := plugins.Bind(values)
+			require.NoError(t, err)
+			dc := imghelper.InitDrawingContext(100, 100, color.White)
+			require.NoError(t, bound.Execute(dc))
+			return dc
+		}
+
+		dc := render(BindValues{"vals": map[string]interface{}{"color": "c1"}, "c1": "f00", "color": "00f"})
+		requireColor(t, dc, 50, 50, red)
+		// color of the first render must not stay in the template
+		dc = render(BindValues{"vals": map[string]interface{}{"other": "y"}, "color": "00f"})
+		requireColor(t, dc, 50, 50, color.RGBA{0, 0, 255, 255})
+		require.Equal(t, map[string]string{"other": "x"}, plugins[0].(*GroupPlugin).Values)
+	})
+
+	t.Run("invalid child", func(t *testing.T) {
+		plugins, err := NewPluginsFromConfig([]map[string]interface{}{{
+			"type":    "group",
+			"plugins": []map[string]interface{}{{"type": "test-fill", "binding": map[string]string{"unknown": "x"}}},
+		}})
+		require.NoError(t, err)
+		require.Error(t, plugins.Configure())
+	})
+}
@@ -2,7 +2,6 @@ package plugins
 
 import (
 	"errors"
-	"fmt"
 	"image"
 
 	"github.com/fogleman/gg"
@@ -39,16 +38,16 @@ const (
 type ImagePlugin struct {
 	BindMapping
 
-	Image   string
+	Image   string `bind:"reconfigure"`
 	ImgType IMAGE_TYPE
 	Width   int
 	Height  int
 	X       int
 	Y       int
-	Rect    FRectangle
-	Mode    IMAGE_RESIZE_MODE
-	HAlign  H_ALIGN
-	VAlign  V_ALIGN
+	Rect    FRectangle        `bind:"reconfigure"`
+	Mode    IMAGE_RESIZE_MODE `bind:"reconfigure"`
+	HAlign  H_ALIGN           `bind:"reconfigure"`
+	VAlign  V_ALIGN           `bind:"reconfigure"`
 
 	_img image.Image
 }
@@ -60,9 +59,12 @@ func (ImagePlugin) Type() string {
 func (p *ImagePlugin) _configure() error {
 	var err error
 	if p.Image == "" {
-		return fmt.Errorf(`field image is required`)
+		return fieldErrorf("image", `field image is required`)
 	}
 	p._img, err = imghelper.LoadImage(p.Image)
+	if err != nil {
+		err = &FieldError{"image", err}
+	}
 
 	if p.Rect.Right == 0 {
 		p.Rect.Right = 1
@@ -77,7 +79,7 @@ func (p *ImagePlugin) _configure() error {
 	case "":
 		p.HAlign = HALIGN_CENTER
 	default:
-		return errors.New("invalid halign")
+		return fieldErrorf("halign", "invalid halign")
 	}
 
 	switch p.VAlign {
@@ -86,7 +88,7 @@ func (p *ImagePlugin) _configure() error {
 	case "":
 		p.VAlign = VALIGN_MIDDLE
 	default:
-		return errors.New("invalid valign")
+		return fieldErrorf("valign", "invalid valign")
 	}
 
 	switch p.Mode {
@@ -95,16 +97,19 @@ func (p *ImagePlugin) _configure() error {
 	case "":
 		p.Mode = MODE_CLIP
 	default:
-		return errors.New("invalid valign")
+		return fieldErrorf("mode", "invalid mode")
 	}
 
 	return err
 }
 
 func (p *ImagePlugin) Configure() error {
-	p.BindMapping.normalize()
+	if err := p.BindMapping.validate(p); err != nil {
+		return err
+	}
 
-	if len(p.Binding) > 0 {
+	// configured when the image is bound
+	if p.Image == "" && p.isBound("image") {
 		return nil
 	}
 
@@ -165,20 +170,29 @@ func (p ImagePlugin) _get_valign(align V_ALIGN, r image.Rectangle) (int, float64
 	return y, ay
 }
 
-func (p ImagePlugin) Apply(dc *gg.Context) error {
-	r := p.Rect.Transform(dc.Width(), dc.Height())
-
-	img := p._img
+// resized image and the point it is anchored at in r
+func (p ImagePlugin) place(r image.Rectangle) (img image.Image, x, y int, ax, ay float64) {
+	img = p._img
 
 	isCorrectSize := img.Bounds().Dx() == r.Dx() && img.Bounds().Dy() == r.Dy()
 	if !isCorrectSize && p.ImgType == IMAGE_TYPE_PRODUCT {
-		img = _getResizer(p.Mode)(img, p.Width, p.Height) // Resize by w, h configured
+		img = imghelper.ResizeCached(img, string(p.Mode), p.Width, p.Height, _getResizer(p.Mode)) // Resize by w, h configured
 	} else {
-		img = _getResizer(p.Mode)(img, r.Dx(), r.Dy()) // Resize by rect frame
+		img = imghelper.ResizeCached(img, string(p.Mode), r.Dx(), r.Dy(), _getResizer(p.Mode)) // Resize by rect frame
+	}
+
+	x, ax = p._get_halign(p.HAlign, r)
+	y, ay = p._get_valign(p.VAlign, r)
+	return img, x, y, ax, ay
+}
+
+func (p ImagePlugin) Apply(dc *gg.Context) error {
+	if p._img == nil {
+		return errors.New("image is not loaded")
 	}
 
-	x, ax := p._get_halign(p.HAlign, r)
-	y, ay := p._get_valign(p.VAlign, r)
+	r := p.Rect.Transform(dc.Width(), dc.Height())
+	img, x, y, ax, ay := p.place(r)
 
 	dc.MoveTo(float64(r.Min.X), float64(r.Min.Y))
 	dc.LineTo(float64(r.Max.X), float64(r.Min.Y))
@@ -192,26 +206,21 @@ func (p ImagePlugin) Apply(dc *gg.Context) error {
 	return nil
 }
 
-func (p *ImagePlugin) Bind(values BindValues) (Plugin, error) {
-	newP := *p
-
-	changed := false
-	for field, key := range p.Binding {
-		switch field {
-		case "image":
-			newP.Image = values.GetString(key)
-			changed = true
-		}
-	}
-
-	if !changed {
-		return p, nil
+func (p ImagePlugin) geometry(dc *gg.Context, g *Geometry) {
+	r := p.Rect.Transform(dc.Width(), dc.Height())
+	g.Rect = newBox(r)
+	if p._img == nil {
+		return
 	}
 
-	err := newP._configure()
-	if err != nil {
-		return nil, err
-	}
+	// drawn like gg.DrawImageAnchored, clipped by rect
+	img, x, y, ax, ay := p.place(r)
+	s := img.Bounds().Size()
+	x -= int(ax * float64(s.X))
+	y -= int(ay * float64(s.Y))
+	g.Content = &Box{x, y, s.X, s.Y}
+}
 
-	return &newP, nil
+func (p *ImagePlugin) Bind(values BindValues) (Plugin, error) {
+	return p.BindMapping.bind(p, values)
 }
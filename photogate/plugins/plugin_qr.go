@@ -1,8 +1,6 @@
 package plugins
 
 import (
-	"errors"
-	"fmt"
 	"image/color"
 
 	"github.com/fogleman/gg"
@@ -17,9 +15,9 @@ func init() {
 type QrPlugin struct {
 	BindMapping
 
-	Text     string
-	Color    string
-	Recovery qrcode.RecoveryLevel
+	Text     string               `bind:"reconfigure"`
+	Color    string               `bind:"reconfigure"`
+	Recovery qrcode.RecoveryLevel `bind:"reconfigure"`
 
 	Anchor FPoint
 	// (0, 1]
@@ -33,6 +31,10 @@ func (QrPlugin) Type() string {
 }
 
 func (p *QrPlugin) _configure() error {
+	if p.Recovery < qrcode.Low || p.Recovery > qrcode.Highest {
+		return fieldErrorf("recovery", "field recovery must >= %d && <= %d", qrcode.Low, qrcode.Highest)
+	}
+
 	qr, err := qrcode.New(p.Text, p.Recovery)
 	if err != nil {
 		return err
@@ -46,13 +48,12 @@ func (p *QrPlugin) _configure() error {
 }
 
 func (p *QrPlugin) Configure() error {
-	p.BindMapping.normalize()
+	if err := p.BindMapping.validate(p); err != nil {
+		return err
+	}
 
 	if p.Size > 1 || p.Size <= 0 {
-		return errors.New("field size must in (0, 1]")
-	}
-	if p.Recovery < qrcode.Low || p.Recovery > qrcode.Highest {
-		return fmt.Errorf("field recovery must >= %d && <= %d", qrcode.Low, qrcode.Highest)
+		return fieldErrorf("size", "field size must in (0, 1]")
 	}
 
 	if p.Text == "" {
@@ -71,28 +72,17 @@ func (p QrPlugin) Apply(dc *gg.Context) error {
 	return nil
 }
 
-// return a new instance with new text
-// return self if not change
-func (p *QrPlugin) Bind(values BindValues) (Plugin, error) {
-	newP := *p
-
-	changed := false
-	for field, key := range p.Binding {
-		switch field {
-		case "text":
-			newP.Text = values.GetString(key)
-			changed = true
-		}
-	}
-
-	if !changed {
-		return p, nil
+func (p QrPlugin) geometry(dc *gg.Context, g *Geometry) {
+	r := p.Anchor.Transform(dc.Width(), dc.Height())
+	g.Anchor = &r
+	if p._qr == nil {
+		return
 	}
 
-	err := newP._configure()
-	if err != nil {
-		return nil, err
-	}
+	s := p._qr.Image(int(p.Size * float64(dc.Width()))).Bounds().Size()
+	g.Content = &Box{r.X - int(0.5*float64(s.X)), r.Y - int(0.5*float64(s.Y)), s.X, s.Y}
+}
 
-	return &newP, nil
+func (p *QrPlugin) Bind(values BindValues) (Plugin, error) {
+	return p.BindMapping.bind(p, values)
 }
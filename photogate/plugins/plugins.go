@@ -1,11 +1,8 @@
 package plugins
 
 import (
-	"fmt"
-
 	"github.com/fogleman/gg"
 	"github.com/mitchellh/mapstructure"
-	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
@@ -16,6 +13,7 @@ func NewStructDecoder(out interface{}) (*mapstructure.Decoder, error) {
 		WeaklyTypedInput: true,
 		DecodeHook: mapstructure.ComposeDecodeHookFunc(
 			mapstructure.StringToTimeDurationHookFunc(),
+			stringToCoordinatesHookFunc(),
 			mapstructure.StringToSliceHookFunc(","),
 		),
 		TagName: "yaml",
@@ -29,12 +27,14 @@ func NewPluginsFromConfig(configs []map[string]interface{}) (Plugins, error) {
 	for i, m := range configs {
 		t, ok := m["type"].(string)
 		if !ok {
-			return nil, fmt.Errorf("plugins at index %d invalid", i)
+			return nil, newPluginError("decode", i, nil, fieldErrorf("type", "plugins at index %d invalid", i))
 		}
 
 		p := newInstanceOf(t)
 		if p == nil {
-			return nil, fmt.Errorf("plugins type %s not found", t)
+			pe := newPluginError("decode", i, nil, fieldErrorf("type", "plugins type %s not found", t))
+			pe.Type = t
+			return nil, pe
 		}
 
 		dec, err := NewStructDecoder(p)
@@ -43,7 +43,7 @@ func NewPluginsFromConfig(configs []map[string]interface{}) (Plugins, error) {
 		}
 
 		if err = dec.Decode(m); err != nil {
-			return nil, err
+			return nil, newPluginError("decode", i, p, err)
 		}
 		plugins = append(plugins, p)
 	}
@@ -55,16 +55,19 @@ func (ps Plugins) Configure() error {
 	for i, l := range ps {
 		err := l.Configure()
 		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf(`configure plugin #%d (%s)`, i, l.Type()))
+			return newPluginError("configure", i, l, err)
 		}
 	}
 	return nil
 }
 
 func (ps Plugins) Execute(dc *gg.Context) error {
-	for _, p := range ps {
+	for i, p := range ps {
+		if _, ok := p.(disabledPlugin); ok {
+			continue
+		}
 		if err := p.Apply(dc); err != nil {
-			return err
+			return newPluginError("render", i, p, err)
 		}
 	}
 	return nil
@@ -74,6 +77,17 @@ func (ps Plugins) Bind(values BindValues) (Plugins, error) {
 	ps2 := make(Plugins, 0, len(ps))
 
 	for i, p := range ps {
+		if cp, ok := p.(conditionalPlugin); ok {
+			enabled, err := cp.enabled(values)
+			if err != nil {
+				return nil, newPluginError("bind", i, p, err)
+			}
+			if !enabled {
+				ps2 = append(ps2, disabledPlugin{p})
+				continue
+			}
+		}
+
 		if dp, ok := p.(bindablePlugin); ok {
 			log.Debug().
 				Interface("values", values).
@@ -82,7 +96,7 @@ func (ps Plugins) Bind(values BindValues) (Plugins, error) {
 				Msg("bind")
 			binded, err := dp.Bind(values)
 			if err != nil {
-				return nil, err
+				return nil, newPluginError("bind", i, p, err)
 			}
 			ps2 = append(ps2, binded)
 		} else {
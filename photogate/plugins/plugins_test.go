@@ -1,9 +1,11 @@
 package plugins
 
 import (
+	"errors"
 	"image/color"
 	"testing"
 
+	"github.com/fogleman/gg"
 	"github.com/skip2/go-qrcode"
 	"github.com/stretchr/testify/require"
 	"gitlab.sendo.vn/system/photogate/downloader"
@@ -55,3 +57,158 @@ func TestPluginsRender(t *testing.T) {
 	_ = dc
 	// dc.SavePNG("test.png")
 }
+
+func TestBindAnyField(t *testing.T) {
+	p := &TextPlugin{
+		BindMapping: BindMapping{Binding: map[string]string{
+			"text":      "name",
+			"color":     "color",
+			"font_size": "size",
+			"x":         "x",
+		}},
+		FontUri:  "../static/fonts/Roboto-Bold.ttf",
+		FontSize: 12,
+	}
+	require.NoError(t, p.Configure())
+
+	b, err := p.Bind(BindValues{"name": "abc", "color": "#ff0000", "size": "20", "x": 15})
+	require.NoError(t, err)
+	bp := b.(*TextPlugin)
+	require.Equal(t, "abc", bp.Text)
+	require.Equal(t, "#ff0000", bp.Color)
+	require.EqualValues(t, 20, bp.FontSize)
+	require.EqualValues(t, 15, bp.X)
+	require.Same(t, p.font, bp.font, "font is parsed once, faces are created by Apply")
+	require.Empty(t, p.Text, "template must not change")
+
+	b, err = p.Bind(BindValues{"name": "abc", "x": 1})
+	require.NoError(t, err)
+	require.Same(t, p.font, b.(*TextPlugin).font, "font fields not changed")
+
+	b, err = p.Bind(BindValues{"other": 1})
+	require.NoError(t, err)
+	require.Same(t, p, b)
+}
+
+// plugin with fields which a copy shares with the template
+type listPlugin struct {
+	BindMapping
+
+	Tags  []string
+	Attrs map[string]interface{}
+}
+
+func (listPlugin) Type() string {
+	return "test-list"
+}
+
+func (p *listPlugin) Configure() error {
+	return p.BindMapping.validate(p)
+}
+
+func (p listPlugin) Apply(dc *gg.Context) error {
+	return nil
+}
+
+func (p *listPlugin) Bind(values BindValues) (Plugin, error) {
+	return p.BindMapping.bind(p, values)
+}
+
+func TestBindDoesNotChangeTemplate(t *testing.T) {
+	p := &listPlugin{
+		BindMapping: BindMapping{Binding: map[string]string{"tags": "tags", "attrs": "attrs"}},
+		Tags:        []string{"a", "b", "c"},
+		Attrs:       map[string]interface{}{"name": "template"},
+	}
+	require.NoError(t, p.Configure())
+
+	b, err := p.Bind(BindValues{"tags": []string{"x"}, "attrs": map[string]interface{}{"extra": 1}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"x"}, b.(*listPlugin).Tags)
+	require.Equal(t, map[string]interface{}{"extra": 1}, b.(*listPlugin).Attrs)
+
+	b, err = p.Bind(BindValues{"tags": []string{"y", "z"}, "attrs": map[string]interface{}{"name": "second"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"y", "z"}, b.(*listPlugin).Tags)
+	require.Equal(t, map[string]interface{}{"name": "second"}, b.(*listPlugin).Attrs)
+
+	require.Equal(t, []string{"a", "b", "c"}, p.Tags, "template must not change")
+	require.Equal(t, map[string]interface{}{"name": "template"}, p.Attrs, "template must not change")
+
+	// same values as the template
+	b, err = p.Bind(BindValues{"tags": []string{"a", "b", "c"}})
+	require.NoError(t, err)
+	require.Same(t, p, b)
+}
+
+func TestBindCoordinates(t *testing.T) {
+	p := &QrPlugin{
+		BindMapping: BindMapping{Binding: map[string]string{
+			"anchor":   "anchor",
+			"recovery": "recovery",
+		}},
+		Text: "hello",
+		Size: 0.5,
+	}
+	require.NoError(t, p.Configure())
+
+	b, err := p.Bind(BindValues{"anchor": "0.25, 0.75", "recovery": "3"})
+	require.NoError(t, err)
+	bp := b.(*QrPlugin)
+	require.Equal(t, FPoint{0.25, 0.75}, bp.Anchor)
+	require.Equal(t, qrcode.Highest, bp.Recovery)
+	require.NotEqual(t, p._qr, bp._qr)
+
+	_, err = p.Bind(BindValues{"recovery": "9"})
+	require.Error(t, err)
+}
+
+func TestBindUnknownField(t *testing.T) {
+	p := &ImagePlugin{
+		BindMapping: BindMapping{Binding: map[string]string{"picture": "source"}},
+	}
+	require.EqualError(t, p.Configure(), "binding field picture not found")
+}
+
+func TestPluginErrorLocation(t *testing.T) {
+	configure := func(cfg []map[string]interface{}) *PluginError {
+		ps, err := NewPluginsFromConfig(cfg)
+		if err == nil {
+			err = ps.Configure()
+		}
+		var pe *PluginError
+		require.True(t, errors.As(err, &pe), "%v", err)
+		return pe
+	}
+
+	pe := configure([]map[string]interface{}{{"name": "text"}})
+	require.Equal(t, "decode", pe.Op)
+	require.Equal(t, "type", pe.Field)
+
+	pe = configure([]map[string]interface{}{
+		{"type": "qr", "text": "a", "size": 0.5},
+		{"type": "qr", "id": "code", "text": "a", "size": 2},
+	})
+	require.Equal(t, "configure plugin #1 (qr): field size must in (0, 1]", pe.Error())
+	require.Equal(t, 1, pe.Index)
+	require.Equal(t, "code", pe.Id)
+	require.Equal(t, "size", pe.Field)
+
+	pe = configure([]map[string]interface{}{
+		{"type": "qr", "text": "a", "size": "big"},
+	})
+	require.Equal(t, "decode", pe.Op)
+	require.Equal(t, "size", pe.Field)
+
+	pe = configure([]map[string]interface{}{
+		{"type": "group", "plugins": []map[string]interface{}{
+			{"type": "qr", "text": "a", "size": 0.5, "binding": map[string]interface{}{"colour": "c"}},
+		}},
+	})
+	require.Equal(t, "group", pe.Type)
+	require.Empty(t, pe.Field)
+	var child *PluginError
+	require.True(t, errors.As(pe.Err, &child))
+	require.Equal(t, 0, child.Index)
+	require.Equal(t, "binding", child.Field)
+}
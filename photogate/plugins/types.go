@@ -1,13 +1,18 @@
 package plugins
 
 import (
+	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"reflect"
+	"strconv"
+	"strings"
 
 	_ "github.com/chai2010/webp"
 	_ "github.com/jdeng/goheif"
+	"github.com/mitchellh/mapstructure"
 )
 
 type FPoint struct {
@@ -37,3 +42,44 @@ func (r FRectangle) Transform(w, h int) image.Rectangle {
 		int(r.Bottom*float64(h)),
 	)
 }
+
+func parseFloats(s string, n int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf(`"%s" must have %d comma separated numbers`, s, n)
+	}
+	v := make([]float64, n)
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = f
+	}
+	return v, nil
+}
+
+// decode "x,y" to FPoint and "left,top,right,bottom" to FRectangle
+func stringToCoordinatesHookFunc() mapstructure.DecodeHookFuncType {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+
+		switch t {
+		case reflect.TypeOf(FPoint{}):
+			v, err := parseFloats(data.(string), 2)
+			if err != nil {
+				return nil, err
+			}
+			return FPoint{v[0], v[1]}, nil
+		case reflect.TypeOf(FRectangle{}):
+			v, err := parseFloats(data.(string), 4)
+			if err != nil {
+				return nil, err
+			}
+			return FRectangle{v[0], v[1], v[2], v[3]}, nil
+		}
+		return data, nil
+	}
+}
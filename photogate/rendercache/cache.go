@@ -0,0 +1,308 @@
+package rendercache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// lookups by cache and result, memory or disk for a hit, else miss
+var lookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "photogate_render_cache_lookups_total",
+	Help: "Lookups of rendered images in the render cache",
+}, []string{"cache", "result"})
+
+var cacheBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "photogate_render_cache_bytes",
+	Help: "Size of the rendered images in the render cache",
+}, []string{"cache", "tier"})
+
+func init() {
+	// renders kept in memory by each service, 0 to disable
+	viper.SetDefault("renderCache.memoryBytes", 64<<20)
+	// renders are also kept on disk in dir/<service>, empty to disable
+	viper.SetDefault("renderCache.dir", "")
+	viper.SetDefault("renderCache.diskBytes", 1<<30)
+}
+
+// Cache keeps encoded renders by key, in a memory tier and an optional
+// disk tier which survives restarts. both evict the least recently used
+type Cache struct {
+	name string
+
+	mu  sync.Mutex
+	mem *lru
+
+	// empty without a disk tier
+	dir    string
+	diskMu sync.Mutex
+	disk   *lru
+}
+
+// New cache named name in metrics, with renders on disk in dir unless
+// it is empty. renders left in dir by a previous run are kept
+func New(name string, memoryBytes int64, dir string, diskBytes int64) (*Cache, error) {
+	c := &Cache{
+		name: name,
+		mem:  newLRU(memoryBytes),
+		dir:  dir,
+		disk: newLRU(diskBytes),
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// FromConfig is the cache of the service name, configured by renderCache.*
+func FromConfig(name string) (*Cache, error) {
+	dir := viper.GetString("renderCache.dir")
+	if dir != "" {
+		dir = filepath.Join(dir, name)
+	}
+	return New(name, viper.GetInt64("renderCache.memoryBytes"), dir, viper.GetInt64("renderCache.diskBytes"))
+}
+
+// Key of a render of template at version from its normalized inputs
+func Key(template, version string, inputs ...string) string {
+	h := sha256.New()
+	for _, s := range append([]string{template, version}, inputs...) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Version of a template from its config and the version of the files it
+// uses, see utils.AssetsVersion, changed by any change of them
+func Version(config interface{}, assets string) (string, error) {
+	b, err := json.Marshal([]interface{}{config, assets})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Get the render of key
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.mem.get(key)
+	c.mu.Unlock()
+	if ok {
+		lookups.WithLabelValues(c.name, "memory").Inc()
+		return e.data, true
+	}
+
+	if b, template, ok := c.getDisk(key); ok {
+		lookups.WithLabelValues(c.name, "disk").Inc()
+		c.putMemory(&entry{key: key, template: template, size: int64(len(b)), data: b})
+		return b, true
+	}
+
+	lookups.WithLabelValues(c.name, "miss").Inc()
+	return nil, false
+}
+
+// Put the render of key, of template. b must not be changed after.
+// a render on disk is kept, renders of a key are the same
+func (c *Cache) Put(template, key string, b []byte) {
+	c.putMemory(&entry{key: key, template: template, size: int64(len(b)), data: b})
+	if c.dir != "" {
+		c.putDisk(template, key, b, false)
+	}
+}
+
+// Replace is Put for data of a key which changes, like a download
+// revalidated or changed upstream, it is written to disk again
+func (c *Cache) Replace(template, key string, b []byte) {
+	c.putMemory(&entry{key: key, template: template, size: int64(len(b)), data: b})
+	if c.dir != "" {
+		c.putDisk(template, key, b, true)
+	}
+}
+
+// Purge the renders of template, returns how many were removed
+func (c *Cache) Purge(template string) int {
+	keys := map[string]bool{}
+
+	c.mu.Lock()
+	for _, e := range c.mem.purge(template) {
+		keys[e.key] = true
+	}
+	cacheBytes.WithLabelValues(c.name, "memory").Set(float64(c.mem.size))
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		c.diskMu.Lock()
+		removed := c.disk.purge(template)
+		cacheBytes.WithLabelValues(c.name, "disk").Set(float64(c.disk.size))
+		c.diskMu.Unlock()
+
+		for _, e := range removed {
+			keys[e.key] = true
+		}
+		c.removeFiles(removed)
+	}
+	return len(keys)
+}
+
+func (c *Cache) putMemory(e *entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.mem.add(e)
+	cacheBytes.WithLabelValues(c.name, "memory").Set(float64(c.mem.size))
+}
+
+// file of a render on disk, by template so that a purge is one dir
+func (c *Cache) path(template, key string) string {
+	return filepath.Join(c.dir, templateDir(template), key)
+}
+
+func templateDir(template string) string {
+	return hex.EncodeToString([]byte(template))
+}
+
+func (c *Cache) getDisk(key string) ([]byte, string, bool) {
+	if c.dir == "" {
+		return nil, "", false
+	}
+	c.diskMu.Lock()
+	e, ok := c.disk.get(key)
+	c.diskMu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+
+	p := c.path(e.template, key)
+	b, err := os.ReadFile(p)
+	if err != nil {
+		// removed by a purge meanwhile, or from outside
+		c.diskMu.Lock()
+		c.disk.remove(key)
+		c.diskMu.Unlock()
+		return nil, "", false
+	}
+	// recently used after a restart too
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return b, e.template, true
+}
+
+func (c *Cache) putDisk(template, key string, b []byte, replace bool) {
+	if !replace {
+		c.diskMu.Lock()
+		_, ok := c.disk.get(key)
+		c.diskMu.Unlock()
+		if ok {
+			return
+		}
+	}
+
+	p := c.path(template, key)
+	if err := writeFile(p, b); err != nil {
+		log.Error().Err(err).Str("cache", c.name).Msg("write render cache")
+		return
+	}
+
+	c.diskMu.Lock()
+	evicted := c.disk.add(&entry{key: key, template: template, size: int64(len(b))})
+	cacheBytes.WithLabelValues(c.name, "disk").Set(float64(c.disk.size))
+	c.diskMu.Unlock()
+	c.removeFiles(evicted)
+}
+
+// write through a temporary file, readers never see a partial render
+func writeFile(p string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), "*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (c *Cache) removeFiles(es []*entry) {
+	for _, e := range es {
+		if err := os.Remove(c.path(e.template, e.key)); err != nil && !os.IsNotExist(err) {
+			log.Error().Err(err).Str("cache", c.name).Msg("remove render cache")
+		}
+	}
+}
+
+// index the renders of dir, the most recently used by modification time
+func (c *Cache) load() error {
+	type file struct {
+		template, key string
+		size          int64
+		mtime         time.Time
+	}
+	var files []file
+
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		template, err := hex.DecodeString(d.Name())
+		if !d.IsDir() || err != nil {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(c.dir, d.Name()))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			p := filepath.Join(c.dir, d.Name(), e.Name())
+			if strings.HasSuffix(e.Name(), ".tmp") {
+				// left by a crash while writing
+				os.Remove(p)
+				continue
+			}
+			info, err := e.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			files = append(files, file{string(template), e.Name(), info.Size(), info.ModTime()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	var evicted []*entry
+	for _, f := range files {
+		evicted = append(evicted, c.disk.add(&entry{key: f.key, template: f.template, size: f.size})...)
+	}
+	c.removeFiles(evicted)
+	cacheBytes.WithLabelValues(c.name, "disk").Set(float64(c.disk.size))
+	return nil
+}
@@ -0,0 +1,95 @@
+package rendercache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	c, err := New("test", 10, "", 0)
+	require.NoError(t, err)
+
+	c.Put("a", "1", []byte("1234"))
+	c.Put("a", "2", []byte("1234"))
+	b, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, "1234", string(b))
+
+	// 2 is the least recently used
+	c.Put("b", "3", []byte("1234"))
+	_, ok = c.Get("2")
+	require.False(t, ok)
+	_, ok = c.Get("1")
+	require.True(t, ok)
+
+	// larger than the cache
+	c.Put("b", "4", []byte("12345678901"))
+	_, ok = c.Get("4")
+	require.False(t, ok)
+
+	require.Equal(t, 1, c.Purge("a"))
+	_, ok = c.Get("1")
+	require.False(t, ok)
+	_, ok = c.Get("3")
+	require.True(t, ok)
+}
+
+func TestDisk(t *testing.T) {
+	dir := t.TempDir()
+	c, err := New("test", 4, dir, 10)
+	require.NoError(t, err)
+
+	c.Put("a/x", "1", []byte("1234"))
+	c.Put("b", "2", []byte("1234"))
+	// evicted from memory, read from disk
+	b, ok := c.Get("1")
+	require.True(t, ok)
+	require.Equal(t, "1234", string(b))
+
+	// 2 is the least recently used on disk
+	c.Put("b", "3", []byte("1234"))
+	_, ok = c.Get("2")
+	require.False(t, ok)
+	_, err = os.Stat(c.path("b", "2"))
+	require.True(t, os.IsNotExist(err))
+
+	// kept by a restart, a partial write is removed
+	tmp := filepath.Join(dir, templateDir("b"), "x.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("12"), 0644))
+	c, err = New("test", 4, dir, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), c.disk.size)
+	_, err = os.Stat(tmp)
+	require.True(t, os.IsNotExist(err))
+	b, ok = c.Get("3")
+	require.True(t, ok)
+	require.Equal(t, "1234", string(b))
+
+	require.Equal(t, 1, c.Purge("a/x"))
+	_, ok = c.Get("1")
+	require.False(t, ok)
+	_, err = os.Stat(c.path("a/x", "1"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestKey(t *testing.T) {
+	v1, err := Version(map[string]interface{}{"a": 1, "b": []int{2}}, "")
+	require.NoError(t, err)
+	v2, err := Version(map[string]interface{}{"b": []int{2}, "a": 1}, "")
+	require.NoError(t, err)
+	require.Equal(t, v1, v2)
+	v3, err := Version(map[string]interface{}{"a": 1, "b": []int{3}}, "")
+	require.NoError(t, err)
+	require.NotEqual(t, v1, v3)
+	// same config, other files
+	v4, err := Version(map[string]interface{}{"a": 1, "b": []int{2}}, "f00")
+	require.NoError(t, err)
+	require.NotEqual(t, v1, v4)
+
+	require.Equal(t, Key("t", v1, "jpeg", "x"), Key("t", v1, "jpeg", "x"))
+	// inputs are not concatenated
+	require.NotEqual(t, Key("t", v1, "jpeg", "x"), Key("t", v1, "jpegx"))
+}
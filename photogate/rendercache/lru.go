@@ -0,0 +1,78 @@
+package rendercache
+
+import "container/list"
+
+type entry struct {
+	key      string
+	template string
+	size     int64
+	// nil for an entry of the disk tier
+	data []byte
+}
+
+// entries bounded by their total size, least recently used evicted first
+type lru struct {
+	max   int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+func (l *lru) get(key string) (*entry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.ll.MoveToFront(el)
+	return el.Value.(*entry), true
+}
+
+// add e as the most recently used, replacing the entry of its key.
+// returns the evicted entries, e itself if it is larger than max
+func (l *lru) add(e *entry) []*entry {
+	if e.size > l.max {
+		return []*entry{e}
+	}
+	l.remove(e.key)
+	l.items[e.key] = l.ll.PushFront(e)
+	l.size += e.size
+
+	var evicted []*entry
+	for l.size > l.max {
+		evicted = append(evicted, l.removeElement(l.ll.Back()))
+	}
+	return evicted
+}
+
+func (l *lru) remove(key string) *entry {
+	el, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	return l.removeElement(el)
+}
+
+func (l *lru) removeElement(el *list.Element) *entry {
+	e := el.Value.(*entry)
+	l.ll.Remove(el)
+	delete(l.items, e.key)
+	l.size -= e.size
+	return e
+}
+
+// remove the entries of template
+func (l *lru) purge(template string) []*entry {
+	var removed []*entry
+	for el := l.ll.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*entry).template == template {
+			removed = append(removed, l.removeElement(el))
+		}
+		el = next
+	}
+	return removed
+}
@@ -0,0 +1,175 @@
+package templatestore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// FS returns the active versions as files of the static fs layout,
+// <kind dir>/<name>.yaml, and assets at their path
+func (s *Store) FS() fs.FS {
+	return &storeFS{s}
+}
+
+type storeFS struct {
+	s *Store
+}
+
+// kind and name of a template file path, ok is false for other paths
+func templatePath(name string) (kind, tname string, ok bool) {
+	dir, file := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	if !strings.HasSuffix(file, ".yaml") {
+		return "", "", false
+	}
+	for k, d := range kindDirs {
+		if d == dir {
+			return k, strings.TrimSuffix(file, ".yaml"), true
+		}
+	}
+	return "", "", false
+}
+
+func dirKind(name string) (string, bool) {
+	for k, d := range kindDirs {
+		if d == name {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func (f *storeFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if _, ok := dirKind(name); ok || name == "." {
+		entries, err := f.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{info: fileInfo{name: name, dir: true}, entries: entries}, nil
+	}
+
+	if kind, tname, ok := templatePath(name); ok {
+		tv, err := f.s.Get(kind, tname, 0)
+		if err == nil {
+			return newMemFile(name, tv.Content, tv.Ctime), nil
+		}
+		if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrInvalidName) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	a, err := f.s.asset(name)
+	if errors.Is(err, ErrNotFound) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return newMemFile(name, a.Content, a.Ctime), nil
+}
+
+// only the kind dirs are listed, assets are found by path
+func (f *storeFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == "." {
+		var entries []fs.DirEntry
+		for _, d := range []string{"fb-templates", "generic-templates", "qr-templates"} {
+			entries = append(entries, fs.FileInfoToDirEntry(fileInfo{name: d, dir: true}))
+		}
+		return entries, nil
+	}
+
+	kind, ok := dirKind(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	heads, err := f.s.List(kind)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, 0, len(heads))
+	for _, h := range heads {
+		entries = append(entries, fs.FileInfoToDirEntry(fileInfo{
+			name:  h.Name + ".yaml",
+			mtime: h.Mtime,
+		}))
+	}
+	return entries, nil
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	mtime int64
+	dir   bool
+}
+
+func (fi fileInfo) Name() string { return path.Base(fi.name) }
+func (fi fileInfo) Size() int64  { return fi.size }
+func (fi fileInfo) IsDir() bool  { return fi.dir }
+func (fi fileInfo) Sys() interface{} {
+	return nil
+}
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi fileInfo) ModTime() time.Time {
+	return time.Unix(0, fi.mtime*int64(time.Millisecond))
+}
+
+type memFile struct {
+	*bytes.Reader
+	info fileInfo
+}
+
+func newMemFile(name string, b []byte, mtime int64) *memFile {
+	return &memFile{
+		Reader: bytes.NewReader(b),
+		info:   fileInfo{name: name, size: int64(len(b)), mtime: mtime},
+	}
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+type dirFile struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
@@ -0,0 +1,213 @@
+package templatestore
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen"
+	jwtmux "gitlab.sendo.vn/iaas-cc/api-utils/restapi/jwtauthen/mux"
+)
+
+// max size of a template file
+const maxTemplateSize = 1 << 20
+
+type storeService struct {
+	store *Store
+	ir    *mux.Router
+}
+
+// NewService serves the store under /internal/templates
+func NewService(store *Store) *storeService {
+	s := &storeService{store: store}
+	s.ir = s.router()
+	s.ir.Use(
+		jwtmux.NewJwtAuthenticationMiddleware(
+			jwtmux.AllowByFunc(checkAllowedRole),
+			jwtmux.WithCustomClaims(&jwtauthen.XClaims{}),
+		),
+	)
+	return s
+}
+
+// routes without authentication
+func (s *storeService) router() *mux.Router {
+	ir := mux.NewRouter()
+	ir.Methods("GET").Path("/{kind}").HandlerFunc(s.handleList).Name("LIST_TEMPLATES")
+	ir.Methods("GET").Path("/{kind}/{name}").HandlerFunc(s.handleGet).Name("GET_TEMPLATE")
+	ir.Methods("POST").Path("/{kind}/{name}").HandlerFunc(s.handleSave).Name("SAVE_TEMPLATE")
+	ir.Methods("GET").Path("/{kind}/{name}/versions").HandlerFunc(s.handleVersions).Name("GET_VERSIONS")
+	ir.Methods("POST").Path("/{kind}/{name}/versions/{version:[0-9]+}/activate").HandlerFunc(s.handleActivate).Name("ACTIVATE_VERSION")
+	ir.Methods("POST").Path("/{kind}/{name}/rollback").HandlerFunc(s.handleRollback).Name("ROLLBACK_TEMPLATE")
+	return ir
+}
+
+func checkAllowedRole(r *http.Request, c jwtauthen.Claims) bool {
+	route := mux.CurrentRoute(r)
+	switch name := route.GetName(); name {
+	case "LIST_TEMPLATES", "GET_TEMPLATE", "GET_VERSIONS":
+		requireRole := "photogate.template.viewer"
+		requireAdminRole := "photogate.template.admin"
+		return c.ContainRole(requireRole) || c.ContainRole(requireAdminRole)
+	case "SAVE_TEMPLATE", "ACTIVATE_VERSION", "ROLLBACK_TEMPLATE":
+		requireAdminRole := "photogate.template.admin"
+		return c.ContainRole(requireAdminRole)
+	}
+	return false
+}
+
+func (s *storeService) MainHandler() http.Handler {
+	return nil
+}
+
+func (s *storeService) InternalHandler() http.Handler {
+	return s.ir
+}
+
+func respondData(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+func respondError(w http.ResponseWriter, code int, msg string) {
+	respondData(w, code, map[string]string{"error": msg})
+}
+
+func respondStoreError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		respondError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, ErrInvalidKind), errors.Is(err, ErrInvalidName), errors.As(err, &verr):
+		respondError(w, http.StatusBadRequest, err.Error())
+	default:
+		respondError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (s *storeService) handleList(w http.ResponseWriter, r *http.Request) {
+	heads, err := s.store.List(mux.Vars(r)["kind"])
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, heads)
+}
+
+// the active version, or the version of query param version.
+// raw=1 returns the yaml content only
+func (s *storeService) handleGet(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil || version < 1 {
+			respondError(w, http.StatusBadRequest, "invalid version")
+			return
+		}
+	}
+
+	tv, err := s.store.Get(vars["kind"], vars["name"], version)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	if r.URL.Query().Get("raw") == "1" {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(tv.Content)
+		return
+	}
+	respondData(w, http.StatusOK, map[string]interface{}{
+		"version": tv.Version,
+		"comment": tv.Comment,
+		"ctime":   tv.Ctime,
+		"content": string(tv.Content),
+	})
+}
+
+// body is the yaml template. query params: comment, and activate which
+// is true by default
+func (s *storeService) handleSave(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	activate := true
+	if v := query.Get("activate"); v != "" {
+		var err error
+		if activate, err = strconv.ParseBool(v); err != nil {
+			respondError(w, http.StatusBadRequest, "invalid activate")
+			return
+		}
+	}
+
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxTemplateSize+1))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(b) == 0 || len(b) > maxTemplateSize {
+		respondError(w, http.StatusBadRequest, "template must be 1 byte to 1MB")
+		return
+	}
+
+	tv, err := s.store.Save(vars["kind"], vars["name"], b, query.Get("comment"), activate)
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, map[string]interface{}{
+		"version": tv.Version,
+		"active":  activate,
+	})
+}
+
+func (s *storeService) handleVersions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tvs, err := s.store.Versions(vars["kind"], vars["name"])
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	head, err := s.store.head(vars["kind"], vars["name"])
+	active := 0
+	if err == nil {
+		active = head.Version
+	} else if !errors.Is(err, ErrNotFound) {
+		respondStoreError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, map[string]interface{}{
+		"active":   active,
+		"versions": tvs,
+	})
+}
+
+func (s *storeService) handleActivate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil || version < 1 {
+		respondError(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+	if err = s.store.Activate(vars["kind"], vars["name"], version); err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, map[string]interface{}{"active": version})
+}
+
+func (s *storeService) handleRollback(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	version, err := s.store.Rollback(vars["kind"], vars["name"])
+	if err != nil {
+		respondStoreError(w, err)
+		return
+	}
+	respondData(w, http.StatusOK, map[string]interface{}{"active": version})
+}
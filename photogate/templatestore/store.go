@@ -0,0 +1,378 @@
+package templatestore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// kind of template => dir of its files in the static fs
+var kindDirs = map[string]string{
+	"fb":      "fb-templates",
+	"generic": "generic-templates",
+	"qr":      "qr-templates",
+}
+
+var nameRx = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,100}$`)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrInvalidKind = errors.New("invalid kind of template")
+	ErrInvalidName = errors.New("invalid template name")
+)
+
+// template content was rejected by the validator of its kind
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid template: " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// a saved template, never changed once created
+type TemplateVersion struct {
+	ID      uint64 `gorm:"primarykey"`
+	Kind    string `gorm:"size:20;uniqueIndex:idx_template_version"`
+	Name    string `gorm:"size:100;uniqueIndex:idx_template_version"`
+	Version int    `gorm:"uniqueIndex:idx_template_version"`
+	Content []byte `gorm:"type:longblob" json:",omitempty"`
+	Comment string `gorm:"size:500"`
+	Ctime   int64
+}
+
+// the version of a template which is served
+type TemplateHead struct {
+	Kind    string `gorm:"primaryKey;size:20"`
+	Name    string `gorm:"primaryKey;size:100"`
+	Version int
+	Mtime   int64
+}
+
+// file used by templates like a frame image, path is relative to
+// the static fs. never changed once created
+type TemplateAsset struct {
+	Path    string `gorm:"primaryKey;size:200"`
+	Content []byte `gorm:"type:longblob"`
+	Ctime   int64
+}
+
+// validate content of a template of some kind before it is saved
+type Validator func(name string, content []byte) error
+
+type Store struct {
+	db *gorm.DB
+
+	mu         sync.RWMutex
+	validators map[string]Validator
+	onChange   []func()
+}
+
+func New(db *gorm.DB) (*Store, error) {
+	if err := db.AutoMigrate(&TemplateVersion{}, &TemplateHead{}, &TemplateAsset{}); err != nil {
+		return nil, err
+	}
+	return &Store{
+		db:         db,
+		validators: map[string]Validator{},
+	}, nil
+}
+
+func (s *Store) SetValidator(kind string, v Validator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.validators[kind] = v
+}
+
+// f is called after the active version of a template changed
+func (s *Store) OnChange(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, f)
+}
+
+func (s *Store) notify() {
+	s.mu.RLock()
+	fs := s.onChange
+	s.mu.RUnlock()
+	for _, f := range fs {
+		f()
+	}
+}
+
+// CheckName returns the error Save would return for the kind and name
+func CheckName(kind, name string) error {
+	return checkKindName(kind, name)
+}
+
+func checkKindName(kind, name string) error {
+	if _, ok := kindDirs[kind]; !ok {
+		return ErrInvalidKind
+	}
+	if !nameRx.MatchString(name) {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+func (s *Store) validate(kind, name string, content []byte) error {
+	s.mu.RLock()
+	v := s.validators[kind]
+	s.mu.RUnlock()
+	if v == nil {
+		return nil
+	}
+	if err := v(name, content); err != nil {
+		return &ValidationError{err}
+	}
+	return nil
+}
+
+// Save creates a new version of the template, which is served
+// when activate is true
+func (s *Store) Save(kind, name string, content []byte, comment string, activate bool) (*TemplateVersion, error) {
+	if err := checkKindName(kind, name); err != nil {
+		return nil, err
+	}
+	if err := s.validate(kind, name, content); err != nil {
+		return nil, err
+	}
+
+	tv := &TemplateVersion{
+		Kind:    kind,
+		Name:    name,
+		Content: content,
+		Comment: comment,
+		Ctime:   utils.MakeTimestamp(),
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var last int
+		err := tx.Model(&TemplateVersion{}).
+			Where(map[string]interface{}{"Kind": kind, "Name": name}).
+			Select("COALESCE(MAX(version), 0)").
+			Scan(&last).
+			Error
+		if err != nil {
+			return err
+		}
+
+		tv.Version = last + 1
+		if err = tx.Create(tv).Error; err != nil {
+			return err
+		}
+		if activate {
+			return setHead(tx, kind, name, tv.Version)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if activate {
+		s.notify()
+	}
+	return tv, nil
+}
+
+func setHead(tx *gorm.DB, kind, name string, version int) error {
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&TemplateHead{
+		Kind:    kind,
+		Name:    name,
+		Version: version,
+		Mtime:   utils.MakeTimestamp(),
+	}).Error
+}
+
+// Get returns a version of the template, the active one if version is 0
+func (s *Store) Get(kind, name string, version int) (*TemplateVersion, error) {
+	if err := checkKindName(kind, name); err != nil {
+		return nil, err
+	}
+
+	if version == 0 {
+		head, err := s.head(kind, name)
+		if err != nil {
+			return nil, err
+		}
+		version = head.Version
+	}
+
+	var tv TemplateVersion
+	res := s.db.Where(map[string]interface{}{"Kind": kind, "Name": name, "Version": version}).
+		Limit(1).
+		Find(&tv)
+	return &tv, found(res)
+}
+
+// Find instead of Take as gorm logs every record not found, and the
+// static fs looks up the store before other dirs
+func found(res *gorm.DB) error {
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *Store) head(kind, name string) (*TemplateHead, error) {
+	var head TemplateHead
+	res := s.db.Where(map[string]interface{}{"Kind": kind, "Name": name}).Limit(1).Find(&head)
+	return &head, found(res)
+}
+
+// List returns the active version of templates of kind
+func (s *Store) List(kind string) ([]TemplateHead, error) {
+	if _, ok := kindDirs[kind]; !ok {
+		return nil, ErrInvalidKind
+	}
+	var heads []TemplateHead
+	err := s.db.Where(map[string]interface{}{"Kind": kind}).Order("name").Find(&heads).Error
+	return heads, err
+}
+
+// Versions returns versions of the template without their content, newest first
+func (s *Store) Versions(kind, name string) ([]TemplateVersion, error) {
+	if err := checkKindName(kind, name); err != nil {
+		return nil, err
+	}
+	var tvs []TemplateVersion
+	err := s.db.Select("id", "kind", "name", "version", "comment", "ctime").
+		Where(map[string]interface{}{"Kind": kind, "Name": name}).
+		Order("version desc").
+		Find(&tvs).
+		Error
+	if err == nil && len(tvs) == 0 {
+		return nil, ErrNotFound
+	}
+	return tvs, err
+}
+
+// Activate serves the version of the template, it is validated again
+// as templates it extends may have changed
+func (s *Store) Activate(kind, name string, version int) error {
+	tv, err := s.Get(kind, name, version)
+	if err != nil {
+		return err
+	}
+	if err = s.validate(kind, name, tv.Content); err != nil {
+		return err
+	}
+	if err = setHead(s.db, kind, name, tv.Version); err != nil {
+		return err
+	}
+	s.notify()
+	return nil
+}
+
+// Rollback activates the newest version older than the active one
+func (s *Store) Rollback(kind, name string) (int, error) {
+	if err := checkKindName(kind, name); err != nil {
+		return 0, err
+	}
+	head, err := s.head(kind, name)
+	if err != nil {
+		return 0, err
+	}
+
+	var prev TemplateVersion
+	err = found(s.db.Select("version").
+		Where(map[string]interface{}{"Kind": kind, "Name": name}).
+		Where("version < ?", head.Version).
+		Order("version desc").
+		Limit(1).
+		Find(&prev))
+	if errors.Is(err, ErrNotFound) {
+		return 0, fmt.Errorf("version %d is the oldest: %w", head.Version, ErrNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return prev.Version, s.Activate(kind, name, prev.Version)
+}
+
+// Delete stops serving the template, its versions are kept and one
+// can be activated again
+func (s *Store) Delete(kind, name string) error {
+	if err := checkKindName(kind, name); err != nil {
+		return err
+	}
+	res := s.db.Where(map[string]interface{}{"Kind": kind, "Name": name}).Delete(&TemplateHead{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	s.notify()
+	return nil
+}
+
+// PutAsset stores a file used by templates, an existing path is an error
+func (s *Store) PutAsset(path string, content []byte) error {
+	return s.db.Create(&TemplateAsset{
+		Path:    path,
+		Content: content,
+		Ctime:   utils.MakeTimestamp(),
+	}).Error
+}
+
+func (s *Store) asset(path string) (*TemplateAsset, error) {
+	var a TemplateAsset
+	res := s.db.Where(map[string]interface{}{"Path": path}).Limit(1).Find(&a)
+	return &a, found(res)
+}
+
+// number and last change of active versions, to notice changes
+// made by other instances
+func (s *Store) headsState() (string, error) {
+	var st struct {
+		N     int64
+		Mtime int64
+	}
+	err := s.db.Model(&TemplateHead{}).
+		Select("COUNT(*) AS n, COALESCE(MAX(mtime), 0) AS mtime").
+		Scan(&st).
+		Error
+	return fmt.Sprintf("%d/%d", st.N, st.Mtime), err
+}
+
+// Poll calls the OnChange functions when other instances change active
+// versions, until stop is closed
+func (s *Store) Poll(interval time.Duration, stop <-chan struct{}) {
+	last, _ := s.headsState()
+	t := time.NewTicker(interval)
+	go func() {
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				st, err := s.headsState()
+				if err != nil {
+					log.Error().Err(err).Msg("poll template store")
+					continue
+				}
+				if st != last {
+					last = st
+					s.notify()
+				}
+			}
+		}
+	}()
+}
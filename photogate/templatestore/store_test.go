@@ -0,0 +1,164 @@
+package templatestore
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.sendo.vn/system/photogate/utils"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestStore(t *testing.T) *Store {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	s, err := New(db)
+	require.NoError(t, err)
+	return s
+}
+
+func TestStoreVersions(t *testing.T) {
+	s := newTestStore(t)
+	changes := 0
+	s.OnChange(func() { changes++ })
+
+	tv, err := s.Save("generic", "hello", []byte("v1"), "first", true)
+	require.NoError(t, err)
+	require.Equal(t, 1, tv.Version)
+	tv, err = s.Save("generic", "hello", []byte("v2"), "", false)
+	require.NoError(t, err)
+	require.Equal(t, 2, tv.Version)
+	require.Equal(t, 1, changes)
+
+	tv, err = s.Get("generic", "hello", 0)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(tv.Content))
+	require.Equal(t, "first", tv.Comment)
+
+	require.NoError(t, s.Activate("generic", "hello", 2))
+	tv, err = s.Get("generic", "hello", 0)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(tv.Content))
+	require.Equal(t, 2, changes)
+
+	tvs, err := s.Versions("generic", "hello")
+	require.NoError(t, err)
+	require.Len(t, tvs, 2)
+	require.Equal(t, 2, tvs[0].Version)
+	require.Nil(t, tvs[0].Content)
+
+	v, err := s.Rollback("generic", "hello")
+	require.NoError(t, err)
+	require.Equal(t, 1, v)
+	_, err = s.Rollback("generic", "hello")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	heads, err := s.List("generic")
+	require.NoError(t, err)
+	require.Len(t, heads, 1)
+	require.Equal(t, 1, heads[0].Version)
+
+	_, err = s.Get("generic", "other", 0)
+	require.True(t, errors.Is(err, ErrNotFound))
+	require.Error(t, s.Activate("generic", "hello", 3))
+	_, err = s.Save("generic", "../x", []byte("x"), "", true)
+	require.Equal(t, ErrInvalidName, err)
+	_, err = s.Save("pdf", "x", []byte("x"), "", true)
+	require.Equal(t, ErrInvalidKind, err)
+}
+
+func TestStoreValidator(t *testing.T) {
+	s := newTestStore(t)
+	s.SetValidator("qr", func(name string, b []byte) error {
+		if strings.Contains(string(b), "bad") {
+			return errors.New("bad template")
+		}
+		return nil
+	})
+
+	_, err := s.Save("qr", "hello", []byte("bad"), "", true)
+	var verr *ValidationError
+	require.True(t, errors.As(err, &verr))
+	_, err = s.Versions("qr", "hello")
+	require.True(t, errors.Is(err, ErrNotFound))
+
+	_, err = s.Save("qr", "hello", []byte("good"), "", true)
+	require.NoError(t, err)
+	_, err = s.Save("generic", "hello", []byte("bad"), "", true)
+	require.NoError(t, err)
+}
+
+func TestStoreFS(t *testing.T) {
+	s := newTestStore(t)
+	_, err := s.Save("qr", "hello", []byte("v1"), "", true)
+	require.NoError(t, err)
+	_, err = s.Save("qr", "draft", []byte("v1"), "", false)
+	require.NoError(t, err)
+	require.NoError(t, s.PutAsset("123/frame.png", []byte("png")))
+	require.Error(t, s.PutAsset("123/frame.png", []byte("png")))
+
+	b, err := fs.ReadFile(s.FS(), "123/frame.png")
+	require.NoError(t, err)
+	require.Equal(t, "png", string(b))
+
+	static := fstest.MapFS{
+		"qr-templates/hello.yaml":   &fstest.MapFile{Data: []byte("static")},
+		"qr-templates/default.yaml": &fstest.MapFile{Data: []byte("default")},
+	}
+	fsys := utils.NewOverlayFS(s.FS(), static)
+
+	b, err = fs.ReadFile(fsys, "qr-templates/hello.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(b))
+	b, err = fs.ReadFile(fsys, "qr-templates/default.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "default", string(b))
+	_, err = fs.ReadFile(fsys, "qr-templates/draft.yaml")
+	require.True(t, errors.Is(err, fs.ErrNotExist))
+
+	entries, err := fs.ReadDir(fsys, "qr-templates")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
+
+func TestStoreService(t *testing.T) {
+	s := newTestStore(t)
+	r := (&storeService{store: s}).router()
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w
+	}
+
+	w := do(http.MethodPost, "/generic/hello?comment=first", "v1")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"version":1,"active":true}`, w.Body.String())
+	w = do(http.MethodPost, "/generic/hello?activate=false", "v2")
+	require.JSONEq(t, `{"version":2,"active":false}`, w.Body.String())
+
+	w = do(http.MethodGet, "/generic/hello?raw=1", "")
+	require.Equal(t, "v1", w.Body.String())
+	w = do(http.MethodGet, "/generic/hello?version=2&raw=1", "")
+	require.Equal(t, "v2", w.Body.String())
+
+	w = do(http.MethodPost, "/generic/hello/versions/2/activate", "")
+	require.JSONEq(t, `{"active":2}`, w.Body.String())
+	w = do(http.MethodPost, "/generic/hello/rollback", "")
+	require.JSONEq(t, `{"active":1}`, w.Body.String())
+
+	w = do(http.MethodGet, "/generic/hello/versions", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), `"active":1`)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/generic/other", "").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/pdf", "").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/generic/hello", "").Code)
+}
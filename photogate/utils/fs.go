@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"errors"
 	"io/fs"
 	"path/filepath"
 	"regexp"
+	"sort"
 )
 
 func ScanFileMatch(targetFs fs.FS, rootDir string, r *regexp.Regexp, cb func(string, string, []byte) error) error {
@@ -29,3 +31,49 @@ func ScanFileMatch(targetFs fs.FS, rootDir string, r *regexp.Regexp, cb func(str
 
 	return nil
 }
+
+// NewOverlayFS returns a fs where files of upper hide files with the same
+// path in lower, directories list the files of both
+func NewOverlayFS(upper, lower fs.FS) fs.FS {
+	return &overlayFS{upper, lower}
+}
+
+type overlayFS struct {
+	upper fs.FS
+	lower fs.FS
+}
+
+func (o *overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	if err == nil {
+		return f, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return o.lower.Open(name)
+}
+
+func (o *overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, uerr := fs.ReadDir(o.upper, name)
+	lower, lerr := fs.ReadDir(o.lower, name)
+	if uerr != nil && lerr != nil {
+		return nil, lerr
+	}
+
+	seen := make(map[string]bool, len(upper))
+	entries := make([]fs.DirEntry, 0, len(upper)+len(lower))
+	for _, de := range upper {
+		seen[de.Name()] = true
+		entries = append(entries, de)
+	}
+	for _, de := range lower {
+		if !seen[de.Name()] {
+			entries = append(entries, de)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
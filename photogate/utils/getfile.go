@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/fs"
 	"net/http"
@@ -8,6 +11,7 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,6 +29,10 @@ var (
 
 	GetNotFound   = errors.New("file not found")
 	UpstreamError = errors.New("upstream error")
+
+	// file:// uris are read only by command line tools,
+	// the service never reads local files
+	fileSchemeAllowed bool
 )
 
 func init() {
@@ -36,6 +44,15 @@ func Init(fs fs.FS) {
 	staticFs = fs
 }
 
+// AllowFileScheme lets SimpleGetFile read file:// uris
+func AllowFileScheme() {
+	fileSchemeAllowed = true
+}
+
+func FileSchemeAllowed() bool {
+	return fileSchemeAllowed
+}
+
 func SimpleGetFile(uri string) ([]byte, error) {
 	u, err := url.Parse(uri)
 	if err != nil {
@@ -47,9 +64,105 @@ func SimpleGetFile(uri string) ([]byte, error) {
 	} else if u.Scheme == "local" {
 		p := path.Join(staticRoot, u.Path)
 		return os.ReadFile(p)
+	} else if u.Scheme == "file" {
+		if !fileSchemeAllowed {
+			return nil, fmt.Errorf(`file uri "%s" is not allowed`, uri)
+		}
+		return os.ReadFile(u.Path)
 	} else if staticFs != nil {
 		return fs.ReadFile(staticFs, strings.TrimPrefix(uri, "/"))
 	} else {
 		return nil, fmt.Errorf(`unknown how to get "%s"`, uri)
 	}
 }
+
+// AssetsVersion is a hash of the content of the static files named by the
+// string values of config, like the frames and fonts of plugins, and their
+// latest modification time. templates have it in their version, so that
+// their renders change with these files
+func AssetsVersion(config interface{}) (string, time.Time) {
+	var v interface{}
+	if b, err := json.Marshal(config); err == nil {
+		json.Unmarshal(b, &v)
+	}
+
+	sums := map[string]string{}
+	var mtime time.Time
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		case string:
+			if _, ok := sums[v]; ok {
+				return
+			}
+			b, t, ok := readStaticFile(v)
+			if !ok {
+				return
+			}
+			sum := sha256.Sum256(b)
+			sums[v] = hex.EncodeToString(sum[:])
+			if t.After(mtime) {
+				mtime = t
+			}
+		}
+	}
+	walk(v)
+	if len(sums) == 0 {
+		return "", mtime
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\x00", name, sums[name])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8]), mtime
+}
+
+// content and modification time of a local file of a template: read by
+// SimpleGetFile from the static dir, or from the working dir like fonts.
+// false for urls and other values
+func readStaticFile(uri string) ([]byte, time.Time, bool) {
+	u, err := url.Parse(uri)
+	if uri == "" || err != nil {
+		return nil, time.Time{}, false
+	}
+	switch {
+	case u.Scheme == "local":
+		return readFileInfo(os.DirFS(staticRoot), strings.TrimPrefix(u.Path, "/"))
+	case u.Scheme != "":
+		return nil, time.Time{}, false
+	}
+	if staticFs != nil {
+		if b, t, ok := readFileInfo(staticFs, strings.TrimPrefix(uri, "/")); ok {
+			return b, t, true
+		}
+	}
+	fi, err := os.Stat(uri)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, time.Time{}, false
+	}
+	b, err := os.ReadFile(uri)
+	return b, fi.ModTime(), err == nil
+}
+
+func readFileInfo(fsys fs.FS, name string) ([]byte, time.Time, bool) {
+	fi, err := fs.Stat(fsys, name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, time.Time{}, false
+	}
+	b, err := fs.ReadFile(fsys, name)
+	return b, fi.ModTime(), err == nil
+}
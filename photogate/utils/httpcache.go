@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// Cache-Control max-age of rendered images, unless their template
+	// sets cacheMaxAge
+	viper.SetDefault("httpCache.maxAge", 24*time.Hour)
+	// of the placeholder of a failed render, short as the failure may not last
+	viper.SetDefault("httpCache.errorMaxAge", time.Minute)
+}
+
+// MaxAge of the renders of a template with cacheMaxAge d, the default if nil
+func MaxAge(d *time.Duration) time.Duration {
+	if d == nil {
+		return viper.GetDuration("httpCache.maxAge")
+	}
+	return *d
+}
+
+// ETag of a render by its key, which changes with the template version
+// and the inputs
+func ETag(key string) string {
+	return `"` + key + `"`
+}
+
+// SetCacheHeaders sets the validators of a render and its Cache-Control,
+// revalidated on each use if maxAge is 0. mtime is omitted if zero
+func SetCacheHeaders(w http.ResponseWriter, etag string, mtime time.Time, maxAge time.Duration) {
+	h := w.Header()
+	h.Set("ETag", etag)
+	if !mtime.IsZero() {
+		h.Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+	}
+	if maxAge > 0 {
+		h.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+}
+
+// SetErrorCacheHeaders sets the Cache-Control of a placeholder served
+// instead of a render
+func SetErrorCacheHeaders(w http.ResponseWriter) {
+	maxAge := viper.GetDuration("httpCache.errorMaxAge")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+}
+
+// NotModified is true if the request has a copy of the render with etag,
+// or one modified since mtime when it has no If-None-Match
+func NotModified(r *http.Request, etag string, mtime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || mtime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	return !mtime.Truncate(time.Second).After(t)
+}
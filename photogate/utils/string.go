@@ -1,5 +1,29 @@
 package utils
 
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// digits, or digits grouped by three
+var priceRx = regexp.MustCompile(`^(\d+|\d{1,3}([., ]\d{3})+)$`)
+
+// ParsePrice parses a non-negative price, plain or grouped like 120.000,
+// 120,000 or 120 000. false for a decimal part like 99.5
+func ParsePrice(s string) (int64, bool) {
+	s = strings.TrimSpace(s)
+	if !priceRx.MatchString(s) {
+		return 0, false
+	}
+	s = strings.NewReplacer(".", "", ",", "", " ", "").Replace(s)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
 func Ellipsis(s string, maxLen int) string {
 	runes := []rune(s)
 	if len(runes) <= maxLen {
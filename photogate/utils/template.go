@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v3"
+)
+
+// ParseTemplateConfig parses the yaml template file and resolves extends
+// and include, file names are relative to the file using them:
+//
+//	extends: sfsch.yaml # parent template
+//	allWidths: [600]    # other keys replace the keys of the parent
+//	plugins:
+//	- id: price         # keys are merged into the parent plugin with id price
+//	  fontsize: 36
+//	- id: frame
+//	  remove: true      # parent plugin frame is removed
+//	- include: components/price.yaml # replaced by the plugins of the file
+//
+// plugins without id, or with an id the parent does not have, are appended
+func ParseTemplateConfig(fsys fs.FS, file string, b []byte) (map[string]interface{}, error) {
+	m, _, err := ParseTemplateConfigMtime(fsys, file, b)
+	return m, err
+}
+
+// ParseTemplateConfigMtime is ParseTemplateConfig which also returns the
+// latest modification time of the file and the files it extends or
+// includes, zero if none is known like for embedded files
+func ParseTemplateConfigMtime(fsys fs.FS, file string, b []byte) (map[string]interface{}, time.Time, error) {
+	l := &templateLoader{fsys: fsys}
+	l.stat(file)
+	m, err := l.parse(file, b)
+	return m, l.mtime, err
+}
+
+// ModTime of file in fsys, zero if unknown
+func ModTime(fsys fs.FS, file string) time.Time {
+	fi, err := fs.Stat(fsys, file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+type templateLoader struct {
+	fsys fs.FS
+	// files being loaded, to report cycles
+	stack []string
+	// latest modification time of the loaded files
+	mtime time.Time
+}
+
+func (l *templateLoader) stat(file string) {
+	if t := ModTime(l.fsys, file); t.After(l.mtime) {
+		l.mtime = t
+	}
+}
+
+func (l *templateLoader) load(file string) (map[string]interface{}, error) {
+	b, err := fs.ReadFile(l.fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	l.stat(file)
+	return l.parse(file, b)
+}
+
+func (l *templateLoader) parse(file string, b []byte) (map[string]interface{}, error) {
+	for i, f := range l.stack {
+		if f == file {
+			cycle := append(append([]string{}, l.stack[i:]...), file)
+			return nil, fmt.Errorf("%s: cycle %s", file, strings.Join(cycle, " -> "))
+		}
+	}
+	l.stack = append(l.stack, file)
+	defer func() {
+		l.stack = l.stack[:len(l.stack)-1]
+	}()
+
+	var m map[string]interface{}
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+
+	dir := path.Dir(file)
+	if ps, ok := m["plugins"]; ok {
+		resolved, err := l.includePlugins(ps, dir)
+		if err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+		m["plugins"] = resolved
+	}
+
+	parent, ok := m["extends"]
+	if !ok {
+		return m, nil
+	}
+	delete(m, "extends")
+
+	parentFile := cast.ToString(parent)
+	if parentFile == "" {
+		return nil, fmt.Errorf("%s: extends must be a file name", file)
+	}
+	pm, err := l.load(path.Join(dir, parentFile))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("%s: extends %s", file, parentFile))
+	}
+
+	merged, err := mergeTemplateConfig(pm, m)
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	return merged, nil
+}
+
+// replace include entries of plugins, also in plugins of groups
+func (l *templateLoader) includePlugins(v interface{}, dir string) (interface{}, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return v, nil
+	}
+
+	out := make([]interface{}, 0, len(list))
+	for _, item := range list {
+		pm, ok := item.(map[string]interface{})
+		if !ok {
+			out = append(out, item)
+			continue
+		}
+
+		if inc, ok := pm["include"]; ok {
+			incFile := cast.ToString(inc)
+			if incFile == "" {
+				return nil, errors.New("include must be a file name")
+			}
+			cm, err := l.load(path.Join(dir, incFile))
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("include %s", incFile))
+			}
+			ps, _ := cm["plugins"].([]interface{})
+			out = append(out, ps...)
+			continue
+		}
+
+		if children, ok := pm["plugins"]; ok {
+			resolved, err := l.includePlugins(children, dir)
+			if err != nil {
+				return nil, err
+			}
+			pm["plugins"] = resolved
+		}
+		out = append(out, pm)
+	}
+	return out, nil
+}
+
+func mergeTemplateConfig(parent, child map[string]interface{}) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(parent)+len(child))
+	for k, v := range parent {
+		out[k] = v
+	}
+	for k, v := range child {
+		if k != "plugins" {
+			out[k] = v
+		}
+	}
+
+	if cps, ok := child["plugins"]; ok {
+		pps, _ := parent["plugins"].([]interface{})
+		cpl, _ := cps.([]interface{})
+		ps, err := mergePlugins(pps, cpl)
+		if err != nil {
+			return nil, err
+		}
+		out["plugins"] = ps
+	}
+	return out, nil
+}
+
+func pluginID(v interface{}) string {
+	m, _ := v.(map[string]interface{})
+	return cast.ToString(m["id"])
+}
+
+func mergePlugins(parent, child []interface{}) ([]interface{}, error) {
+	out := make([]interface{}, 0, len(parent)+len(child))
+	index := map[string]int{}
+	for _, p := range parent {
+		if id := pluginID(p); id != "" {
+			index[id] = len(out)
+		}
+		out = append(out, p)
+	}
+
+	removed := map[int]bool{}
+	for _, c := range child {
+		id := pluginID(c)
+		i, found := index[id]
+		cm, _ := c.(map[string]interface{})
+		remove := cast.ToBool(cm["remove"])
+
+		if id == "" || !found {
+			if remove {
+				return nil, fmt.Errorf(`remove plugin "%s": not found in parent`, id)
+			}
+			out = append(out, c)
+			continue
+		}
+
+		if remove {
+			removed[i] = true
+			continue
+		}
+		pm := out[i].(map[string]interface{})
+		merged := make(map[string]interface{}, len(pm)+len(cm))
+		for k, v := range pm {
+			merged[k] = v
+		}
+		for k, v := range cm {
+			merged[k] = v
+		}
+		out[i] = merged
+	}
+
+	if len(removed) == 0 {
+		return out, nil
+	}
+	kept := out[:0]
+	for i, p := range out {
+		if !removed[i] {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// reloads of templates by service and result, ok or error
+var TemplateReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "photogate_template_reload_total",
+	Help: "Template files reloaded from the template dir",
+}, []string{"service", "result"})
+
+// WatchDir calls onChange after files in dir or its sub directories change.
+// changes within delay of each other are reported once, as editors write
+// a file in several steps. watching stops when stop is closed
+func WatchDir(dir string, delay time.Duration, onChange func(), stop <-chan struct{}) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// fsnotify does not watch sub directories
+	addTree := func(root string) error {
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return w.Add(path)
+			}
+			return nil
+		})
+	}
+	if err = addTree(dir); err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+
+		timer := time.NewTimer(delay)
+		timer.Stop()
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&fsnotify.Create != 0 {
+					if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+						if err = addTree(ev.Name); err != nil {
+							log.Error().Err(err).Str("dir", ev.Name).Msg("watch dir")
+						}
+					}
+				}
+				// a timer fired but not yet received would report
+				// the change now and again after the delay
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(delay)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Error().Err(err).Str("dir", dir).Msg("watch dir")
+			case <-timer.C:
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}